@@ -0,0 +1,123 @@
+// Package audit records every key operation of the keyprovider as a structured event.
+// Events never contain key material: wrapped keys are only recorded as fingerprint and
+// free text is redacted before it is written to a sink.
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// Operation is the audited key operation.
+type Operation string
+
+const (
+	OperationWrap   Operation = "wrap"
+	OperationUnwrap Operation = "unwrap"
+)
+
+// Key is a key used by an operation.
+type Key struct {
+	URL      string `json:"url"`
+	Provider string `json:"provider,omitempty"`
+}
+
+// Event is the record of one wrap or unwrap request.
+type Event struct {
+	Time      time.Time `json:"time"`
+	Operation Operation `json:"operation"`
+	// Caller identifies the client, see Caller.
+	Caller string `json:"caller,omitempty"`
+	Keys   []Key  `json:"keys,omitempty"`
+	// WrappedKeyFingerprint identifies the wrapped key annotation, see Fingerprint.
+	WrappedKeyFingerprint string `json:"wrapped_key_fingerprint,omitempty"`
+	// Outcome is the grpc status code of the request, "OK" on success.
+	Outcome   string  `json:"outcome"`
+	Error     string  `json:"error,omitempty"`
+	LatencyMs float64 `json:"latency_ms"`
+}
+
+// Sink stores serialized events, one per Write.
+type Sink interface {
+	Write(event []byte) error
+	Close() error
+}
+
+// Logger redacts events and writes them to a sink.
+type Logger struct {
+	mu   sync.Mutex
+	sink Sink
+}
+
+func NewLogger(sink Sink) *Logger {
+	return &Logger{sink: sink}
+}
+
+// Log redacts the event and writes it as a JSON line.
+func (l *Logger) Log(event Event) error {
+	line, err := json.Marshal(Redact(event))
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.sink.Write(line)
+}
+
+// Close flushes and closes the sink.
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.sink.Close()
+}
+
+// Fingerprint returns a hash of a wrapped key, which identifies it across events without recording the ciphertext.
+func Fingerprint(wrappedKey []byte) string {
+	sum := sha256.Sum256(wrappedKey)
+	return hex.EncodeToString(sum[:16])
+}
+
+// CallerIdentity is implemented by the credentials.AuthInfo of transports identifying the caller, e.g. by its process credentials.
+type CallerIdentity interface {
+	CallerIdentity() string
+}
+
+// Caller identifies the client of a grpc request: by the identity of the transport credentials, the subject of a
+// verified client certificate or the peer address. Without a grpc peer, the caller is the parent of this process,
+// which runs ocicrypt cmd keyprovider requests.
+func Caller(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return fmt.Sprintf("uid=%d gid=%d pid=%d", os.Getuid(), os.Getgid(), os.Getppid())
+	}
+	switch info := p.AuthInfo.(type) {
+	case CallerIdentity:
+		return info.CallerIdentity()
+	case credentials.TLSInfo:
+		if cert := verifiedClientCert(info); cert != nil {
+			return "tls:" + cert.Subject.String()
+		}
+	}
+	if p.Addr == nil {
+		return ""
+	}
+	return p.Addr.String()
+}
+
+func verifiedClientCert(info credentials.TLSInfo) *x509.Certificate {
+	if len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return info.State.VerifiedChains[0][0]
+}
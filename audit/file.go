@@ -0,0 +1,101 @@
+package audit
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// FileSink appends events to a file and rotates it when it exceeds the maximum size.
+// Rotated files are named <path>.1 (newest) to <path>.<maxBackups> (oldest).
+type FileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// NewFileSink opens the file for appending. maxSize 0 disables the rotation.
+func NewFileSink(path string, maxSize int64, maxBackups int) (*FileSink, error) {
+	s := &FileSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("opening audit log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+// Write implements Sink. Every event is synced to disk before Write returns.
+// A failed rotation keeps appending to the current file.
+func (s *FileSink) Write(event []byte) error {
+	var rotateErr error
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(event)) > s.maxSize {
+		rotateErr = s.rotate()
+		if s.file == nil {
+			return rotateErr
+		}
+	}
+	n, err := s.file.Write(event)
+	s.size += int64(n)
+	if err == nil {
+		err = s.file.Sync()
+	}
+	return errors.Join(rotateErr, err)
+}
+
+// rotate moves the current file to <path>.1, shifting the backups, and opens a new file.
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.file = nil
+	err := s.shiftBackups()
+	if openErr := s.open(); openErr != nil {
+		return errors.Join(err, openErr)
+	}
+	if err != nil {
+		return fmt.Errorf("rotating audit log: %w", err)
+	}
+	return nil
+}
+
+func (s *FileSink) shiftBackups() error {
+	if s.maxBackups <= 0 {
+		return os.Remove(s.path)
+	}
+	for i := s.maxBackups - 1; i > 0; i-- {
+		err := os.Rename(s.backup(i), s.backup(i+1))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(s.path, s.backup(1))
+}
+
+func (s *FileSink) backup(i int) string {
+	return fmt.Sprintf("%s.%d", s.path, i)
+}
+
+// Close implements Sink.
+func (s *FileSink) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
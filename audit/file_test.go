@@ -0,0 +1,145 @@
+package audit
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// event returns an audit line of 10 bytes.
+func event(i int) []byte {
+	return []byte(fmt.Sprintf("event %03d\n", i))
+}
+
+func newTestFileSink(t *testing.T, path string, maxSize int64, maxBackups int) *FileSink {
+	s, err := NewFileSink(path, maxSize, maxBackups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func writeEvents(t *testing.T, s *FileSink, from, to int) {
+	for i := from; i < to; i++ {
+		if err := s.Write(event(i)); err != nil {
+			t.Fatalf("Write of event %d: %v", i, err)
+		}
+	}
+}
+
+// checkFiles checks the contents of the audit log and its backups, nil for a missing file.
+func checkFiles(t *testing.T, path string, want map[string][]byte) {
+	t.Helper()
+	for name, content := range want {
+		got, err := os.ReadFile(filepath.Join(filepath.Dir(path), name))
+		if content == nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("%s exists with %q, want no file", name, got)
+			}
+			continue
+		}
+		if err != nil || string(got) != string(content) {
+			t.Errorf("%s contains %q, %v, want %q", name, got, err, content)
+		}
+	}
+}
+
+func events(from, to int) []byte {
+	var b []byte
+	for i := from; i < to; i++ {
+		b = append(b, event(i)...)
+	}
+	return b
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	s := newTestFileSink(t, path, 20, 2)
+
+	// two events fit, the third rotates
+	writeEvents(t, s, 0, 3)
+	checkFiles(t, path, map[string][]byte{
+		"audit.log":   events(2, 3),
+		"audit.log.1": events(0, 2),
+		"audit.log.2": nil,
+	})
+
+	// the backups are shifted, the oldest is pruned
+	writeEvents(t, s, 3, 7)
+	checkFiles(t, path, map[string][]byte{
+		"audit.log":   events(6, 7),
+		"audit.log.1": events(4, 6),
+		"audit.log.2": events(2, 4),
+		"audit.log.3": nil,
+	})
+
+	// an event larger than the maximum size is written to a file of its own
+	large := append(events(100, 103), '\n')
+	if err := s.Write(large); err != nil {
+		t.Fatal(err)
+	}
+	writeEvents(t, s, 7, 8)
+	checkFiles(t, path, map[string][]byte{
+		"audit.log":   events(7, 8),
+		"audit.log.1": large,
+		"audit.log.2": events(6, 7),
+	})
+}
+
+func TestFileSinkReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if err := os.WriteFile(path, events(0, 1), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// the size of the existing file counts towards the maximum size
+	s := newTestFileSink(t, path, 20, 1)
+	writeEvents(t, s, 1, 3)
+	checkFiles(t, path, map[string][]byte{
+		"audit.log":   events(2, 3),
+		"audit.log.1": events(0, 2),
+	})
+}
+
+func TestFileSinkNoBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	s := newTestFileSink(t, path, 20, 0)
+	writeEvents(t, s, 0, 5)
+	checkFiles(t, path, map[string][]byte{
+		"audit.log":   events(4, 5),
+		"audit.log.1": nil,
+	})
+}
+
+func TestFileSinkNoRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	s := newTestFileSink(t, path, 0, 2)
+	writeEvents(t, s, 0, 10)
+	checkFiles(t, path, map[string][]byte{
+		"audit.log":   events(0, 10),
+		"audit.log.1": nil,
+	})
+}
+
+func TestFileSinkMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("windows has no unix file modes")
+	}
+	path := filepath.Join(t.TempDir(), "audit.log")
+	s := newTestFileSink(t, path, 20, 2)
+	writeEvents(t, s, 0, 5)
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0o600 {
+			t.Errorf("%s has mode %v, want %v", filepath.Base(name), info.Mode().Perm(), fs.FileMode(0o600))
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package audit
+
+import (
+	"regexp"
+	"strings"
+)
+
+const redacted = "REDACTED"
+
+var (
+	// encodedRun matches runs of base64, base64url or hex characters that may encode key material
+	encodedRun = regexp.MustCompile(`[A-Za-z0-9+/_-]{32,}={0,2}`)
+	// byteSlice matches byte slices printed with %v
+	byteSlice = regexp.MustCompile(`\[(?:\d{1,3} ){15,}\d{1,3}\]`)
+	// pinValue matches the pin attribute of pkcs11 uris
+	pinValue = regexp.MustCompile(`pin-value=[^;&?\s]*`)
+	// userinfo matches the password of urls
+	userinfo = regexp.MustCompile(`(://[^/@\s]*:)[^/@\s]*@`)
+)
+
+// Redact removes secrets from the free text of an event: pkcs11 pins and url passwords from key urls and
+// additionally anything that may encode key material or ciphertext from the error.
+func Redact(event Event) Event {
+	if event.Keys != nil {
+		keys := make([]Key, len(event.Keys))
+		for i, key := range event.Keys {
+			keys[i] = Key{URL: RedactKeyURL(key.URL), Provider: key.Provider}
+		}
+		event.Keys = keys
+	}
+	event.Error = RedactText(event.Error)
+	return event
+}
+
+// RedactKeyURL removes credentials from a key url.
+func RedactKeyURL(url string) string {
+	url = pinValue.ReplaceAllString(url, "pin-value="+redacted)
+	return userinfo.ReplaceAllString(url, "${1}"+redacted+"@")
+}
+
+// RedactText removes credentials and encoded binary data from free text.
+// Long runs of base64 or hex characters are redacted if they look random, i.e. mix upper and lower case
+// letters and digits, or are hex encoded. Key paths like "projects/p/locations/l" are kept.
+func RedactText(text string) string {
+	text = RedactKeyURL(text)
+	text = byteSlice.ReplaceAllString(text, "["+redacted+"]")
+	return encodedRun.ReplaceAllStringFunc(text, func(run string) string {
+		if isHex(run) || mixesClasses(run) {
+			return redacted
+		}
+		return run
+	})
+}
+
+func isHex(s string) bool {
+	return strings.Trim(strings.ToLower(s), "0123456789abcdef") == ""
+}
+
+func mixesClasses(s string) bool {
+	var upper, lower, digit bool
+	for _, r := range s {
+		switch {
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= '0' && r <= '9':
+			digit = true
+		}
+	}
+	return upper && lower && digit
+}
@@ -0,0 +1,42 @@
+//go:build !windows && !plan9
+
+package audit
+
+import (
+	"fmt"
+	"log/syslog"
+	"strings"
+)
+
+// SyslogSink sends events to syslog with the auth facility.
+type SyslogSink struct {
+	writer *syslog.Writer
+}
+
+// NewSyslogSink connects to the syslog daemon at address, "local" for the local daemon
+// or a "<network>://<host>:<port>" address like udp://logs:514.
+func NewSyslogSink(address string, tag string) (*SyslogSink, error) {
+	var network, raddr string
+	if address != "local" {
+		var ok bool
+		network, raddr, ok = strings.Cut(address, "://")
+		if !ok {
+			return nil, fmt.Errorf("invalid syslog address %q, expected local or <network>://<host>:<port>", address)
+		}
+	}
+	writer, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to syslog: %w", err)
+	}
+	return &SyslogSink{writer: writer}, nil
+}
+
+// Write implements Sink.
+func (s *SyslogSink) Write(event []byte) error {
+	return s.writer.Info(strings.TrimSuffix(string(event), "\n"))
+}
+
+// Close implements Sink.
+func (s *SyslogSink) Close() error {
+	return s.writer.Close()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	keyproviderconfig "github.com/containers/ocicrypt/config/keyprovider-config"
+)
+
+// serverFlags only configure the grpc server or the generated config and are not passed on to the cmd keyprovider.
+var serverFlags = map[string]bool{
+	"port":                 true,
+	"socket":               true,
+	"socket-mode":          true,
+	"socket-owner":         true,
+	"allowed-peer-uids":    true,
+	"allowed-peer-gids":    true,
+	"allowed-peer-pids":    true,
+	"tls-cert":             true,
+	"tls-key":              true,
+	"tls-client-ca":        true,
+	"cache-ttl":            true,
+	"cache-max-entries":    true,
+	"metrics-address":      true,
+	"health-address":       true,
+	"health-canary-keys":   true,
+	"health-interval":      true,
+	"health-timeout":       true,
+	"cmd":                  true,
+	"ocicrypt-config":      true,
+	"ocicrypt-config-mode": true,
+
+	// concurrent cmd processes appending to the same audit log would rotate it over each other
+	"audit-log-max-size":    true,
+	"audit-log-max-backups": true,
+}
+
+// serveCmd serves a single cmd keyprovider request with the service of the flags.
+func serveCmd() error {
+	// every request runs in its own process, the audit log is rotated externally
+	auditLog, err := newAuditLogger(false)
+	if err != nil {
+		return err
+	}
+	if auditLog != nil {
+		defer auditLog.Close()
+	}
+	keyProviderService, err := newKeyProviderService(nil, auditLog)
+	if err != nil {
+		return err
+	}
+	defer keyProviderService.Close()
+	return keyProviderService.RunCmd(context.Background(), os.Stdin, os.Stdout)
+}
+
+// keyproviderCommand is the ocicrypt cmd keyprovider running this binary with the kms flags of this process.
+func keyproviderCommand() (*keyproviderconfig.Command, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	return &keyproviderconfig.Command{Path: path, Args: keyproviderArgs(flag.CommandLine)}, nil
+}
+
+// keyproviderArgs returns the arguments of the cmd keyprovider, the set flags without the server flags.
+func keyproviderArgs(flags *flag.FlagSet) []string {
+	args := []string{"-cmd"}
+	flags.Visit(func(f *flag.Flag) {
+		if !serverFlags[f.Name] {
+			args = append(args, fmt.Sprintf("-%s=%s", f.Name, f.Value))
+		}
+	})
+	return args
+}
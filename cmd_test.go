@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestKeyproviderArgs(t *testing.T) {
+	flags := flag.NewFlagSet("kms-ocicrypt", flag.ContinueOnError)
+	flags.Int("port", 9666, "")
+	flags.String("socket", "", "")
+	flags.String("tls-cert", "", "")
+	flags.Duration("cache-ttl", 0, "")
+	flags.String("ocicrypt-config", "", "")
+	flags.String("ocicrypt-config-mode", "grpc", "")
+	flags.Int64("audit-log-max-size", 100, "")
+	flags.String("audit-log", "", "")
+	flags.String("kms-provider", "aws", "")
+	flags.String("kms-region", "", "")
+	flags.String("encryption-context", "", "")
+	flags.Var(&providerFlag[time.Duration]{providers: map[string]time.Duration{}, parse: time.ParseDuration}, "kms-timeout", "")
+	err := flags.Parse([]string{
+		"-port=9000",
+		"-socket=/run/kms-ocicrypt.sock",
+		"-tls-cert=server.pem",
+		"-cache-ttl=5m",
+		"-ocicrypt-config=/etc/ocicrypt.conf",
+		"-ocicrypt-config-mode=cmd",
+		"-audit-log-max-size=10",
+		"-audit-log=/var/log/kms-ocicrypt/audit.log",
+		"-kms-provider=vault,aws",
+		"-encryption-context=repository,label",
+		"-kms-timeout=5s,vault=2s",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args := keyproviderArgs(flags)
+	want := []string{
+		"-cmd",
+		"-audit-log=/var/log/kms-ocicrypt/audit.log",
+		"-encryption-context=repository,label",
+		"-kms-provider=vault,aws",
+		"-kms-timeout=5s,vault=2s",
+	}
+	if !slices.Equal(args, want) {
+		t.Fatalf("keyproviderArgs returned %q, want %q", args, want)
+	}
+
+	// unset flags keep their defaults in the cmd keyprovider
+	if args := keyproviderArgs(flag.NewFlagSet("kms-ocicrypt", flag.ContinueOnError)); !slices.Equal(args, []string{"-cmd"}) {
+		t.Fatalf("keyproviderArgs without flags returned %q", args)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"github.com/hown3d/kms-ocicrypt/audit"
+	keyproviderpb "github.com/hown3d/kms-ocicrypt/gen/go/utils/keyprovider"
+	"github.com/hown3d/kms-ocicrypt/kms"
+	"github.com/hown3d/kms-ocicrypt/service"
+)
+
+// providerStatus is the readiness of a kms provider, as of the last canary check of its keys.
+type providerStatus struct {
+	Ready bool `json:"ready"`
+	// Checked is false for providers without canary keys, which are always ready.
+	Checked   bool       `json:"checked"`
+	LastCheck *time.Time `json:"last_check,omitempty"`
+	// Error is the class of the first error of the last check, e.g. "permission_denied".
+	// The error itself is only logged, redacted.
+	Error string `json:"error,omitempty"`
+}
+
+// readiness checks the canary keys periodically by encrypting and decrypting with them.
+// The service is ready once every canary key passed the last check.
+type readiness struct {
+	service  *service.KeyProviderService
+	keys     []string
+	interval time.Duration
+	timeout  time.Duration
+	grpc     *health.Server
+	stop     chan struct{}
+
+	mu        sync.RWMutex
+	providers map[string]providerStatus
+	checked   bool
+	draining  bool
+}
+
+func newReadiness(s *service.KeyProviderService, keys []string, interval time.Duration, timeout time.Duration) *readiness {
+	r := &readiness{
+		service:   s,
+		keys:      keys,
+		interval:  interval,
+		timeout:   timeout,
+		grpc:      health.NewServer(),
+		stop:      make(chan struct{}),
+		providers: map[string]providerStatus{},
+		checked:   len(keys) == 0,
+	}
+	for _, provider := range s.Providers() {
+		r.providers[provider] = providerStatus{Ready: true}
+	}
+	r.setGRPCStatus(r.checked)
+	return r
+}
+
+// start checks the canary keys now and then every interval, until close.
+func (r *readiness) start() {
+	if len(r.keys) == 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			r.check()
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (r *readiness) close() {
+	close(r.stop)
+}
+
+// shutdown reports the service as not ready while it drains, so no new requests are routed to it.
+func (r *readiness) shutdown() {
+	r.mu.Lock()
+	r.draining = true
+	r.mu.Unlock()
+	r.grpc.Shutdown()
+}
+
+// check runs the canaries of all keys and updates the status of their providers.
+func (r *readiness) check() {
+	providers := map[string]providerStatus{}
+	for _, provider := range r.service.Providers() {
+		providers[provider] = providerStatus{Ready: true}
+	}
+	for _, key := range r.keys {
+		ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+		provider, err := r.service.CheckKey(ctx, key)
+		cancel()
+		if provider == "" {
+			// the key has no enabled provider
+			provider = audit.RedactKeyURL(key)
+		}
+		status := providers[provider]
+		if !status.Checked || status.Ready {
+			now := time.Now()
+			status = providerStatus{Ready: err == nil, Checked: true, LastCheck: &now}
+		}
+		if err != nil {
+			slog.Warn("canary check failed", "key", audit.RedactKeyURL(key), "error", audit.RedactText(err.Error()))
+			if status.Error == "" {
+				status.Error = kms.ErrorClass(err)
+			}
+		}
+		providers[provider] = status
+	}
+
+	ready := true
+	for _, status := range providers {
+		ready = ready && status.Ready
+	}
+	r.mu.Lock()
+	wasReady := r.checked && r.ready()
+	r.providers = providers
+	r.checked = true
+	r.mu.Unlock()
+	if ready != wasReady {
+		slog.Info("readiness changed", "ready", ready)
+	}
+	r.setGRPCStatus(ready)
+}
+
+// ready reports whether all providers are ready, r.mu must be held.
+func (r *readiness) ready() bool {
+	for _, status := range r.providers {
+		if !status.Ready {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *readiness) setGRPCStatus(ready bool) {
+	status := healthpb.HealthCheckResponse_NOT_SERVING
+	if ready {
+		status = healthpb.HealthCheckResponse_SERVING
+	}
+	r.grpc.SetServingStatus("", status)
+	r.grpc.SetServingStatus(keyproviderpb.KeyProviderService_ServiceDesc.ServiceName, status)
+}
+
+// liveHandler serves /healthz, the process is live as long as it serves http.
+func (r *readiness) liveHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+}
+
+// readyHandler serves /readyz with the status of every provider, failing with 503 until all canary keys pass.
+func (r *readiness) readyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		r.mu.RLock()
+		ready := r.checked && !r.draining && r.ready()
+		body, err := json.Marshal(struct {
+			Ready     bool                      `json:"ready"`
+			Providers map[string]providerStatus `json:"providers"`
+		}{Ready: ready, Providers: r.providers})
+		r.mu.RUnlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write(append(body, '\n'))
+	})
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	keyproviderpb "github.com/hown3d/kms-ocicrypt/gen/go/utils/keyprovider"
+	"github.com/hown3d/kms-ocicrypt/kms"
+	"github.com/hown3d/kms-ocicrypt/service"
+)
+
+// newTestReadiness creates the readiness of the canary keys with the local provider on a key directory with the key "ok".
+func newTestReadiness(t *testing.T, keys ...string) *readiness {
+	keyDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(keyDir, "ok"), bytes.Repeat([]byte{1}, 32), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("LOCAL_KMS_KEY_DIR", keyDir)
+	provider, err := kms.New(context.Background(), "local", kms.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := service.NewKeyProviderService(map[string]kms.Provider{"local": provider}, "local", "kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return newReadiness(s, keys, time.Hour, time.Second)
+}
+
+type readyResponse struct {
+	Ready     bool                      `json:"ready"`
+	Providers map[string]providerStatus `json:"providers"`
+}
+
+// getReady requests /readyz and returns the status code, the decoded and the raw body.
+func getReady(t *testing.T, r *readiness) (int, readyResponse, string) {
+	recorder := httptest.NewRecorder()
+	r.readyHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var response readyResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("/readyz returned %q: %v", recorder.Body.String(), err)
+	}
+	return recorder.Code, response, recorder.Body.String()
+}
+
+// grpcStatus returns the grpc health status of the server and the keyprovider service.
+func grpcStatus(t *testing.T, r *readiness) []healthpb.HealthCheckResponse_ServingStatus {
+	var statuses []healthpb.HealthCheckResponse_ServingStatus
+	for _, name := range []string{"", keyproviderpb.KeyProviderService_ServiceDesc.ServiceName} {
+		response, err := r.grpc.Check(context.Background(), &healthpb.HealthCheckRequest{Service: name})
+		if err != nil {
+			t.Fatalf("health check of %q: %v", name, err)
+		}
+		statuses = append(statuses, response.Status)
+	}
+	return statuses
+}
+
+func TestReadinessWithoutCanaryKeys(t *testing.T) {
+	r := newTestReadiness(t)
+	code, response, _ := getReady(t, r)
+	if code != http.StatusOK || !response.Ready || !response.Providers["local"].Ready || response.Providers["local"].Checked {
+		t.Fatalf("/readyz returned %d %+v, want ready and an unchecked local provider", code, response)
+	}
+	for _, status := range grpcStatus(t, r) {
+		if status != healthpb.HealthCheckResponse_SERVING {
+			t.Fatalf("grpc health status is %v, want %v", status, healthpb.HealthCheckResponse_SERVING)
+		}
+	}
+
+	// the live handler doesn't depend on the readiness
+	recorder := httptest.NewRecorder()
+	r.liveHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("/healthz returned %d", recorder.Code)
+	}
+}
+
+func TestReadinessCanaryKeys(t *testing.T) {
+	r := newTestReadiness(t, "file://ok")
+	// not ready before the first check
+	if code, _, _ := getReady(t, r); code != http.StatusServiceUnavailable {
+		t.Fatalf("/readyz returned %d before the first check, want %d", code, http.StatusServiceUnavailable)
+	}
+	for _, status := range grpcStatus(t, r) {
+		if status != healthpb.HealthCheckResponse_NOT_SERVING {
+			t.Fatalf("grpc health status is %v before the first check, want %v", status, healthpb.HealthCheckResponse_NOT_SERVING)
+		}
+	}
+
+	r.check()
+	code, response, _ := getReady(t, r)
+	local := response.Providers["local"]
+	if code != http.StatusOK || !response.Ready || !local.Ready || !local.Checked || local.LastCheck == nil || local.Error != "" {
+		t.Fatalf("/readyz returned %d %+v, want ready", code, response)
+	}
+	for _, status := range grpcStatus(t, r) {
+		if status != healthpb.HealthCheckResponse_SERVING {
+			t.Fatalf("grpc health status is %v, want %v", status, healthpb.HealthCheckResponse_SERVING)
+		}
+	}
+}
+
+func TestReadinessFailedCanaryKey(t *testing.T) {
+	r := newTestReadiness(t, "file://ok", "file://missing-canary")
+	r.check()
+
+	code, response, body := getReady(t, r)
+	local := response.Providers["local"]
+	if code != http.StatusServiceUnavailable || response.Ready || local.Ready || !local.Checked {
+		t.Fatalf("/readyz returned %d %+v, want the local provider not ready", code, response)
+	}
+	// only the error class is served, the error is only logged
+	if local.Error != "not_found" {
+		t.Fatalf("local provider has error %q, want not_found", local.Error)
+	}
+	if strings.Contains(body, "missing-canary") {
+		t.Fatalf("/readyz serves the failed key: %s", body)
+	}
+	for _, status := range grpcStatus(t, r) {
+		if status != healthpb.HealthCheckResponse_NOT_SERVING {
+			t.Fatalf("grpc health status is %v, want %v", status, healthpb.HealthCheckResponse_NOT_SERVING)
+		}
+	}
+
+	// the status follows the next check
+	if err := os.WriteFile(filepath.Join(os.Getenv("LOCAL_KMS_KEY_DIR"), "missing-canary"), bytes.Repeat([]byte{2}, 32), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	r.check()
+	if code, response, _ := getReady(t, r); code != http.StatusOK || !response.Ready {
+		t.Fatalf("/readyz returned %d %+v after the key was created, want ready", code, response)
+	}
+	for _, status := range grpcStatus(t, r) {
+		if status != healthpb.HealthCheckResponse_SERVING {
+			t.Fatalf("grpc health status is %v after the key was created, want %v", status, healthpb.HealthCheckResponse_SERVING)
+		}
+	}
+}
+
+func TestReadinessShutdown(t *testing.T) {
+	r := newTestReadiness(t)
+	r.shutdown()
+	if code, response, _ := getReady(t, r); code != http.StatusServiceUnavailable || response.Ready {
+		t.Fatalf("/readyz returned %d %+v while draining, want not ready", code, response)
+	}
+	for _, status := range grpcStatus(t, r) {
+		if status != healthpb.HealthCheckResponse_NOT_SERVING {
+			t.Fatalf("grpc health status is %v while draining, want %v", status, healthpb.HealthCheckResponse_NOT_SERVING)
+		}
+	}
+	// a check while draining doesn't report the service as serving again
+	r.check()
+	for _, status := range grpcStatus(t, r) {
+		if status != healthpb.HealthCheckResponse_NOT_SERVING {
+			t.Fatalf("grpc health status is %v after a check while draining, want %v", status, healthpb.HealthCheckResponse_NOT_SERVING)
+		}
+	}
+}
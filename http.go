@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// httpServers serves http endpoints with one server per address, so endpoints configured with the same address share a port.
+type httpServers struct {
+	muxes   map[string]*http.ServeMux
+	servers []*http.Server
+}
+
+func newHTTPServers() *httpServers {
+	return &httpServers{muxes: map[string]*http.ServeMux{}}
+}
+
+// handle registers the handler for the pattern on the server of the address.
+func (s *httpServers) handle(address string, pattern string, handler http.Handler) {
+	mux, ok := s.muxes[address]
+	if !ok {
+		mux = http.NewServeMux()
+		s.muxes[address] = mux
+	}
+	mux.Handle(pattern, handler)
+}
+
+// serve listens on all addresses and serves in the background.
+func (s *httpServers) serve() error {
+	for address, mux := range s.muxes {
+		lis, err := net.Listen("tcp", address)
+		if err != nil {
+			return err
+		}
+		server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		s.servers = append(s.servers, server)
+		slog.Info("serving http", "address", lis.Addr().String())
+		go func() {
+			if err := server.Serve(lis); err != nil && err != http.ErrServerClosed {
+				slog.Error("http server stopped", "address", lis.Addr().String(), "error", err)
+			}
+		}()
+	}
+	return nil
+}
+
+// shutdown stops the servers, waiting until ctx is done for running requests like a last metrics scrape.
+func (s *httpServers) shutdown(ctx context.Context) {
+	for _, server := range s.servers {
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Error("shutting down http server", "error", err)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package kms
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// AlgorithmRSAOAEPSHA256 identifies keys wrapped offline with the public key of an asymmetric RSA key.
+// A random AES-256-GCM data key encrypts the plaintext and is encrypted with RSAES-OAEP SHA-256,
+// so only unwrapping needs the kms.
+const AlgorithmRSAOAEPSHA256 = "RSAES_OAEP_SHA_256"
+
+// minRSAKeyBits is the smallest RSA modulus accepted for wrapping.
+const minRSAKeyBits = 2048
+
+// AsymmetricProvider is implemented by providers with asymmetric keys, whose public keys can wrap without calling the kms.
+type AsymmetricProvider interface {
+	// PublicKey returns the public key of keyId, if it can encrypt with algorithm.
+	PublicKey(ctx context.Context, keyId string, algorithm string) (crypto.PublicKey, error)
+	// DecryptAsymmetric decrypts a ciphertext encrypted with the public key of keyId.
+	DecryptAsymmetric(ctx context.Context, cipher []byte, keyId string, algorithm string) ([]byte, error)
+}
+
+// Asymmetric returns the provider as AsymmetricProvider, ok is false if it has no asymmetric keys.
+func Asymmetric(p Provider) (AsymmetricProvider, bool) {
+	if policy, ok := p.(*policyProvider); ok {
+		asymmetric, ok := policy.Provider.(AsymmetricProvider)
+		if !ok {
+			return nil, false
+		}
+		return &policyAsymmetricProvider{AsymmetricProvider: asymmetric, policy: policy}, true
+	}
+	asymmetric, ok := p.(AsymmetricProvider)
+	return asymmetric, ok
+}
+
+// publicKeyWrappedKey is the ciphertext returned by WrapWithPublicKey.
+type publicKeyWrappedKey struct {
+	// WrappedKey is the data key encrypted with the public key.
+	WrappedKey []byte `json:"wrapped_key"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// WrapWithPublicKey encrypts plain with a public key using algorithm. The ciphertext is bound to the encryption context.
+func WrapWithPublicKey(pub crypto.PublicKey, algorithm string, plain []byte, encCtx EncryptionContext) ([]byte, error) {
+	if algorithm != AlgorithmRSAOAEPSHA256 {
+		return nil, fmt.Errorf("unsupported algorithm %q", algorithm)
+	}
+	rsaPub, err := checkRSAPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey := make([]byte, 32)
+	defer clear(dataKey)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	nonce, ciphertext, err := sealAESGCM(dataKey, plain, encCtx.AAD())
+	if err != nil {
+		return nil, err
+	}
+	wrappedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, rsaPub, dataKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(publicKeyWrappedKey{WrappedKey: wrappedKey, Nonce: nonce, Ciphertext: ciphertext})
+}
+
+// UnwrapAsymmetric decrypts a ciphertext of WrapWithPublicKey, the data key is decrypted by the provider.
+func UnwrapAsymmetric(ctx context.Context, p AsymmetricProvider, cipher []byte, keyId string, algorithm string, encCtx EncryptionContext) ([]byte, error) {
+	if algorithm != AlgorithmRSAOAEPSHA256 {
+		return nil, fmt.Errorf("unsupported algorithm %q", algorithm)
+	}
+	var wrapped publicKeyWrappedKey
+	if err := json.Unmarshal(cipher, &wrapped); err != nil {
+		return nil, classified(ErrInvalidCiphertext, fmt.Errorf("decoding wrapped key: %w", err))
+	}
+	dataKey, err := p.DecryptAsymmetric(ctx, wrapped.WrappedKey, keyId, algorithm)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(dataKey)
+	plain, err := openAESGCM(dataKey, wrapped.Nonce, wrapped.Ciphertext, encCtx.AAD())
+	return plain, classified(ErrInvalidCiphertext, err)
+}
+
+// ParsePublicKey parses a PEM encoded public key, optionally base64 encoded, or a DER encoded SubjectPublicKeyInfo.
+func ParsePublicKey(data []byte) (crypto.PublicKey, error) {
+	if decoded, err := base64.StdEncoding.DecodeString(string(data)); err == nil {
+		data = decoded
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		switch block.Type {
+		case "PUBLIC KEY":
+			data = block.Bytes
+		case "RSA PUBLIC KEY":
+			return x509.ParsePKCS1PublicKey(block.Bytes)
+		default:
+			return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+		}
+	}
+	pub, err := x509.ParsePKIXPublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing public key: %w", err)
+	}
+	return pub, nil
+}
+
+func checkRSAPublicKey(pub crypto.PublicKey) (*rsa.PublicKey, error) {
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not an RSA key")
+	}
+	if rsaPub.N.BitLen() < minRSAKeyBits {
+		return nil, fmt.Errorf("RSA key has %d bits, at least %d are needed", rsaPub.N.BitLen(), minRSAKeyBits)
+	}
+	return rsaPub, nil
+}
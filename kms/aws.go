@@ -2,63 +2,157 @@ package kms
 
 import (
 	"context"
+	"crypto"
+	"errors"
 	"fmt"
-	"log"
+	"slices"
+	"sync"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	aws_kms "github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+	"github.com/aws/smithy-go"
 )
 
 func init() {
-	awsKms, err := newKMS()
-	if err != nil {
-		log.Fatal(err)
-	}
-	register("aws", awsKms)
+	register("aws", newKMS)
 }
 
 type awsKms struct {
 	client *aws_kms.Client
+	// publicKeys caches the public keys of asymmetric keys by keyId and algorithm
+	publicKeys sync.Map
 }
 
 // Interface compliance
-var _ Provider = (*awsKms)(nil)
+var (
+	_ Provider           = (*awsKms)(nil)
+	_ AsymmetricProvider = (*awsKms)(nil)
+)
 
 // Decrypt implements kms.KMS.
-func (k *awsKms) Decrypt(ctx context.Context, cipher []byte, keyId string) ([]byte, error) {
+func (k *awsKms) Decrypt(ctx context.Context, cipher []byte, keyId string, encCtx EncryptionContext) ([]byte, error) {
 	req := &aws_kms.DecryptInput{
-		KeyId:          &keyId,
-		CiphertextBlob: cipher,
+		KeyId:             &keyId,
+		CiphertextBlob:    cipher,
+		EncryptionContext: encCtx,
 	}
 	resp, err := k.client.Decrypt(ctx, req)
 	if err != nil {
-		return nil, err
+		return nil, awsError(err)
 	}
 	return resp.Plaintext, nil
 }
 
 // Encrypt implements kms.KMS.
-func (k *awsKms) Encrypt(ctx context.Context, plain []byte, keyId string) ([]byte, error) {
+func (k *awsKms) Encrypt(ctx context.Context, plain []byte, keyId string, encCtx EncryptionContext) ([]byte, error) {
 	req := &aws_kms.EncryptInput{
-		KeyId:     &keyId,
-		Plaintext: plain,
+		KeyId:             &keyId,
+		Plaintext:         plain,
+		EncryptionContext: encCtx,
 	}
 	resp, err := k.client.Encrypt(ctx, req)
 	if err != nil {
-		return nil, err
+		return nil, awsError(err)
 	}
 	return resp.CiphertextBlob, nil
 }
 
-func newKMS() (*awsKms, error) {
+// SupportsEncryptionContext implements kms.KMS.
+func (k *awsKms) SupportsEncryptionContext() bool {
+	return true
+}
+
+// PublicKey implements kms.AsymmetricProvider.
+// Public keys are fetched once with GetPublicKey and cached, encrypting with them needs no kms:Encrypt permission.
+func (k *awsKms) PublicKey(ctx context.Context, keyId string, algorithm string) (crypto.PublicKey, error) {
+	cacheKey := keyId + "/" + algorithm
+	if pub, ok := k.publicKeys.Load(cacheKey); ok {
+		return pub, nil
+	}
+	resp, err := k.client.GetPublicKey(ctx, &aws_kms.GetPublicKeyInput{KeyId: &keyId})
+	if err != nil {
+		return nil, awsError(err)
+	}
+	if resp.KeyUsage != types.KeyUsageTypeEncryptDecrypt {
+		return nil, fmt.Errorf("key %s has usage %s, not %s", keyId, resp.KeyUsage, types.KeyUsageTypeEncryptDecrypt)
+	}
+	if !slices.Contains(resp.EncryptionAlgorithms, types.EncryptionAlgorithmSpec(algorithm)) {
+		return nil, fmt.Errorf("key %s does not support %s", keyId, algorithm)
+	}
+	pub, err := ParsePublicKey(resp.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	k.publicKeys.Store(cacheKey, pub)
+	return pub, nil
+}
+
+// DecryptAsymmetric implements kms.AsymmetricProvider.
+func (k *awsKms) DecryptAsymmetric(ctx context.Context, cipher []byte, keyId string, algorithm string) ([]byte, error) {
+	req := &aws_kms.DecryptInput{
+		KeyId:               &keyId,
+		CiphertextBlob:      cipher,
+		EncryptionAlgorithm: types.EncryptionAlgorithmSpec(algorithm),
+	}
+	resp, err := k.client.Decrypt(ctx, req)
+	if err != nil {
+		return nil, awsError(err)
+	}
+	return resp.Plaintext, nil
+}
+
+// awsError classifies the errors of the AWS KMS API by their error code.
+func awsError(err error) error {
+	if err, ok := classifyTransport(err); ok {
+		return err
+	}
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+	switch apiErr.ErrorCode() {
+	case "NotFoundException":
+		return classified(ErrNotFound, err)
+	case "AccessDeniedException", "UnrecognizedClientException", "InvalidSignatureException", "ExpiredTokenException":
+		return classified(ErrPermissionDenied, err)
+	case "DisabledException", "KMSInvalidStateException", "KeyUnavailableException":
+		return classified(ErrKeyDisabled, err)
+	case "ThrottlingException", "LimitExceededException":
+		return classified(ErrThrottled, err)
+	case "KMSInternalException", "DependencyTimeoutException", "ServiceUnavailableException":
+		return classified(ErrUnavailable, err)
+	case "InvalidCiphertextException", "IncorrectKeyException", "InvalidKeyUsageException":
+		return classified(ErrInvalidCiphertext, err)
+	}
+	return err
+}
+
+func newKMS(ctx context.Context, kmsCfg Config) (Provider, error) {
+	var opts []func(*config.LoadOptions) error
+	if kmsCfg.Region != "" {
+		opts = append(opts, config.WithRegion(kmsCfg.Region))
+	}
+	if kmsCfg.Profile != "" {
+		opts = append(opts, config.WithSharedConfigProfile(kmsCfg.Profile))
+	}
 	// Using the SDK's default configuration, loading additional config
 	// and credentials values from the environment variables, shared
 	// credentials, and shared configuration files
-	cfg, err := config.LoadDefaultConfig(context.TODO())
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("unable to load SDK config: %w", err)
 	}
 
-	client := aws_kms.NewFromConfig(cfg)
+	client := aws_kms.NewFromConfig(cfg, func(o *aws_kms.Options) {
+		if kmsCfg.Endpoint != "" {
+			o.BaseEndpoint = aws.String(kmsCfg.Endpoint)
+		}
+		if kmsCfg.Retry.MaxAttempts > 1 {
+			// calls are retried by the retry policy, SDK retries would multiply the attempts
+			o.Retryer = aws.NopRetryer{}
+		}
+	})
 	return &awsKms{client: client}, nil
 }
@@ -0,0 +1,267 @@
+package kms
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeAWSKey is a key of the fake, an AES key or an RSA key pair with its usage and encryption algorithms.
+type fakeAWSKey struct {
+	aesKey     []byte
+	rsaKey     *rsa.PrivateKey
+	usage      string
+	algorithms []string
+}
+
+// fakeAWSKMS is an in-process stand-in for the Encrypt, Decrypt and GetPublicKey actions of the AWS KMS json protocol.
+type fakeAWSKMS struct {
+	mu    sync.Mutex
+	keys  map[string]fakeAWSKey
+	calls map[string]int
+}
+
+func newFakeAWSKMS(t *testing.T) (*fakeAWSKMS, *httptest.Server) {
+	f := &fakeAWSKMS{keys: map[string]fakeAWSKey{}, calls: map[string]int{}}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return f, server
+}
+
+// addAESKey adds a symmetric key.
+func (f *fakeAWSKMS) addAESKey(t *testing.T, keyId string) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.keys[keyId] = fakeAWSKey{aesKey: key, usage: "ENCRYPT_DECRYPT", algorithms: []string{"SYMMETRIC_DEFAULT"}}
+}
+
+// addRSAKey adds an RSA key pair with the usage and encryption algorithms.
+func (f *fakeAWSKMS) addRSAKey(t *testing.T, keyId string, usage string, algorithms ...string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.keys[keyId] = fakeAWSKey{rsaKey: key, usage: usage, algorithms: algorithms}
+}
+
+func (f *fakeAWSKMS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	action := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "TrentService.")
+	var req struct {
+		KeyId               string
+		Plaintext           []byte
+		CiphertextBlob      []byte
+		EncryptionContext   EncryptionContext
+		EncryptionAlgorithm string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		awsErrorResponse(w, "SerializationException", err.Error())
+		return
+	}
+	f.mu.Lock()
+	f.calls[action]++
+	key, ok := f.keys[req.KeyId]
+	f.mu.Unlock()
+	if !ok {
+		awsErrorResponse(w, "NotFoundException", "Key '"+req.KeyId+"' does not exist")
+		return
+	}
+	if req.EncryptionAlgorithm == "" {
+		req.EncryptionAlgorithm = "SYMMETRIC_DEFAULT"
+	}
+
+	switch action {
+	case "Encrypt":
+		if key.aesKey == nil || req.EncryptionAlgorithm != "SYMMETRIC_DEFAULT" {
+			awsErrorResponse(w, "InvalidKeyUsageException", "the key does not support "+req.EncryptionAlgorithm)
+			return
+		}
+		nonce, ciphertext, err := sealAESGCM(key.aesKey, req.Plaintext, req.EncryptionContext.AAD())
+		if err != nil {
+			awsErrorResponse(w, "KMSInternalException", err.Error())
+			return
+		}
+		awsResponse(w, map[string]any{"KeyId": req.KeyId, "CiphertextBlob": append(nonce, ciphertext...)})
+	case "Decrypt":
+		var plain []byte
+		var err error
+		switch {
+		case key.aesKey != nil && req.EncryptionAlgorithm == "SYMMETRIC_DEFAULT":
+			if len(req.CiphertextBlob) < gcmNonceSize {
+				err = errors.New("ciphertext too short")
+				break
+			}
+			plain, err = openAESGCM(key.aesKey, req.CiphertextBlob[:gcmNonceSize], req.CiphertextBlob[gcmNonceSize:], req.EncryptionContext.AAD())
+		case key.rsaKey != nil && key.usage == "ENCRYPT_DECRYPT" && req.EncryptionAlgorithm == "RSAES_OAEP_SHA_256":
+			plain, err = rsa.DecryptOAEP(sha256.New(), nil, key.rsaKey, req.CiphertextBlob, nil)
+		default:
+			awsErrorResponse(w, "InvalidKeyUsageException", "the key does not support "+req.EncryptionAlgorithm)
+			return
+		}
+		if err != nil {
+			awsErrorResponse(w, "InvalidCiphertextException", "")
+			return
+		}
+		awsResponse(w, map[string]any{"KeyId": req.KeyId, "Plaintext": plain, "EncryptionAlgorithm": req.EncryptionAlgorithm})
+	case "GetPublicKey":
+		if key.rsaKey == nil {
+			awsErrorResponse(w, "UnsupportedOperationException", "GetPublicKey is not supported for symmetric keys")
+			return
+		}
+		der, err := x509.MarshalPKIXPublicKey(&key.rsaKey.PublicKey)
+		if err != nil {
+			awsErrorResponse(w, "KMSInternalException", err.Error())
+			return
+		}
+		awsResponse(w, map[string]any{
+			"KeyId":                req.KeyId,
+			"PublicKey":            der,
+			"KeySpec":              "RSA_2048",
+			"KeyUsage":             key.usage,
+			"EncryptionAlgorithms": key.algorithms,
+		})
+	default:
+		awsErrorResponse(w, "UnknownOperationException", action)
+	}
+}
+
+func (f *fakeAWSKMS) callCount(action string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[action]
+}
+
+func awsResponse(w http.ResponseWriter, body any) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	json.NewEncoder(w).Encode(body)
+}
+
+func awsErrorResponse(w http.ResponseWriter, code string, message string) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.Header().Set("X-Amzn-Errortype", code)
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"__type": code, "message": message})
+}
+
+func newTestAWS(t *testing.T, endpoint string) *awsKms {
+	// static credentials, no shared config of the host
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+	provider, err := newKMS(context.Background(), Config{Region: "eu-central-1", Endpoint: endpoint})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider.(*awsKms)
+}
+
+func TestAWSWrapUnwrap(t *testing.T) {
+	fake, server := newFakeAWSKMS(t)
+	fake.addAESKey(t, "alias/layers")
+	aws := newTestAWS(t, server.URL)
+	ctx := context.Background()
+	plain := []byte("layer key")
+	encCtx := EncryptionContext{"repository": "registry.example.com/app"}
+
+	cipher, err := aws.Encrypt(ctx, plain, "alias/layers", encCtx)
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	decrypted, err := aws.Decrypt(ctx, cipher, "alias/layers", encCtx)
+	if err != nil {
+		t.Fatalf("Decrypt: %v", err)
+	}
+	if !bytes.Equal(decrypted, plain) {
+		t.Fatalf("Decrypt returned %q, want %q", decrypted, plain)
+	}
+
+	if _, err := aws.Decrypt(ctx, cipher, "alias/layers", EncryptionContext{"repository": "registry.example.com/other"}); !errors.Is(err, ErrInvalidCiphertext) {
+		t.Fatalf("Decrypt with another encryption context returned %v, want %v", err, ErrInvalidCiphertext)
+	}
+	if _, err := aws.Encrypt(ctx, plain, "alias/missing", nil); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Encrypt with a missing key returned %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestAWSAsymmetricWrapUnwrap(t *testing.T) {
+	fake, server := newFakeAWSKMS(t)
+	fake.addRSAKey(t, "alias/rsa", "ENCRYPT_DECRYPT", "RSAES_OAEP_SHA_1", "RSAES_OAEP_SHA_256")
+	aws := newTestAWS(t, server.URL)
+	ctx := context.Background()
+	plain := []byte("layer key")
+	encCtx := EncryptionContext{"repository": "registry.example.com/app"}
+
+	pub, err := aws.PublicKey(ctx, "alias/rsa", AlgorithmRSAOAEPSHA256)
+	if err != nil {
+		t.Fatalf("PublicKey: %v", err)
+	}
+	// wrapping needs no kms call
+	cipher, err := WrapWithPublicKey(pub, AlgorithmRSAOAEPSHA256, plain, encCtx)
+	if err != nil {
+		t.Fatalf("WrapWithPublicKey: %v", err)
+	}
+	decrypted, err := UnwrapAsymmetric(ctx, aws, cipher, "alias/rsa", AlgorithmRSAOAEPSHA256, encCtx)
+	if err != nil {
+		t.Fatalf("UnwrapAsymmetric: %v", err)
+	}
+	if !bytes.Equal(decrypted, plain) {
+		t.Fatalf("UnwrapAsymmetric returned %q, want %q", decrypted, plain)
+	}
+	if _, err := UnwrapAsymmetric(ctx, aws, cipher, "alias/rsa", AlgorithmRSAOAEPSHA256, nil); !errors.Is(err, ErrInvalidCiphertext) {
+		t.Fatalf("UnwrapAsymmetric without encryption context returned %v, want %v", err, ErrInvalidCiphertext)
+	}
+
+	// the public key is fetched once
+	if _, err := aws.PublicKey(ctx, "alias/rsa", AlgorithmRSAOAEPSHA256); err != nil {
+		t.Fatal(err)
+	}
+	if calls := fake.callCount("GetPublicKey"); calls != 1 {
+		t.Fatalf("GetPublicKey was called %d times, want 1", calls)
+	}
+	if _, err := aws.Encrypt(ctx, plain, "alias/rsa", nil); !errors.Is(err, ErrInvalidCiphertext) {
+		t.Fatalf("Encrypt with an asymmetric key returned %v, want the invalid key usage", err)
+	}
+}
+
+func TestAWSPublicKeyRejected(t *testing.T) {
+	fake, server := newFakeAWSKMS(t)
+	fake.addAESKey(t, "alias/layers")
+	fake.addRSAKey(t, "alias/sign", "SIGN_VERIFY", "RSASSA_PSS_SHA_256")
+	fake.addRSAKey(t, "alias/sha1", "ENCRYPT_DECRYPT", "RSAES_OAEP_SHA_1")
+	aws := newTestAWS(t, server.URL)
+
+	tests := []struct {
+		keyId string
+		want  string
+	}{
+		{keyId: "alias/sign", want: "has usage SIGN_VERIFY"},
+		{keyId: "alias/sha1", want: "does not support RSAES_OAEP_SHA_256"},
+		{keyId: "alias/layers", want: "UnsupportedOperationException"},
+		{keyId: "alias/missing", want: ErrNotFound.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.keyId, func(t *testing.T) {
+			pub, err := aws.PublicKey(context.Background(), tt.keyId, AlgorithmRSAOAEPSHA256)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("PublicKey returned %v, %v, want an error containing %q", pub, err, tt.want)
+			}
+		})
+	}
+}
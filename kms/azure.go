@@ -0,0 +1,265 @@
+package kms
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/security/keyvault/azkeys"
+)
+
+func init() {
+	register("azure", newAzure)
+}
+
+// azureKms wraps keys with the wrapKey/unwrapKey operations of Azure Key Vault or Managed HSM.
+// RSA keys use RSA-OAEP-256, symmetric Managed HSM keys use AES key wrap (A256KW).
+type azureKms struct {
+	algorithm     azkeys.EncryptionAlgorithm
+	credential    azcore.TokenCredential
+	clientOptions *azkeys.ClientOptions
+
+	mu         sync.Mutex
+	clients    map[string]*azkeys.Client
+	algorithms map[string]azkeys.EncryptionAlgorithm
+}
+
+// Interface compliance
+var _ Provider = (*azureKms)(nil)
+
+// azureWrappedKey is the ciphertext returned by azureKms.
+// It records the exact key version and algorithm, so unwrapping keeps working after the key was rotated.
+type azureWrappedKey struct {
+	KID       string                     `json:"kid"`
+	Algorithm azkeys.EncryptionAlgorithm `json:"alg"`
+	Value     []byte                     `json:"value"`
+}
+
+// azureKeyId is a parsed key identifier https://<vault>/keys/<name>[/<version>]
+type azureKeyId struct {
+	vaultURL string
+	name     string
+	version  string
+}
+
+// Encrypt implements kms.KMS.
+func (k *azureKms) Encrypt(ctx context.Context, plain []byte, keyId string, _ EncryptionContext) ([]byte, error) {
+	id, err := parseAzureKeyId(keyId)
+	if err != nil {
+		return nil, err
+	}
+	client, err := k.getClient(id.vaultURL)
+	if err != nil {
+		return nil, err
+	}
+	algorithm, err := k.wrapAlgorithm(ctx, client, id)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.WrapKey(ctx, id.name, id.version, azkeys.KeyOperationParameters{
+		Algorithm: &algorithm,
+		Value:     plain,
+	}, nil)
+	if err != nil {
+		return nil, azureError(err)
+	}
+	if resp.KID == nil {
+		return nil, errors.New("wrapKey response contains no key identifier")
+	}
+	return json.Marshal(azureWrappedKey{
+		KID:       string(*resp.KID),
+		Algorithm: algorithm,
+		Value:     resp.Result,
+	})
+}
+
+// Decrypt implements kms.KMS.
+func (k *azureKms) Decrypt(ctx context.Context, cipher []byte, keyId string, _ EncryptionContext) ([]byte, error) {
+	id, err := parseAzureKeyId(keyId)
+	if err != nil {
+		return nil, err
+	}
+	var wrapped azureWrappedKey
+	if err := json.Unmarshal(cipher, &wrapped); err != nil {
+		return nil, classified(ErrInvalidCiphertext, fmt.Errorf("malformed azure wrapped key: %w", err))
+	}
+	wrappedId, err := parseAzureKeyId(wrapped.KID)
+	if err != nil {
+		return nil, classified(ErrInvalidCiphertext, err)
+	}
+	if wrappedId.vaultURL != id.vaultURL || wrappedId.name != id.name {
+		return nil, classified(ErrInvalidCiphertext, fmt.Errorf("key was wrapped with %s, not %s", wrapped.KID, keyId))
+	}
+	if id.version != "" && id.version != wrappedId.version {
+		return nil, classified(ErrInvalidCiphertext, fmt.Errorf("key was wrapped with version %s, not %s", wrappedId.version, id.version))
+	}
+
+	client, err := k.getClient(id.vaultURL)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.UnwrapKey(ctx, wrappedId.name, wrappedId.version, azkeys.KeyOperationParameters{
+		Algorithm: &wrapped.Algorithm,
+		Value:     wrapped.Value,
+	}, nil)
+	if err != nil {
+		return nil, azureError(err)
+	}
+	return resp.Result, nil
+}
+
+// SupportsEncryptionContext implements kms.KMS.
+// wrapKey accepts no additional authenticated data for RSA-OAEP and AES key wrap.
+func (k *azureKms) SupportsEncryptionContext() bool {
+	return false
+}
+
+// azureError classifies the errors of the Key Vault API by status and error code.
+func azureError(err error) error {
+	var authErr *azidentity.AuthenticationFailedError
+	if errors.As(err, &authErr) {
+		return classified(ErrPermissionDenied, err)
+	}
+	var respErr *azcore.ResponseError
+	if !errors.As(err, &respErr) {
+		err, _ = classifyTransport(err)
+		return err
+	}
+	switch {
+	case respErr.ErrorCode == "KeyDisabled" || strings.Contains(strings.ToLower(err.Error()), "disabled key"):
+		return classified(ErrKeyDisabled, err)
+	case respErr.StatusCode == http.StatusNotFound:
+		return classified(ErrNotFound, err)
+	case respErr.StatusCode == http.StatusUnauthorized || respErr.StatusCode == http.StatusForbidden:
+		return classified(ErrPermissionDenied, err)
+	case respErr.StatusCode == http.StatusTooManyRequests:
+		return classified(ErrThrottled, err)
+	case respErr.StatusCode >= 500:
+		return classified(ErrUnavailable, err)
+	case respErr.StatusCode == http.StatusBadRequest:
+		// unwrapping a value not wrapped by the key
+		return classified(ErrInvalidCiphertext, err)
+	}
+	return err
+}
+
+func parseAzureKeyId(keyId string) (azureKeyId, error) {
+	u, err := url.Parse(keyId)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return azureKeyId{}, fmt.Errorf("invalid azure key identifier %q", keyId)
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] != "keys" || parts[1] == "" {
+		return azureKeyId{}, fmt.Errorf("invalid azure key identifier %q, expected https://<vault>/keys/<name>[/<version>]", keyId)
+	}
+	id := azureKeyId{
+		vaultURL: u.Scheme + "://" + u.Host,
+		name:     parts[1],
+	}
+	if len(parts) == 3 {
+		id.version = parts[2]
+	}
+	return id, nil
+}
+
+// wrapAlgorithm returns the configured algorithm or derives it from the key type.
+func (k *azureKms) wrapAlgorithm(ctx context.Context, client *azkeys.Client, id azureKeyId) (azkeys.EncryptionAlgorithm, error) {
+	if k.algorithm != "" {
+		return k.algorithm, nil
+	}
+	cacheKey := id.vaultURL + "/" + id.name
+	k.mu.Lock()
+	algorithm, ok := k.algorithms[cacheKey]
+	k.mu.Unlock()
+	if ok {
+		return algorithm, nil
+	}
+
+	resp, err := client.GetKey(ctx, id.name, id.version, nil)
+	if err != nil {
+		return "", fmt.Errorf("getting key type: %w", azureError(err))
+	}
+	if resp.Key == nil || resp.Key.Kty == nil {
+		return "", errors.New("key has no key type")
+	}
+	switch *resp.Key.Kty {
+	case azkeys.KeyTypeRSA, azkeys.KeyTypeRSAHSM:
+		algorithm = azkeys.EncryptionAlgorithmRSAOAEP256
+	case azkeys.KeyTypeOct, azkeys.KeyTypeOctHSM:
+		algorithm = azkeys.EncryptionAlgorithmA256KW
+	default:
+		return "", fmt.Errorf("key type %s does not support wrapKey", *resp.Key.Kty)
+	}
+
+	k.mu.Lock()
+	k.algorithms[cacheKey] = algorithm
+	k.mu.Unlock()
+	return algorithm, nil
+}
+
+// getClient returns the client for a vault.
+func (k *azureKms) getClient(vaultURL string) (*azkeys.Client, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if client, ok := k.clients[vaultURL]; ok {
+		return client, nil
+	}
+	client, err := azkeys.NewClient(vaultURL, k.credential, k.clientOptions)
+	if err != nil {
+		return nil, fmt.Errorf("creating key vault client: %w", err)
+	}
+	k.clients[vaultURL] = client
+	return client, nil
+}
+
+// newAzureCredential chains workload identity (AZURE_FEDERATED_TOKEN_FILE) and
+// client credentials (AZURE_CLIENT_SECRET or AZURE_CLIENT_CERTIFICATE_PATH) from the environment.
+func newAzureCredential() (azcore.TokenCredential, error) {
+	var sources []azcore.TokenCredential
+	var errs []error
+	workloadIdentity, err := azidentity.NewWorkloadIdentityCredential(nil)
+	if err == nil {
+		sources = append(sources, workloadIdentity)
+	} else {
+		errs = append(errs, err)
+	}
+	clientCredentials, err := azidentity.NewEnvironmentCredential(nil)
+	if err == nil {
+		sources = append(sources, clientCredentials)
+	} else {
+		errs = append(errs, err)
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no azure credentials configured: %w", errors.Join(errs...))
+	}
+	return azidentity.NewChainedTokenCredential(sources, nil)
+}
+
+// newAzure configures the provider. AZURE_KEYVAULT_WRAP_ALGORITHM overrides the algorithm derived from the key type.
+func newAzure(_ context.Context, cfg Config) (Provider, error) {
+	credential, err := newAzureCredential()
+	if err != nil {
+		return nil, err
+	}
+	var clientOptions *azkeys.ClientOptions
+	if cfg.Retry.MaxAttempts > 1 {
+		// calls are retried by the retry policy, SDK retries would multiply the attempts
+		clientOptions = &azkeys.ClientOptions{ClientOptions: azcore.ClientOptions{Retry: policy.RetryOptions{MaxRetries: -1}}}
+	}
+	return &azureKms{
+		algorithm:     azkeys.EncryptionAlgorithm(os.Getenv("AZURE_KEYVAULT_WRAP_ALGORITHM")),
+		credential:    credential,
+		clientOptions: clientOptions,
+		clients:       map[string]*azkeys.Client{},
+		algorithms:    map[string]azkeys.EncryptionAlgorithm{},
+	}, nil
+}
@@ -0,0 +1,281 @@
+package kms
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/security/keyvault/azkeys"
+)
+
+const fakeAzureToken = "test-token"
+
+// fakeKeyVault is an in-process stand-in for the getKey, wrapKey and unwrapKey operations of Azure Key Vault,
+// including the authentication challenge. Keys are RSA keys created on first use, except for the names of the
+// failure responses. Wrapping is simulated with AES-GCM.
+type fakeKeyVault struct {
+	url string
+
+	mu   sync.Mutex
+	keys map[string][]byte
+	// failures maps key names to the status code and error code returned for them
+	failures map[string]fakeAzureFailure
+	// calls counts the authenticated requests by key name
+	calls map[string]int
+}
+
+type fakeAzureFailure struct {
+	status  int
+	code    string
+	message string
+}
+
+func newFakeKeyVault(t *testing.T) (*fakeKeyVault, *httptest.Server) {
+	f := &fakeKeyVault{keys: map[string][]byte{}, failures: map[string]fakeAzureFailure{}, calls: map[string]int{}}
+	// bearer tokens are only sent over tls
+	server := httptest.NewTLSServer(f)
+	t.Cleanup(server.Close)
+	f.url = server.URL
+	return f, server
+}
+
+func (f *fakeKeyVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+fakeAzureToken {
+		w.Header().Set("WWW-Authenticate", `Bearer authorization="https://login.microsoftonline.com/tenant" resource="https://vault.azure.net"`)
+		azureErrorResponse(w, fakeAzureFailure{status: http.StatusUnauthorized, code: "Unauthorized", message: "AKV10000: Request is missing a Bearer or PoP token."})
+		return
+	}
+	// /keys/<name>[/<version>][/<operation>]
+	var parts []string
+	for _, part := range strings.Split(r.URL.Path, "/") {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) < 2 || parts[0] != "keys" {
+		azureErrorResponse(w, fakeAzureFailure{status: http.StatusNotFound, code: "NotFound", message: "no route"})
+		return
+	}
+	name := parts[1]
+	f.mu.Lock()
+	f.calls[name]++
+	failure, failed := f.failures[name]
+	f.mu.Unlock()
+	if failed {
+		azureErrorResponse(w, failure)
+		return
+	}
+	kid := f.url + "/keys/" + name + "/v1"
+	key := f.key(name)
+
+	if r.Method == http.MethodGet {
+		azureResponse(w, map[string]any{"key": map[string]any{"kid": kid, "kty": "RSA"}})
+		return
+	}
+	var req struct {
+		Algorithm string `json:"alg"`
+		Value     string `json:"value"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		azureErrorResponse(w, fakeAzureFailure{status: http.StatusBadRequest, code: "BadParameter", message: err.Error()})
+		return
+	}
+	value, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(req.Value, "="))
+	if err != nil {
+		azureErrorResponse(w, fakeAzureFailure{status: http.StatusBadRequest, code: "BadParameter", message: err.Error()})
+		return
+	}
+	aad := []byte(req.Algorithm)
+	var result []byte
+	switch parts[len(parts)-1] {
+	case "wrapkey":
+		nonce, ciphertext, err := sealAESGCM(key, value, aad)
+		if err != nil {
+			azureErrorResponse(w, fakeAzureFailure{status: http.StatusInternalServerError, code: "InternalError", message: err.Error()})
+			return
+		}
+		result = append(nonce, ciphertext...)
+	case "unwrapkey":
+		if len(value) >= 12 {
+			result, err = openAESGCM(key, value[:12], value[12:], aad)
+		}
+		if len(value) < 12 || err != nil {
+			azureErrorResponse(w, fakeAzureFailure{status: http.StatusBadRequest, code: "BadParameter", message: "Unwrap failed"})
+			return
+		}
+	default:
+		azureErrorResponse(w, fakeAzureFailure{status: http.StatusNotFound, code: "NotFound", message: "no route"})
+		return
+	}
+	azureResponse(w, map[string]any{"kid": kid, "value": base64.RawURLEncoding.EncodeToString(result)})
+}
+
+func (f *fakeKeyVault) key(name string) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key, ok := f.keys[name]
+	if !ok {
+		key = make([]byte, 32)
+		rand.Read(key)
+		f.keys[name] = key
+	}
+	return key
+}
+
+// fail returns the failure responses for the key names.
+func (f *fakeKeyVault) fail(failures map[string]fakeAzureFailure) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for name, failure := range failures {
+		f.failures[name] = failure
+	}
+}
+
+func azureResponse(w http.ResponseWriter, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+func azureErrorResponse(w http.ResponseWriter, failure fakeAzureFailure) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(failure.status)
+	json.NewEncoder(w).Encode(map[string]any{"error": map[string]string{"code": failure.code, "message": failure.message}})
+}
+
+type fakeAzureCredential struct{}
+
+func (fakeAzureCredential) GetToken(context.Context, policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	return azcore.AccessToken{Token: fakeAzureToken, ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+func newTestAzure(server *httptest.Server) *azureKms {
+	return &azureKms{
+		credential: fakeAzureCredential{},
+		clientOptions: &azkeys.ClientOptions{
+			ClientOptions:                        azcore.ClientOptions{Transport: server.Client()},
+			DisableChallengeResourceVerification: true,
+		},
+		clients:    map[string]*azkeys.Client{},
+		algorithms: map[string]azkeys.EncryptionAlgorithm{},
+	}
+}
+
+func TestAzureWrapUnwrap(t *testing.T) {
+	fake, server := newFakeKeyVault(t)
+	azure := newTestAzure(server)
+	ctx := context.Background()
+	plain := []byte("layer key")
+
+	keyId := fake.url + "/keys/layers"
+	cipher, err := azure.Encrypt(ctx, plain, keyId, nil)
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	var wrapped azureWrappedKey
+	if err := json.Unmarshal(cipher, &wrapped); err != nil {
+		t.Fatal(err)
+	}
+	if wrapped.KID != keyId+"/v1" || wrapped.Algorithm != azkeys.EncryptionAlgorithmRSAOAEP256 {
+		t.Fatalf("wrapped with %s %s, want %s/v1 %s", wrapped.KID, wrapped.Algorithm, keyId, azkeys.EncryptionAlgorithmRSAOAEP256)
+	}
+
+	for _, decryptKeyId := range []string{keyId, keyId + "/v1"} {
+		decrypted, err := azure.Decrypt(ctx, cipher, decryptKeyId, nil)
+		if err != nil {
+			t.Fatalf("Decrypt with %s: %v", decryptKeyId, err)
+		}
+		if !bytes.Equal(decrypted, plain) {
+			t.Fatalf("Decrypt with %s returned %q, want %q", decryptKeyId, decrypted, plain)
+		}
+	}
+
+	for _, otherKeyId := range []string{fake.url + "/keys/other", keyId + "/v2"} {
+		_, err = azure.Decrypt(ctx, cipher, otherKeyId, nil)
+		if !errors.Is(err, ErrInvalidCiphertext) {
+			t.Fatalf("Decrypt with %s returned %v, want %v", otherKeyId, err, ErrInvalidCiphertext)
+		}
+	}
+}
+
+func TestAzureErrorClassification(t *testing.T) {
+	fake, server := newFakeKeyVault(t)
+	fake.fail(map[string]fakeAzureFailure{
+		"missing":  {status: http.StatusNotFound, code: "KeyNotFound", message: "A key with (name/id) missing was not found in this key vault."},
+		"denied":   {status: http.StatusForbidden, code: "Forbidden", message: "The user, group or application does not have keys wrapKey permission."},
+		"disabled": {status: http.StatusForbidden, code: "Forbidden", message: "Operation wrapKey is not allowed on a disabled key."},
+		"conflict": {status: http.StatusConflict, code: "Conflict", message: "conflict"},
+	})
+	azure := newTestAzure(server)
+	azure.algorithm = azkeys.EncryptionAlgorithmRSAOAEP256
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "missing", want: "not_found"},
+		{name: "denied", want: "permission_denied"},
+		{name: "disabled", want: "key_disabled"},
+		{name: "conflict", want: "other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := azure.Encrypt(context.Background(), []byte("layer key"), fake.url+"/keys/"+tt.name, nil)
+			if err == nil {
+				t.Fatal("Encrypt succeeded")
+			}
+			if got := ErrorClass(err); got != tt.want {
+				t.Fatalf("Encrypt returned %v of class %s, want %s", err, got, tt.want)
+			}
+		})
+	}
+
+	t.Run("tampered", func(t *testing.T) {
+		cipher, err := json.Marshal(azureWrappedKey{KID: fake.url + "/keys/layers/v1", Algorithm: azure.algorithm, Value: []byte("not wrapped by the key")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = azure.Decrypt(context.Background(), cipher, fake.url+"/keys/layers", nil)
+		if !errors.Is(err, ErrInvalidCiphertext) {
+			t.Fatalf("Decrypt returned %v, want %v", err, ErrInvalidCiphertext)
+		}
+	})
+}
+
+func TestAzureNoSDKRetries(t *testing.T) {
+	fake, server := newFakeKeyVault(t)
+	fake.fail(map[string]fakeAzureFailure{
+		"unavailable": {status: http.StatusServiceUnavailable, code: "ServiceUnavailable", message: "unavailable"},
+	})
+	t.Setenv("AZURE_TENANT_ID", "tenant")
+	t.Setenv("AZURE_CLIENT_ID", "client")
+	t.Setenv("AZURE_CLIENT_SECRET", "secret")
+	// the retry policy retries, not the SDK
+	provider, err := newAzure(context.Background(), Config{Retry: RetryPolicy{MaxAttempts: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	azure := provider.(*azureKms)
+	azure.credential = fakeAzureCredential{}
+	azure.clientOptions.Transport = server.Client()
+	azure.clientOptions.DisableChallengeResourceVerification = true
+	azure.algorithm = azkeys.EncryptionAlgorithmRSAOAEP256
+
+	_, err = azure.Encrypt(context.Background(), []byte("layer key"), fake.url+"/keys/unavailable", nil)
+	if !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("Encrypt returned %v, want %v", err, ErrUnavailable)
+	}
+	if calls := fake.calls["unavailable"]; calls != 1 {
+		t.Fatalf("Encrypt called the key vault %d times, want 1", calls)
+	}
+}
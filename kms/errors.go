@@ -0,0 +1,87 @@
+package kms
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// Kinds of provider errors. Providers classify the errors of their SDKs with them,
+// callers check the kind with errors.Is.
+var (
+	ErrNotFound          = errors.New("key not found")
+	ErrPermissionDenied  = errors.New("permission denied")
+	ErrKeyDisabled       = errors.New("key disabled")
+	ErrThrottled         = errors.New("request throttled")
+	ErrUnavailable       = errors.New("kms unavailable")
+	ErrInvalidCiphertext = errors.New("invalid ciphertext")
+)
+
+// Error is a provider error classified by its kind.
+type Error struct {
+	// Kind is one of the Err* kinds.
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() []error {
+	return []error{e.Kind, e.Err}
+}
+
+// classified returns err classified as kind, unless it is nil or already classified.
+func classified(kind error, err error) error {
+	if err == nil {
+		return nil
+	}
+	var kmsErr *Error
+	if errors.As(err, &kmsErr) {
+		return err
+	}
+	return &Error{Kind: kind, Err: err}
+}
+
+// classifyTransport classifies errors every provider can see: network errors are unavailable.
+// Context errors are left as is, so callers can tell their own cancellation apart. ok is false for other errors.
+func classifyTransport(err error) (classifiedErr error, ok bool) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err, true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return classified(ErrUnavailable, err), true
+	}
+	return err, false
+}
+
+// errorClasses name the kinds of errors for metrics and traces, the first matching class is used.
+var errorClasses = []struct {
+	err   error
+	class string
+}{
+	{err: ErrUnavailable, class: "unavailable"},
+	{err: context.DeadlineExceeded, class: "timeout"},
+	{err: ErrThrottled, class: "throttled"},
+	{err: ErrPermissionDenied, class: "permission_denied"},
+	{err: ErrKeyDisabled, class: "key_disabled"},
+	{err: ErrNotFound, class: "not_found"},
+	{err: ErrInvalidCiphertext, class: "invalid_ciphertext"},
+	{err: context.Canceled, class: "canceled"},
+}
+
+// ErrorClass returns a short name of the kind of err, e.g. "not_found", "other" for unclassified errors and
+// an empty string for nil.
+func ErrorClass(err error) string {
+	if err == nil {
+		return ""
+	}
+	for _, c := range errorClasses {
+		if errors.Is(err, c.err) {
+			return c.class
+		}
+	}
+	return "other"
+}
@@ -0,0 +1,215 @@
+package kms
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"strconv"
+	"strings"
+
+	gcp_kms "cloud.google.com/go/kms/apiv1"
+	"cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func init() {
+	register("gcp", newGCP)
+}
+
+const defaultGCPLocation = "global"
+
+// gcpKms wraps keys with symmetric Google Cloud KMS keys.
+// Credentials are taken from Application Default Credentials, which includes Workload Identity on GKE.
+type gcpKms struct {
+	project  string
+	location string
+	keyRing  string
+	aad      []byte
+	client   *gcp_kms.KeyManagementClient
+}
+
+// Interface compliance
+var _ Provider = (*gcpKms)(nil)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+func crc32c(data []byte) *wrapperspb.Int64Value {
+	return wrapperspb.Int64(int64(crc32.Checksum(data, crc32cTable)))
+}
+
+// Encrypt implements kms.KMS.
+func (k *gcpKms) Encrypt(ctx context.Context, plain []byte, keyId string, encCtx EncryptionContext) ([]byte, error) {
+	name, err := k.resourceName(keyId)
+	if err != nil {
+		return nil, err
+	}
+	aad := k.additionalAuthenticatedData(encCtx)
+	req := &kmspb.EncryptRequest{
+		Name:                              name,
+		Plaintext:                         plain,
+		PlaintextCrc32C:                   crc32c(plain),
+		AdditionalAuthenticatedData:       aad,
+		AdditionalAuthenticatedDataCrc32C: crc32c(aad),
+	}
+	resp, err := k.client.Encrypt(ctx, req)
+	if err != nil {
+		return nil, gcpError(err)
+	}
+	// see https://cloud.google.com/kms/docs/data-integrity-guidelines
+	if !resp.VerifiedPlaintextCrc32C || !resp.VerifiedAdditionalAuthenticatedDataCrc32C {
+		return nil, errors.New("encrypt request corrupted in-transit")
+	}
+	if resp.CiphertextCrc32C == nil || resp.CiphertextCrc32C.Value != crc32c(resp.Ciphertext).Value {
+		return nil, errors.New("encrypt response corrupted in-transit")
+	}
+	return resp.Ciphertext, nil
+}
+
+// Decrypt implements kms.KMS.
+func (k *gcpKms) Decrypt(ctx context.Context, cipher []byte, keyId string, encCtx EncryptionContext) ([]byte, error) {
+	name, err := k.resourceName(keyId)
+	if err != nil {
+		return nil, err
+	}
+	aad := k.additionalAuthenticatedData(encCtx)
+	req := &kmspb.DecryptRequest{
+		Name:                              name,
+		Ciphertext:                        cipher,
+		CiphertextCrc32C:                  crc32c(cipher),
+		AdditionalAuthenticatedData:       aad,
+		AdditionalAuthenticatedDataCrc32C: crc32c(aad),
+	}
+	resp, err := k.client.Decrypt(ctx, req)
+	if err != nil {
+		return nil, gcpError(err)
+	}
+	if resp.PlaintextCrc32C == nil || resp.PlaintextCrc32C.Value != crc32c(resp.Plaintext).Value {
+		return nil, errors.New("decrypt response corrupted in-transit")
+	}
+	return resp.Plaintext, nil
+}
+
+// SupportsEncryptionContext implements kms.KMS.
+func (k *gcpKms) SupportsEncryptionContext() bool {
+	return true
+}
+
+// gcpError classifies the errors of the Cloud KMS API by their gRPC status.
+func gcpError(err error) error {
+	if err, ok := classifyTransport(err); ok {
+		return err
+	}
+	s, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	switch s.Code() {
+	case codes.NotFound:
+		return classified(ErrNotFound, err)
+	case codes.PermissionDenied, codes.Unauthenticated:
+		return classified(ErrPermissionDenied, err)
+	case codes.FailedPrecondition:
+		// the key version is disabled, destroyed or not yet enabled
+		return classified(ErrKeyDisabled, err)
+	case codes.ResourceExhausted:
+		return classified(ErrThrottled, err)
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal:
+		return classified(ErrUnavailable, err)
+	case codes.InvalidArgument:
+		// decrypting a ciphertext of another key or with other additional authenticated data
+		return classified(ErrInvalidCiphertext, err)
+	}
+	return err
+}
+
+// additionalAuthenticatedData appends the encryption context to the configured additional authenticated data.
+func (k *gcpKms) additionalAuthenticatedData(encCtx EncryptionContext) []byte {
+	return append(bytes.Clone(k.aad), encCtx.AAD()...)
+}
+
+// resourceName maps a keyId to a crypto key resource name.
+// The keyId is either a full projects/*/locations/*/keyRings/*/cryptoKeys/* resource name
+// or [[<location>/]<keyRing>/]<cryptoKey>, with the missing parts taken from the provider configuration.
+func (k *gcpKms) resourceName(keyId string) (string, error) {
+	if strings.HasPrefix(keyId, "projects/") {
+		parts := strings.Split(keyId, "/")
+		if len(parts) != 8 || parts[2] != "locations" || parts[4] != "keyRings" || parts[6] != "cryptoKeys" {
+			return "", fmt.Errorf("invalid crypto key resource name %q", keyId)
+		}
+		return keyId, nil
+	}
+
+	location, keyRing := k.location, k.keyRing
+	parts := strings.Split(keyId, "/")
+	switch len(parts) {
+	case 1:
+	case 2:
+		keyRing = parts[0]
+	case 3:
+		location, keyRing = parts[0], parts[1]
+	default:
+		return "", fmt.Errorf("invalid gcp key %q", keyId)
+	}
+	cryptoKey := parts[len(parts)-1]
+	if k.project == "" || location == "" || keyRing == "" || cryptoKey == "" {
+		return "", fmt.Errorf("cannot build crypto key resource name from %q, project, location or key ring is missing", keyId)
+	}
+	return fmt.Sprintf("projects/%s/locations/%s/keyRings/%s/cryptoKeys/%s", k.project, location, keyRing, cryptoKey), nil
+}
+
+// newGCP configures the provider from GOOGLE_CLOUD_PROJECT, GCP_KMS_LOCATION, GCP_KMS_KEY_RING
+// and GCP_KMS_ADDITIONAL_AUTHENTICATED_DATA. The region of the configuration takes precedence over GCP_KMS_LOCATION.
+// The endpoint of the configuration or GCP_KMS_ENDPOINT overrides the API endpoint;
+// with GCP_KMS_INSECURE the endpoint is dialed without TLS and authentication.
+func newGCP(ctx context.Context, cfg Config) (Provider, error) {
+	var opts []option.ClientOption
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = os.Getenv("GCP_KMS_ENDPOINT")
+	}
+	if endpoint != "" {
+		opts = append(opts, option.WithEndpoint(endpoint))
+		if insecureEndpoint, _ := strconv.ParseBool(os.Getenv("GCP_KMS_INSECURE")); insecureEndpoint {
+			opts = append(opts,
+				option.WithoutAuthentication(),
+				option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+			)
+		}
+	}
+
+	var aad []byte
+	if v := os.Getenv("GCP_KMS_ADDITIONAL_AUTHENTICATED_DATA"); v != "" {
+		aad = []byte(v)
+	}
+
+	location := cfg.Region
+	if location == "" {
+		location = envOrDefault("GCP_KMS_LOCATION", defaultGCPLocation)
+	}
+
+	client, err := gcp_kms.NewKeyManagementClient(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("creating gcp kms client: %w", err)
+	}
+	if cfg.Retry.MaxAttempts > 1 {
+		// calls are retried by the retry policy, SDK retries would multiply the attempts
+		client.CallOptions.Encrypt = nil
+		client.CallOptions.Decrypt = nil
+	}
+
+	return &gcpKms{
+		project:  os.Getenv("GOOGLE_CLOUD_PROJECT"),
+		location: location,
+		keyRing:  os.Getenv("GCP_KMS_KEY_RING"),
+		aad:      aad,
+		client:   client,
+	}, nil
+}
@@ -0,0 +1,213 @@
+package kms
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeCloudKMS is an in-process stand-in for the Encrypt and Decrypt methods of the Cloud KMS API.
+// Keys are created on first use, except for the crypto key names of the failure codes.
+type fakeCloudKMS struct {
+	kmspb.UnimplementedKeyManagementServiceServer
+
+	mu   sync.Mutex
+	keys map[string][]byte
+	// failures maps crypto key names to the status code returned for them
+	failures map[string]codes.Code
+	// calls counts the calls by crypto key name
+	calls map[string]int
+}
+
+func newFakeCloudKMS(t *testing.T) (*fakeCloudKMS, string) {
+	f := &fakeCloudKMS{keys: map[string][]byte{}, failures: map[string]codes.Code{}, calls: map[string]int{}}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	kmspb.RegisterKeyManagementServiceServer(server, f)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	return f, lis.Addr().String()
+}
+
+func (f *fakeCloudKMS) Encrypt(_ context.Context, req *kmspb.EncryptRequest) (*kmspb.EncryptResponse, error) {
+	key, err := f.key(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if req.PlaintextCrc32C.GetValue() != crc32c(req.Plaintext).Value {
+		return nil, status.Error(codes.InvalidArgument, "plaintext crc32c mismatch")
+	}
+	nonce, ciphertext, err := sealAESGCM(key, req.Plaintext, req.AdditionalAuthenticatedData)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	ciphertext = append(nonce, ciphertext...)
+	return &kmspb.EncryptResponse{
+		Name:                    req.Name + "/cryptoKeyVersions/1",
+		Ciphertext:              ciphertext,
+		CiphertextCrc32C:        crc32c(ciphertext),
+		VerifiedPlaintextCrc32C: true,
+		VerifiedAdditionalAuthenticatedDataCrc32C: true,
+	}, nil
+}
+
+func (f *fakeCloudKMS) Decrypt(_ context.Context, req *kmspb.DecryptRequest) (*kmspb.DecryptResponse, error) {
+	key, err := f.key(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.Ciphertext) < 12 {
+		return nil, status.Error(codes.InvalidArgument, "ciphertext is invalid")
+	}
+	plain, err := openAESGCM(key, req.Ciphertext[:12], req.Ciphertext[12:], req.AdditionalAuthenticatedData)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "Decryption failed: the ciphertext is invalid.")
+	}
+	return &kmspb.DecryptResponse{Plaintext: plain, PlaintextCrc32C: crc32c(plain)}, nil
+}
+
+func (f *fakeCloudKMS) key(name string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls[name[strings.LastIndex(name, "/")+1:]]++
+	if code, ok := f.failures[name[strings.LastIndex(name, "/")+1:]]; ok {
+		return nil, status.Errorf(code, "%s failed", name)
+	}
+	key, ok := f.keys[name]
+	if !ok {
+		key = make([]byte, 32)
+		rand.Read(key)
+		f.keys[name] = key
+	}
+	return key, nil
+}
+
+// fail returns the status codes for the crypto key names.
+func (f *fakeCloudKMS) fail(failures map[string]codes.Code) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for name, code := range failures {
+		f.failures[name] = code
+	}
+}
+
+func newTestGCP(t *testing.T, cfg Config) Provider {
+	t.Setenv("GCP_KMS_INSECURE", "true")
+	t.Setenv("GOOGLE_CLOUD_PROJECT", "project")
+	t.Setenv("GCP_KMS_KEY_RING", "ring")
+	t.Setenv("GCP_KMS_ADDITIONAL_AUTHENTICATED_DATA", "")
+	provider, err := newGCP(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+func TestGCPWrapUnwrap(t *testing.T) {
+	fake, address := newFakeCloudKMS(t)
+	gcp := newTestGCP(t, Config{Endpoint: address})
+	ctx := context.Background()
+	plain := []byte("layer key")
+	encCtx := EncryptionContext{"repository": "registry.example.com/app"}
+
+	for _, keyId := range []string{"layers", "ring/layers", "global/ring/layers", "projects/project/locations/global/keyRings/ring/cryptoKeys/layers"} {
+		t.Run(keyId, func(t *testing.T) {
+			cipher, err := gcp.Encrypt(ctx, plain, keyId, encCtx)
+			if err != nil {
+				t.Fatalf("Encrypt: %v", err)
+			}
+			decrypted, err := gcp.Decrypt(ctx, cipher, keyId, encCtx)
+			if err != nil {
+				t.Fatalf("Decrypt: %v", err)
+			}
+			if !bytes.Equal(decrypted, plain) {
+				t.Fatalf("Decrypt returned %q, want %q", decrypted, plain)
+			}
+		})
+	}
+	if len(fake.keys) != 1 {
+		t.Fatalf("key ids resolved to %d crypto keys, want 1", len(fake.keys))
+	}
+
+	cipher, err := gcp.Encrypt(ctx, plain, "layers", encCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = gcp.Decrypt(ctx, cipher, "layers", EncryptionContext{"repository": "other"})
+	if !errors.Is(err, ErrInvalidCiphertext) {
+		t.Fatalf("Decrypt with another encryption context returned %v, want %v", err, ErrInvalidCiphertext)
+	}
+}
+
+func TestGCPErrorClassification(t *testing.T) {
+	fake, address := newFakeCloudKMS(t)
+	fake.fail(map[string]codes.Code{
+		"missing":   codes.NotFound,
+		"denied":    codes.PermissionDenied,
+		"anonymous": codes.Unauthenticated,
+		"disabled":  codes.FailedPrecondition,
+		"throttled": codes.ResourceExhausted,
+		"internal":  codes.Internal,
+		"aborted":   codes.Aborted,
+	})
+	gcp := newTestGCP(t, Config{Endpoint: address})
+
+	tests := []struct {
+		keyId string
+		want  string
+	}{
+		{keyId: "missing", want: "not_found"},
+		{keyId: "denied", want: "permission_denied"},
+		{keyId: "anonymous", want: "permission_denied"},
+		{keyId: "disabled", want: "key_disabled"},
+		{keyId: "throttled", want: "throttled"},
+		{keyId: "internal", want: "unavailable"},
+		{keyId: "aborted", want: "other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.keyId, func(t *testing.T) {
+			_, err := gcp.Encrypt(context.Background(), []byte("layer key"), tt.keyId, nil)
+			if err == nil {
+				t.Fatal("Encrypt succeeded")
+			}
+			if got := ErrorClass(err); got != tt.want {
+				t.Fatalf("Encrypt returned %v of class %s, want %s", err, got, tt.want)
+			}
+		})
+	}
+
+	t.Run("invalid key id", func(t *testing.T) {
+		_, err := gcp.Encrypt(context.Background(), []byte("layer key"), "projects/project/layers", nil)
+		if err == nil {
+			t.Fatal("Encrypt succeeded")
+		}
+	})
+}
+
+func TestGCPNoSDKRetries(t *testing.T) {
+	fake, address := newFakeCloudKMS(t)
+	fake.fail(map[string]codes.Code{"unavailable": codes.Unavailable})
+	// the retry policy retries, not the SDK
+	gcp := newTestGCP(t, Config{Endpoint: address, Retry: RetryPolicy{MaxAttempts: 3}})
+
+	_, err := gcp.Encrypt(context.Background(), []byte("layer key"), "unavailable", nil)
+	if !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("Encrypt returned %v, want %v", err, ErrUnavailable)
+	}
+	if calls := fake.calls["unavailable"]; calls != 1 {
+		t.Fatalf("Encrypt called the kms %d times, want 1", calls)
+	}
+}
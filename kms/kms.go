@@ -2,18 +2,91 @@ package kms
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
 )
 
+// AlgorithmDefault identifies keys wrapped with the Encrypt operation of a provider.
+const AlgorithmDefault = "default"
+
 type Provider interface {
-	Encrypt(ctx context.Context, plain []byte, keyId string) ([]byte, error)
-	Decrypt(ctx context.Context, cipher []byte, keyId string) ([]byte, error)
+	Encrypt(ctx context.Context, plain []byte, keyId string, encCtx EncryptionContext) ([]byte, error)
+	Decrypt(ctx context.Context, cipher []byte, keyId string, encCtx EncryptionContext) ([]byte, error)
+	// SupportsEncryptionContext reports whether the provider binds ciphertexts to the encryption context.
+	// Providers without support ignore the encryption context.
+	SupportsEncryptionContext() bool
+}
+
+// EncryptionContext is non-secret data a wrapped key is cryptographically bound to.
+// Decrypting requires the exact encryption context used for encrypting.
+type EncryptionContext map[string]string
+
+// AAD returns the canonical encoding of the encryption context as additional authenticated data, nil if it is empty.
+func (c EncryptionContext) AAD() []byte {
+	if len(c) == 0 {
+		return nil
+	}
+	// map keys are encoded in sorted order
+	aad, _ := json.Marshal(c)
+	return aad
+}
+
+// Config configures a provider. Settings that don't apply to a provider are ignored by it,
+// provider specific settings are read from the environment.
+type Config struct {
+	// Region is the region (aws) or location (gcp) of the keys.
+	Region string
+	// Endpoint overrides the API endpoint of the provider.
+	Endpoint string
+	// Profile is the named configuration profile to load credentials from (aws).
+	Profile string
+	// Timeout bounds every attempt of a call, if set.
+	Timeout time.Duration
+	// Retry retries calls failing with a retryable error.
+	Retry RetryPolicy
+	// CircuitBreaker fails calls fast while the kms is down.
+	CircuitBreaker CircuitBreakerPolicy
+	// Observer is called after every attempt of a call, if set.
+	Observer CallObserver
 }
 
+// Factory creates a provider from its configuration.
+type Factory func(ctx context.Context, cfg Config) (Provider, error)
+
 // Register can be called from init() on a plugin in this package
-// It will automatically be added to the Inputs map to be called externally
-func register(name string, provider Provider) {
-	Providers[name] = provider
+// It will automatically be added to the factories map to be called by New.
+// It panics if a provider of the same name is registered already.
+func register(name string, factory Factory) {
+	if _, ok := factories[name]; ok {
+		panic(fmt.Sprintf("kms provider %v is registered twice", name))
+	}
+	factories[name] = factory
 }
 
-// Providers registry
-var Providers = map[string]Provider{}
+// Factories registry
+var factories = map[string]Factory{}
+
+// New creates the provider registered with name.
+func New(ctx context.Context, name string, cfg Config) (Provider, error) {
+	factory, ok := factories[name]
+	if !ok {
+		return nil, fmt.Errorf("kms provider %v is not registered", name)
+	}
+	provider, err := factory(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("creating kms provider %v: %w", name, err)
+	}
+	return newPolicyProvider(provider, name, cfg), nil
+}
+
+// Names returns the sorted names of all registered providers.
+func Names() []string {
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
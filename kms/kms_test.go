@@ -0,0 +1,66 @@
+package kms
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+)
+
+// registerTest registers a provider for the test and removes it again at its end.
+func registerTest(t *testing.T, name string, factory Factory) {
+	register(name, factory)
+	t.Cleanup(func() { delete(factories, name) })
+}
+
+func TestRegistry(t *testing.T) {
+	fake := &faultyProvider{}
+	var gotCfg Config
+	registerTest(t, "fake", func(_ context.Context, cfg Config) (Provider, error) {
+		gotCfg = cfg
+		return fake, nil
+	})
+	registerTest(t, "broken", func(context.Context, Config) (Provider, error) {
+		return nil, errors.New("missing credentials")
+	})
+	if names := Names(); !slices.Contains(names, "fake") || !slices.IsSorted(names) {
+		t.Fatalf("Names returned %v, want the sorted names with fake", names)
+	}
+
+	provider, err := New(context.Background(), "fake", Config{Region: "eu-central-1", Retry: testRetryPolicy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotCfg.Region != "eu-central-1" {
+		t.Fatalf("factory was called with region %q", gotCfg.Region)
+	}
+	// the provider is wrapped in the policies of the config
+	policy, ok := provider.(*policyProvider)
+	if !ok || policy.Provider != fake || policy.name != "fake" || policy.retry != testRetryPolicy {
+		t.Fatalf("New returned %#v, want the provider wrapped in its policies", provider)
+	}
+
+	if _, err := New(context.Background(), "broken", Config{}); err == nil {
+		t.Fatal("New succeeded with a failing factory")
+	}
+	if _, err := New(context.Background(), "missing", Config{}); err == nil {
+		t.Fatal("New succeeded with a provider that is not registered")
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("registering a provider twice didn't panic")
+		}
+	}()
+	register("local", newLocal)
+}
+
+func TestKeyURLSchemesRegistered(t *testing.T) {
+	for _, s := range keyURLSchemes {
+		if _, ok := factories[s.provider]; !ok {
+			t.Fatalf("provider %s of key url scheme %s is not registered", s.provider, s.scheme)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package kms
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+)
+
+func init() {
+	register("local", newLocal)
+}
+
+const defaultLocalKeyDir = "/etc/kms-crypt/keys"
+
+// localKms wraps keys with keys loaded from files in a directory, resolved by file name.
+// A key file contains either a 32 byte AES-256-GCM key (raw, hex or base64 encoded),
+// age X25519 identities (AGE-SECRET-KEY-1...) or only age recipients (age1...), which can encrypt but not decrypt.
+// Key files are read on every call, so keys can be added or rotated without a restart.
+type localKms struct {
+	keyDir string
+}
+
+// Interface compliance
+var _ Provider = (*localKms)(nil)
+
+// localKey is a key file. Exactly one of aesKey, identities or recipients is set.
+type localKey struct {
+	aesKey     []byte
+	identities []age.Identity
+	recipients []age.Recipient
+}
+
+// Encrypt implements kms.KMS.
+func (k *localKms) Encrypt(_ context.Context, plain []byte, keyId string, encCtx EncryptionContext) ([]byte, error) {
+	key, err := k.loadKey(keyId)
+	if err != nil {
+		return nil, err
+	}
+	if key.aesKey != nil {
+		defer clear(key.aesKey)
+		nonce, ciphertext, err := sealAESGCM(key.aesKey, plain, encCtx.AAD())
+		if err != nil {
+			return nil, err
+		}
+		return append(nonce, ciphertext...), nil
+	}
+
+	recipients := key.recipients
+	for _, identity := range key.identities {
+		x25519, ok := identity.(*age.X25519Identity)
+		if !ok {
+			return nil, fmt.Errorf("unsupported age identity in key %s", keyId)
+		}
+		recipients = append(recipients, x25519.Recipient())
+	}
+	var out bytes.Buffer
+	w, err := age.Encrypt(&out, recipients...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(ageContextHeader(encCtx)); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(plain); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// Decrypt implements kms.KMS.
+func (k *localKms) Decrypt(_ context.Context, cipher []byte, keyId string, encCtx EncryptionContext) ([]byte, error) {
+	key, err := k.loadKey(keyId)
+	if err != nil {
+		return nil, err
+	}
+	if key.aesKey != nil {
+		defer clear(key.aesKey)
+		if len(cipher) < gcmNonceSize {
+			return nil, classified(ErrInvalidCiphertext, errors.New("ciphertext too short"))
+		}
+		plain, err := openAESGCM(key.aesKey, cipher[:gcmNonceSize], cipher[gcmNonceSize:], encCtx.AAD())
+		return plain, classified(ErrInvalidCiphertext, err)
+	}
+
+	if len(key.identities) == 0 {
+		return nil, fmt.Errorf("key %s contains only age recipients and cannot decrypt", keyId)
+	}
+	r, err := age.Decrypt(bytes.NewReader(cipher), key.identities...)
+	if err != nil {
+		return nil, classified(ErrInvalidCiphertext, err)
+	}
+	payload, err := io.ReadAll(r)
+	if err != nil {
+		return nil, classified(ErrInvalidCiphertext, err)
+	}
+	header := ageContextHeader(encCtx)
+	if len(payload) < len(header) || subtle.ConstantTimeCompare(payload[:len(header)], header) != 1 {
+		clear(payload)
+		return nil, classified(ErrInvalidCiphertext, errors.New("encryption context does not match"))
+	}
+	return payload[len(header):], nil
+}
+
+// SupportsEncryptionContext implements kms.KMS.
+func (k *localKms) SupportsEncryptionContext() bool {
+	return true
+}
+
+const gcmNonceSize = 12
+
+// ageContextHeader binds age ciphertexts to the encryption context by prefixing the plaintext with it,
+// since age has no additional authenticated data. It is empty without encryption context.
+func ageContextHeader(encCtx EncryptionContext) []byte {
+	aad := encCtx.AAD()
+	if aad == nil {
+		return nil
+	}
+	return append(binary.AppendUvarint(nil, uint64(len(aad))), aad...)
+}
+
+func (k *localKms) loadKey(keyId string) (*localKey, error) {
+	if keyId == "" || keyId == "." || keyId == ".." || strings.ContainsAny(keyId, `/\`) {
+		return nil, fmt.Errorf("invalid local key name %q", keyId)
+	}
+	data, err := os.ReadFile(filepath.Join(k.keyDir, keyId))
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return nil, classified(ErrNotFound, fmt.Errorf("reading local key: %w", err))
+	case errors.Is(err, fs.ErrPermission):
+		return nil, classified(ErrPermissionDenied, fmt.Errorf("reading local key: %w", err))
+	case err != nil:
+		return nil, fmt.Errorf("reading local key: %w", err)
+	}
+	defer clear(data)
+	return parseLocalKey(data)
+}
+
+func parseLocalKey(data []byte) (*localKey, error) {
+	if len(data) == 32 {
+		return &localKey{aesKey: bytes.Clone(data)}, nil
+	}
+
+	text := strings.TrimSpace(string(data))
+	switch {
+	case strings.Contains(text, "AGE-SECRET-KEY-1"):
+		identities, err := age.ParseIdentities(strings.NewReader(text))
+		if err != nil {
+			return nil, err
+		}
+		return &localKey{identities: identities}, nil
+	case strings.HasPrefix(text, "age1") || strings.HasPrefix(text, "#"):
+		recipients, err := age.ParseRecipients(strings.NewReader(text))
+		if err != nil {
+			return nil, err
+		}
+		return &localKey{recipients: recipients}, nil
+	}
+
+	if key, err := hex.DecodeString(text); err == nil && len(key) == 32 {
+		return &localKey{aesKey: key}, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == 32 {
+		return &localKey{aesKey: key}, nil
+	}
+	return nil, errors.New("key file is neither a 32 byte AES key nor an age identity or recipient file")
+}
+
+// newLocal configures the key directory from LOCAL_KMS_KEY_DIR.
+func newLocal(context.Context, Config) (Provider, error) {
+	keyDir := envOrDefault("LOCAL_KMS_KEY_DIR", defaultLocalKeyDir)
+	info, err := os.Stat(keyDir)
+	if err != nil {
+		return nil, fmt.Errorf("key directory: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("key directory %s is not a directory", keyDir)
+	}
+	return &localKms{keyDir: keyDir}, nil
+}
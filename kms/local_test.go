@@ -0,0 +1,185 @@
+package kms
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+)
+
+// newTestLocal creates the local provider on a temporary key directory with the key files.
+func newTestLocal(t *testing.T, files map[string][]byte) *localKms {
+	keyDir := t.TempDir()
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(keyDir, name), data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("LOCAL_KMS_KEY_DIR", keyDir)
+	provider, err := newLocal(context.Background(), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider.(*localKms)
+}
+
+func TestLocalKeyFormats(t *testing.T) {
+	aesKey := make([]byte, 32)
+	if _, err := rand.Read(aesKey); err != nil {
+		t.Fatal(err)
+	}
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := newTestLocal(t, map[string][]byte{
+		"raw":       aesKey,
+		"hex":       []byte(hex.EncodeToString(aesKey) + "\n"),
+		"base64":    []byte(base64.StdEncoding.EncodeToString(aesKey) + "\n"),
+		"identity":  []byte("# created: 2024-01-02\n" + identity.String() + "\n"),
+		"recipient": []byte(identity.Recipient().String() + "\n"),
+	})
+	ctx := context.Background()
+	encCtx := EncryptionContext{"repository": "registry.example.com/app"}
+	plain := []byte("layer key")
+
+	for _, name := range []string{"raw", "hex", "base64", "identity"} {
+		t.Run(name, func(t *testing.T) {
+			cipher, err := local.Encrypt(ctx, plain, name, encCtx)
+			if err != nil {
+				t.Fatalf("Encrypt: %v", err)
+			}
+			decrypted, err := local.Decrypt(ctx, cipher, name, encCtx)
+			if err != nil {
+				t.Fatalf("Decrypt: %v", err)
+			}
+			if !bytes.Equal(decrypted, plain) {
+				t.Fatalf("Decrypt returned %q, want %q", decrypted, plain)
+			}
+
+			// the ciphertext is bound to the encryption context. Age ciphertexts without encryption context
+			// have no header, so only another encryption context is detected for them.
+			others := []EncryptionContext{{"repository": "registry.example.com/other"}}
+			if name != "identity" {
+				others = append(others, nil)
+			}
+			for _, other := range others {
+				if _, err := local.Decrypt(ctx, cipher, name, other); !errors.Is(err, ErrInvalidCiphertext) {
+					t.Fatalf("Decrypt with encryption context %v returned %v, want %v", other, err, ErrInvalidCiphertext)
+				}
+			}
+		})
+	}
+
+	// the aes key files are the same key
+	cipher, err := local.Encrypt(ctx, plain, "raw", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"hex", "base64"} {
+		if decrypted, err := local.Decrypt(ctx, cipher, name, nil); err != nil || !bytes.Equal(decrypted, plain) {
+			t.Fatalf("Decrypt with %s returned %q, %v, want %q", name, decrypted, err, plain)
+		}
+	}
+
+	t.Run("recipient", func(t *testing.T) {
+		cipher, err := local.Encrypt(ctx, plain, "recipient", encCtx)
+		if err != nil {
+			t.Fatalf("Encrypt: %v", err)
+		}
+		if _, err := local.Decrypt(ctx, cipher, "recipient", encCtx); err == nil {
+			t.Fatal("Decrypt with a recipient file succeeded")
+		}
+		// the identity of the recipient decrypts
+		decrypted, err := local.Decrypt(ctx, cipher, "identity", encCtx)
+		if err != nil || !bytes.Equal(decrypted, plain) {
+			t.Fatalf("Decrypt with the identity returned %q, %v, want %q", decrypted, err, plain)
+		}
+	})
+}
+
+func TestLocalInvalidKeys(t *testing.T) {
+	local := newTestLocal(t, map[string][]byte{
+		"short":     []byte("0123456789abcdef"),
+		"invalid":   []byte("not a key"),
+		"identity":  []byte("AGE-SECRET-KEY-1INVALID\n"),
+		"recipient": []byte("age1invalid\n"),
+	})
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		keyId   string
+		wantErr error
+	}{
+		{name: "missing", keyId: "missing", wantErr: ErrNotFound},
+		{name: "short", keyId: "short"},
+		{name: "invalid", keyId: "invalid"},
+		{name: "invalid identity", keyId: "identity"},
+		{name: "invalid recipient", keyId: "recipient"},
+		// key names are file names in the key directory
+		{name: "empty", keyId: ""},
+		{name: "dot", keyId: "."},
+		{name: "parent", keyId: ".."},
+		{name: "path", keyId: "../keys/short"},
+		{name: "absolute path", keyId: "/etc/passwd"},
+		{name: "windows path", keyId: `..\short`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := local.Encrypt(ctx, []byte("layer key"), tt.keyId, nil)
+			if err == nil || (tt.wantErr != nil && !errors.Is(err, tt.wantErr)) {
+				t.Fatalf("Encrypt returned %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLocalInvalidCiphertext(t *testing.T) {
+	aesKey := make([]byte, 32)
+	if _, err := rand.Read(aesKey); err != nil {
+		t.Fatal(err)
+	}
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := newTestLocal(t, map[string][]byte{"aes": aesKey, "identity": []byte(identity.String())})
+	ctx := context.Background()
+
+	for _, name := range []string{"aes", "identity"} {
+		cipher, err := local.Encrypt(ctx, []byte("layer key"), name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cipher[len(cipher)-1] ^= 1
+		for _, invalid := range [][]byte{cipher, []byte("short")} {
+			if _, err := local.Decrypt(ctx, invalid, name, nil); !errors.Is(err, ErrInvalidCiphertext) {
+				t.Fatalf("Decrypt of an invalid %s ciphertext returned %v, want %v", name, err, ErrInvalidCiphertext)
+			}
+		}
+	}
+}
+
+func TestLocalKeyDir(t *testing.T) {
+	t.Setenv("LOCAL_KMS_KEY_DIR", filepath.Join(t.TempDir(), "missing"))
+	if _, err := newLocal(context.Background(), Config{}); err == nil {
+		t.Fatal("newLocal succeeded with a missing key directory")
+	}
+
+	file := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("LOCAL_KMS_KEY_DIR", file)
+	if _, err := newLocal(context.Background(), Config{}); err == nil {
+		t.Fatal("newLocal succeeded with a file as key directory")
+	}
+}
@@ -0,0 +1,506 @@
+//go:build cgo
+
+package kms
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+	pkcs11uri "github.com/stefanberger/go-pkcs11uri"
+)
+
+func init() {
+	register("pkcs11", newPKCS11)
+}
+
+const (
+	pkcs11MechanismAESKeyWrapPad = "aes-key-wrap-pad"
+	pkcs11MechanismRSAOAEP       = "rsa-oaep-sha256"
+
+	defaultPKCS11MaxSessions = 8
+)
+
+var defaultPKCS11ModuleDirectories = []string{
+	"/usr/lib64/pkcs11/",
+	"/usr/lib/pkcs11/",
+	"/usr/lib64/softhsm/",
+	"/usr/lib/softhsm/",
+	"/usr/lib/x86_64-linux-gnu/softhsm/",
+	"/usr/local/lib/softhsm/",
+}
+
+// pkcs11Kms wraps keys with keys stored on a PKCS#11 token.
+// The keyId is a pkcs11: URI (RFC 7512) selecting the module, token and key object.
+// AES keys wrap with CKM_AES_KEY_WRAP_PAD, RSA keys wrap a random AES-256-GCM data key with CKM_RSA_PKCS_OAEP.
+type pkcs11Kms struct {
+	moduleDirectories  []string
+	allowedModulePaths []string
+	maxSessions        int
+
+	mu      sync.Mutex
+	modules map[string]*pkcs11.Ctx
+	tokens  map[string]*pkcs11Token
+	pools   map[string]*pkcs11SessionPool
+}
+
+// Interface compliance
+var _ Provider = (*pkcs11Kms)(nil)
+
+// pkcs11WrappedKey is the ciphertext returned by pkcs11Kms.
+type pkcs11WrappedKey struct {
+	Mechanism  string `json:"mechanism"`
+	WrappedKey []byte `json:"wrapped_key"`
+	Nonce      []byte `json:"nonce,omitempty"`
+	Ciphertext []byte `json:"ciphertext,omitempty"`
+}
+
+// Encrypt implements kms.KMS.
+func (k *pkcs11Kms) Encrypt(ctx context.Context, plain []byte, keyId string, _ EncryptionContext) ([]byte, error) {
+	uri, pool, err := k.resolve(keyId)
+	if err != nil {
+		return nil, err
+	}
+	var wrapped *pkcs11WrappedKey
+	err = pool.with(ctx, func(p *pkcs11.Ctx, session pkcs11.SessionHandle) error {
+		key, err := findPKCS11Key(p, session, uri, pkcs11.CKO_SECRET_KEY)
+		if err == nil {
+			result, err := pkcs11WrapData(p, session, key, plain)
+			if err != nil {
+				return err
+			}
+			wrapped = &pkcs11WrappedKey{Mechanism: pkcs11MechanismAESKeyWrapPad, WrappedKey: result}
+			return nil
+		}
+		if !errors.Is(err, errPKCS11KeyNotFound) {
+			return err
+		}
+
+		key, err = findPKCS11Key(p, session, uri, pkcs11.CKO_PUBLIC_KEY)
+		if err != nil {
+			return err
+		}
+		dataKey := make([]byte, 32)
+		defer clear(dataKey)
+		if _, err := rand.Read(dataKey); err != nil {
+			return err
+		}
+		nonce, ciphertext, err := sealAESGCM(dataKey, plain, nil)
+		if err != nil {
+			return err
+		}
+		result, err := pkcs11Crypt(p, session, key, rsaOAEP(), dataKey, true)
+		if err != nil {
+			return err
+		}
+		wrapped = &pkcs11WrappedKey{
+			Mechanism:  pkcs11MechanismRSAOAEP,
+			WrappedKey: result,
+			Nonce:      nonce,
+			Ciphertext: ciphertext,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, pkcs11Error(err)
+	}
+	return json.Marshal(wrapped)
+}
+
+// Decrypt implements kms.KMS.
+func (k *pkcs11Kms) Decrypt(ctx context.Context, cipher []byte, keyId string, _ EncryptionContext) ([]byte, error) {
+	var wrapped pkcs11WrappedKey
+	if err := json.Unmarshal(cipher, &wrapped); err != nil {
+		return nil, classified(ErrInvalidCiphertext, fmt.Errorf("malformed pkcs11 wrapped key: %w", err))
+	}
+	uri, pool, err := k.resolve(keyId)
+	if err != nil {
+		return nil, err
+	}
+	var plain []byte
+	err = pool.with(ctx, func(p *pkcs11.Ctx, session pkcs11.SessionHandle) error {
+		switch wrapped.Mechanism {
+		case pkcs11MechanismAESKeyWrapPad:
+			key, err := findPKCS11Key(p, session, uri, pkcs11.CKO_SECRET_KEY)
+			if err != nil {
+				return err
+			}
+			plain, err = pkcs11UnwrapData(p, session, key, wrapped.WrappedKey)
+			return err
+		case pkcs11MechanismRSAOAEP:
+			key, err := findPKCS11Key(p, session, uri, pkcs11.CKO_PRIVATE_KEY)
+			if err != nil {
+				return err
+			}
+			dataKey, err := pkcs11Crypt(p, session, key, rsaOAEP(), wrapped.WrappedKey, false)
+			if err != nil {
+				return err
+			}
+			defer clear(dataKey)
+			plain, err = openAESGCM(dataKey, wrapped.Nonce, wrapped.Ciphertext, nil)
+			return classified(ErrInvalidCiphertext, err)
+		default:
+			return classified(ErrInvalidCiphertext, fmt.Errorf("unknown pkcs11 wrapping mechanism %q", wrapped.Mechanism))
+		}
+	})
+	if err != nil {
+		return nil, pkcs11Error(err)
+	}
+	return plain, nil
+}
+
+// SupportsEncryptionContext implements kms.KMS.
+// AES key wrap accepts no additional authenticated data.
+func (k *pkcs11Kms) SupportsEncryptionContext() bool {
+	return false
+}
+
+func aesKeyWrapPad() []*pkcs11.Mechanism {
+	return []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_KEY_WRAP_PAD, nil)}
+}
+
+func rsaOAEP() []*pkcs11.Mechanism {
+	params := pkcs11.NewOAEPParams(pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256, pkcs11.CKZ_DATA_SPECIFIED, nil)
+	return []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_OAEP, params)}
+}
+
+// pkcs11WrapData wraps data with CKM_AES_KEY_WRAP_PAD. Tokens offer the mechanism only for C_WrapKey,
+// so the data is imported as a temporary session key to be wrapped.
+func pkcs11WrapData(p *pkcs11.Ctx, session pkcs11.SessionHandle, key pkcs11.ObjectHandle, data []byte) ([]byte, error) {
+	dataKey, err := p.CreateObject(session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_GENERIC_SECRET),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, data),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("C_CreateObject: %w", err)
+	}
+	defer p.DestroyObject(session, dataKey)
+	wrapped, err := p.WrapKey(session, aesKeyWrapPad(), key, dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("C_WrapKey: %w", err)
+	}
+	return wrapped, nil
+}
+
+// pkcs11UnwrapData unwraps data wrapped by pkcs11WrapData into a temporary session key and reads its value.
+func pkcs11UnwrapData(p *pkcs11.Ctx, session pkcs11.SessionHandle, key pkcs11.ObjectHandle, wrapped []byte) ([]byte, error) {
+	dataKey, err := p.UnwrapKey(session, aesKeyWrapPad(), key, wrapped, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_GENERIC_SECRET),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("C_UnwrapKey: %w", err)
+	}
+	defer p.DestroyObject(session, dataKey)
+	attrs, err := p.GetAttributeValue(session, dataKey, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil)})
+	if err != nil {
+		return nil, fmt.Errorf("C_GetAttributeValue: %w", err)
+	}
+	return attrs[0].Value, nil
+}
+
+func pkcs11Crypt(p *pkcs11.Ctx, session pkcs11.SessionHandle, key pkcs11.ObjectHandle, mechanism []*pkcs11.Mechanism, data []byte, encrypt bool) ([]byte, error) {
+	if encrypt {
+		if err := p.EncryptInit(session, mechanism, key); err != nil {
+			return nil, fmt.Errorf("C_EncryptInit: %w", err)
+		}
+		return p.Encrypt(session, data)
+	}
+	if err := p.DecryptInit(session, mechanism, key); err != nil {
+		return nil, fmt.Errorf("C_DecryptInit: %w", err)
+	}
+	return p.Decrypt(session, data)
+}
+
+var errPKCS11KeyNotFound = &Error{Kind: ErrNotFound, Err: errors.New("key not found on token")}
+
+// pkcs11Error classifies the return values of the PKCS#11 module.
+func pkcs11Error(err error) error {
+	var rv pkcs11.Error
+	if !errors.As(err, &rv) {
+		return err
+	}
+	switch rv {
+	case pkcs11.CKR_KEY_HANDLE_INVALID, pkcs11.CKR_OBJECT_HANDLE_INVALID, pkcs11.CKR_SLOT_ID_INVALID:
+		return classified(ErrNotFound, err)
+	case pkcs11.CKR_PIN_INCORRECT, pkcs11.CKR_PIN_EXPIRED, pkcs11.CKR_PIN_LOCKED, pkcs11.CKR_USER_NOT_LOGGED_IN,
+		pkcs11.CKR_KEY_FUNCTION_NOT_PERMITTED:
+		return classified(ErrPermissionDenied, err)
+	case pkcs11.CKR_DEVICE_REMOVED, pkcs11.CKR_TOKEN_NOT_PRESENT, pkcs11.CKR_DEVICE_ERROR,
+		pkcs11.CKR_SESSION_HANDLE_INVALID, pkcs11.CKR_SESSION_CLOSED, pkcs11.CKR_DEVICE_MEMORY, pkcs11.CKR_HOST_MEMORY:
+		return classified(ErrUnavailable, err)
+	case pkcs11.CKR_SESSION_COUNT:
+		return classified(ErrThrottled, err)
+	case pkcs11.CKR_ENCRYPTED_DATA_INVALID, pkcs11.CKR_ENCRYPTED_DATA_LEN_RANGE,
+		pkcs11.CKR_WRAPPED_KEY_INVALID, pkcs11.CKR_WRAPPED_KEY_LEN_RANGE:
+		return classified(ErrInvalidCiphertext, err)
+	}
+	return err
+}
+
+// findPKCS11Key finds the single key object of the given class matching the object and id attributes of the uri.
+func findPKCS11Key(p *pkcs11.Ctx, session pkcs11.SessionHandle, uri *pkcs11uri.Pkcs11URI, class uint) (pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, class)}
+	if label, ok := uri.GetPathAttribute("object", false); ok {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, label))
+	}
+	if id, ok := uri.GetPathAttribute("id", false); ok {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(id)))
+	}
+	if len(template) == 1 {
+		return 0, errors.New("pkcs11 uri must contain an object or id attribute")
+	}
+
+	if err := p.FindObjectsInit(session, template); err != nil {
+		return 0, fmt.Errorf("C_FindObjectsInit: %w", err)
+	}
+	objects, _, err := p.FindObjects(session, 2)
+	if finalErr := p.FindObjectsFinal(session); err == nil {
+		err = finalErr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("C_FindObjects: %w", err)
+	}
+	switch len(objects) {
+	case 0:
+		return 0, errPKCS11KeyNotFound
+	case 1:
+		return objects[0], nil
+	default:
+		return 0, errors.New("pkcs11 uri matches more than one key")
+	}
+}
+
+// resolve parses the uri and returns the session pool of the token it selects.
+func (k *pkcs11Kms) resolve(keyId string) (*pkcs11uri.Pkcs11URI, *pkcs11SessionPool, error) {
+	uri := pkcs11uri.New()
+	if err := uri.Parse(keyId); err != nil {
+		return nil, nil, fmt.Errorf("invalid pkcs11 uri: %w", err)
+	}
+	uri.SetModuleDirectories(k.moduleDirectories)
+	uri.SetAllowedModulePaths(k.allowedModulePaths)
+	module, err := uri.GetModule()
+	if err != nil {
+		return nil, nil, err
+	}
+	var pin string
+	if uri.HasPIN() {
+		pin, err = uri.GetPIN()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	p, ok := k.modules[module]
+	if !ok {
+		p = pkcs11.New(module)
+		if p == nil {
+			return nil, nil, fmt.Errorf("loading pkcs11 module %s failed", module)
+		}
+		if err := p.Initialize(); err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED)) {
+			p.Destroy()
+			return nil, nil, fmt.Errorf("C_Initialize: %w", err)
+		}
+		k.modules[module] = p
+	}
+	slot, err := findPKCS11Slot(p, uri)
+	if err != nil {
+		return nil, nil, err
+	}
+	tokenKey := module + "#" + strconv.FormatUint(uint64(slot), 10)
+	token, ok := k.tokens[tokenKey]
+	if !ok {
+		token = &pkcs11Token{}
+		k.tokens[tokenKey] = token
+	}
+	// every pin has a pool of its own, whose sessions are only used while the token is logged in with it
+	pinHash := sha256.Sum256([]byte(pin))
+	poolKey := tokenKey + "#" + hex.EncodeToString(pinHash[:])
+	pool, ok := k.pools[poolKey]
+	if !ok {
+		pool = newPKCS11SessionPool(p, slot, token, pin, k.maxSessions)
+		k.pools[poolKey] = pool
+	}
+	return uri, pool, nil
+}
+
+// findPKCS11Slot returns the first slot whose token matches the slot-id, token, serial, manufacturer and model attributes of the uri.
+func findPKCS11Slot(p *pkcs11.Ctx, uri *pkcs11uri.Pkcs11URI) (uint, error) {
+	slots, err := p.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("C_GetSlotList: %w", err)
+	}
+	matches := func(attr string, value string) bool {
+		want, ok := uri.GetPathAttribute(attr, false)
+		return !ok || want == value
+	}
+	for _, slot := range slots {
+		if !matches("slot-id", strconv.FormatUint(uint64(slot), 10)) {
+			continue
+		}
+		info, err := p.GetTokenInfo(slot)
+		if err != nil {
+			continue
+		}
+		if matches("token", info.Label) && matches("serial", info.SerialNumber) &&
+			matches("manufacturer", info.ManufacturerID) && matches("model", info.Model) {
+			return slot, nil
+		}
+	}
+	return 0, errors.New("no pkcs11 token matches the uri")
+}
+
+// errPKCS11PinMismatch is returned for requests whose pin differs from the pin the token is logged in with.
+var errPKCS11PinMismatch = &Error{Kind: ErrPermissionDenied, Err: errors.New("pin does not match the pin the token is logged in with")}
+
+// pkcs11Token is the login state of a token, which is shared by all sessions of the process.
+// Once logged in, the token accepts further logins without checking the pin, so the pin of
+// every request is checked against the pin of the first login instead.
+type pkcs11Token struct {
+	mu       sync.Mutex
+	loggedIn bool
+	pinHash  [sha256.Size]byte
+}
+
+// login records a successful login with the pin.
+func (t *pkcs11Token) login(pinHash [sha256.Size]byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.loggedIn = true
+	t.pinHash = pinHash
+}
+
+// checkPIN returns errPKCS11PinMismatch if the token is logged in with another pin. Without login, a request
+// without pin only sees the public objects of the token.
+func (t *pkcs11Token) checkPIN(pinHash [sha256.Size]byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.loggedIn && subtle.ConstantTimeCompare(t.pinHash[:], pinHash[:]) != 1 {
+		return errPKCS11PinMismatch
+	}
+	return nil
+}
+
+// pkcs11SessionPool hands out sessions of one token for one pin exclusively, since a session must not be used concurrently.
+type pkcs11SessionPool struct {
+	p       *pkcs11.Ctx
+	slot    uint
+	token   *pkcs11Token
+	pin     string
+	pinHash [sha256.Size]byte
+	// slots limits the number of open sessions
+	slots chan struct{}
+	idle  chan pkcs11.SessionHandle
+}
+
+func newPKCS11SessionPool(p *pkcs11.Ctx, slot uint, token *pkcs11Token, pin string, maxSessions int) *pkcs11SessionPool {
+	return &pkcs11SessionPool{
+		p:       p,
+		slot:    slot,
+		token:   token,
+		pin:     pin,
+		pinHash: sha256.Sum256([]byte(pin)),
+		slots:   make(chan struct{}, maxSessions),
+		idle:    make(chan pkcs11.SessionHandle, maxSessions),
+	}
+}
+
+// with runs fn with a session of the pool. Sessions on which fn failed are closed instead of being reused.
+func (pool *pkcs11SessionPool) with(ctx context.Context, fn func(p *pkcs11.Ctx, session pkcs11.SessionHandle) error) error {
+	select {
+	case pool.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-pool.slots }()
+	// idle sessions opened before another pool logged in share the login as well
+	if err := pool.token.checkPIN(pool.pinHash); err != nil {
+		return err
+	}
+
+	var session pkcs11.SessionHandle
+	select {
+	case session = <-pool.idle:
+	default:
+		var err error
+		session, err = pool.open()
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := fn(pool.p, session); err != nil {
+		_ = pool.p.CloseSession(session)
+		return err
+	}
+	pool.idle <- session
+	return nil
+}
+
+func (pool *pkcs11SessionPool) open() (pkcs11.SessionHandle, error) {
+	session, err := pool.p.OpenSession(pool.slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return 0, fmt.Errorf("C_OpenSession: %w", err)
+	}
+	if pool.pin != "" {
+		// the login state is shared by all sessions of the token
+		err := pool.p.Login(session, pkcs11.CKU_USER, pool.pin)
+		switch {
+		case err == nil:
+			pool.token.login(pool.pinHash)
+		case errors.Is(err, pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)):
+			// the pin wasn't checked by the token
+			err = pool.token.checkPIN(pool.pinHash)
+		default:
+			err = fmt.Errorf("C_Login: %w", err)
+		}
+		if err != nil {
+			_ = pool.p.CloseSession(session)
+			return 0, err
+		}
+	}
+	return session, nil
+}
+
+// newPKCS11 configures the provider from PKCS11_MODULE_DIRECTORIES, PKCS11_ALLOWED_MODULE_PATHS
+// (comma separated, directories end with a '/', defaults to the module directories) and PKCS11_MAX_SESSIONS.
+func newPKCS11(context.Context, Config) (Provider, error) {
+	moduleDirectories := defaultPKCS11ModuleDirectories
+	if v := os.Getenv("PKCS11_MODULE_DIRECTORIES"); v != "" {
+		moduleDirectories = strings.Split(v, ",")
+	}
+	allowedModulePaths := moduleDirectories
+	if v := os.Getenv("PKCS11_ALLOWED_MODULE_PATHS"); v != "" {
+		allowedModulePaths = strings.Split(v, ",")
+	}
+	maxSessions, err := strconv.Atoi(os.Getenv("PKCS11_MAX_SESSIONS"))
+	if err != nil || maxSessions < 1 {
+		maxSessions = defaultPKCS11MaxSessions
+	}
+	return &pkcs11Kms{
+		moduleDirectories:  moduleDirectories,
+		allowedModulePaths: allowedModulePaths,
+		maxSessions:        maxSessions,
+		modules:            map[string]*pkcs11.Ctx{},
+		tokens:             map[string]*pkcs11Token{},
+		pools:              map[string]*pkcs11SessionPool{},
+	}, nil
+}
@@ -0,0 +1,17 @@
+//go:build !cgo
+
+package kms
+
+import (
+	"context"
+	"errors"
+)
+
+func init() {
+	register("pkcs11", newPKCS11)
+}
+
+// newPKCS11 fails, PKCS#11 modules can only be loaded by binaries built with cgo.
+func newPKCS11(context.Context, Config) (Provider, error) {
+	return nil, errors.New("the binary was built without cgo, which the pkcs11 provider needs to load PKCS#11 modules")
+}
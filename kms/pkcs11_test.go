@@ -0,0 +1,284 @@
+//go:build cgo
+
+package kms
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+)
+
+const (
+	softHSMToken = "kms"
+	softHSMPin   = "1234"
+	softHSMSOPin = "0000"
+)
+
+// softHSMModule returns the path of the SoftHSM module, from SOFTHSM2_MODULE or the default module directories.
+func softHSMModule(t *testing.T) string {
+	if module := os.Getenv("SOFTHSM2_MODULE"); module != "" {
+		return module
+	}
+	for _, dir := range defaultPKCS11ModuleDirectories {
+		module := filepath.Join(dir, "libsofthsm2.so")
+		if _, err := os.Stat(module); err == nil {
+			return module
+		}
+	}
+	t.Skip("SoftHSM is not installed, set SOFTHSM2_MODULE to the path of libsofthsm2.so")
+	return ""
+}
+
+// newSoftHSMToken initializes a token in a temporary SoftHSM token directory with an AES key "layers"
+// and an RSA key pair "rsa".
+func newSoftHSMToken(t *testing.T, module string) {
+	dir := t.TempDir()
+	tokenDir := filepath.Join(dir, "tokens")
+	if err := os.Mkdir(tokenDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	conf := filepath.Join(dir, "softhsm2.conf")
+	if err := os.WriteFile(conf, []byte(fmt.Sprintf("directories.tokendir = %s\nobjectstore.backend = file\n", tokenDir)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SOFTHSM2_CONF", conf)
+
+	p := pkcs11.New(module)
+	if p == nil {
+		t.Fatalf("loading %s failed", module)
+	}
+	defer p.Destroy()
+	if err := p.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	// the provider initializes the module again
+	defer p.Finalize()
+
+	slots, err := p.GetSlotList(false)
+	if err != nil || len(slots) == 0 {
+		t.Fatalf("no free SoftHSM slot: %v", err)
+	}
+	if err := p.InitToken(slots[0], softHSMSOPin, softHSMToken); err != nil {
+		t.Fatalf("C_InitToken: %v", err)
+	}
+	// SoftHSM moves the initialized token to a new slot
+	slots, err = p.GetSlotList(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var slot uint
+	for _, s := range slots {
+		if info, err := p.GetTokenInfo(s); err == nil && info.Label == softHSMToken {
+			slot = s
+		}
+	}
+
+	session, err := p.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.CloseSession(session)
+	if err := p.Login(session, pkcs11.CKU_SO, softHSMSOPin); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.InitPIN(session, softHSMPin); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Logout(session); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Login(session, pkcs11.CKU_USER, softHSMPin); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Logout(session)
+
+	_, err = p.GenerateKey(session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_KEY_GEN, nil)}, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_AES),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE_LEN, 32),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, "layers"),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_WRAP, true),
+		pkcs11.NewAttribute(pkcs11.CKA_UNWRAP, true),
+	})
+	if err != nil {
+		t.Fatalf("generating AES key: %v", err)
+	}
+	_, _, err = p.GenerateKeyPair(session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, nil)}, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, 2048),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, "rsa"),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, true),
+	}, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, "rsa"),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, true),
+	})
+	if err != nil {
+		t.Fatalf("generating RSA key pair: %v", err)
+	}
+}
+
+func newTestPKCS11(module string) *pkcs11Kms {
+	return &pkcs11Kms{
+		moduleDirectories:  []string{filepath.Dir(module) + "/"},
+		allowedModulePaths: []string{module},
+		maxSessions:        2,
+		modules:            map[string]*pkcs11.Ctx{},
+		tokens:             map[string]*pkcs11Token{},
+		pools:              map[string]*pkcs11SessionPool{},
+	}
+}
+
+func softHSMKey(module string, object string, pin string) string {
+	return fmt.Sprintf("pkcs11:token=%s;object=%s?module-path=%s&pin-value=%s", softHSMToken, object, module, pin)
+}
+
+func TestPKCS11SoftHSM(t *testing.T) {
+	module := softHSMModule(t)
+	newSoftHSMToken(t, module)
+	ctx := context.Background()
+	plain := []byte("layer key")
+
+	// before any login of the process, SoftHSM accepts further logins without checking the pin
+	t.Run("wrong pin", func(t *testing.T) {
+		_, err := newTestPKCS11(module).Encrypt(ctx, plain, softHSMKey(module, "layers", "4321"), nil)
+		if !errors.Is(err, ErrPermissionDenied) {
+			t.Fatalf("Encrypt returned %v, want %v", err, ErrPermissionDenied)
+		}
+	})
+
+	hsm := newTestPKCS11(module)
+	for _, tt := range []struct {
+		object    string
+		mechanism string
+	}{
+		{object: "layers", mechanism: pkcs11MechanismAESKeyWrapPad},
+		{object: "rsa", mechanism: pkcs11MechanismRSAOAEP},
+	} {
+		t.Run(tt.object, func(t *testing.T) {
+			keyId := softHSMKey(module, tt.object, softHSMPin)
+			cipher, err := hsm.Encrypt(ctx, plain, keyId, nil)
+			if err != nil {
+				t.Fatalf("Encrypt: %v", err)
+			}
+			var wrapped pkcs11WrappedKey
+			if err := json.Unmarshal(cipher, &wrapped); err != nil {
+				t.Fatal(err)
+			}
+			if wrapped.Mechanism != tt.mechanism {
+				t.Fatalf("wrapped with %s, want %s", wrapped.Mechanism, tt.mechanism)
+			}
+			decrypted, err := hsm.Decrypt(ctx, cipher, keyId, nil)
+			if err != nil {
+				t.Fatalf("Decrypt: %v", err)
+			}
+			if !bytes.Equal(decrypted, plain) {
+				t.Fatalf("Decrypt returned %q, want %q", decrypted, plain)
+			}
+		})
+	}
+
+	// the token is logged in now and accepts any pin, the provider checks it
+	for _, pin := range []string{"4321", ""} {
+		t.Run(fmt.Sprintf("pin %q after login", pin), func(t *testing.T) {
+			keyId := fmt.Sprintf("pkcs11:token=%s;object=layers?module-path=%s", softHSMToken, module)
+			if pin != "" {
+				keyId = softHSMKey(module, "layers", pin)
+			}
+			_, err := hsm.Encrypt(ctx, plain, keyId, nil)
+			if !errors.Is(err, ErrPermissionDenied) {
+				t.Fatalf("Encrypt returned %v, want %v", err, ErrPermissionDenied)
+			}
+		})
+	}
+
+	t.Run("missing key", func(t *testing.T) {
+		_, err := hsm.Encrypt(ctx, plain, softHSMKey(module, "missing", softHSMPin), nil)
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Encrypt returned %v, want %v", err, ErrNotFound)
+		}
+	})
+
+	t.Run("unknown mechanism", func(t *testing.T) {
+		cipher, err := json.Marshal(pkcs11WrappedKey{Mechanism: "des", WrappedKey: plain})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = hsm.Decrypt(ctx, cipher, softHSMKey(module, "layers", softHSMPin), nil)
+		if !errors.Is(err, ErrInvalidCiphertext) {
+			t.Fatalf("Decrypt returned %v, want %v", err, ErrInvalidCiphertext)
+		}
+	})
+
+	t.Run("module not allowed", func(t *testing.T) {
+		hsm := newTestPKCS11(module)
+		hsm.allowedModulePaths = []string{"/nonexistent/"}
+		_, err := hsm.Encrypt(ctx, plain, softHSMKey(module, "layers", softHSMPin), nil)
+		if err == nil {
+			t.Fatal("Encrypt succeeded with a module that is not allowed")
+		}
+	})
+}
+
+func TestPKCS11TokenPIN(t *testing.T) {
+	token := &pkcs11Token{}
+	pin := sha256.Sum256([]byte(softHSMPin))
+	wrongPIN := sha256.Sum256([]byte("4321"))
+	noPIN := sha256.Sum256(nil)
+
+	// before the login, the token checks the pin itself
+	for _, hash := range [][sha256.Size]byte{pin, wrongPIN, noPIN} {
+		if err := token.checkPIN(hash); err != nil {
+			t.Fatalf("checkPIN before login returned %v", err)
+		}
+	}
+	token.login(pin)
+	if err := token.checkPIN(pin); err != nil {
+		t.Fatalf("checkPIN of the login pin returned %v", err)
+	}
+	for _, hash := range [][sha256.Size]byte{wrongPIN, noPIN} {
+		if err := token.checkPIN(hash); !errors.Is(err, ErrPermissionDenied) {
+			t.Fatalf("checkPIN of another pin returned %v, want %v", err, ErrPermissionDenied)
+		}
+	}
+}
+
+func TestPKCS11Error(t *testing.T) {
+	tests := []struct {
+		rv   uint
+		want string
+	}{
+		{rv: pkcs11.CKR_PIN_INCORRECT, want: "permission_denied"},
+		{rv: pkcs11.CKR_KEY_HANDLE_INVALID, want: "not_found"},
+		{rv: pkcs11.CKR_DEVICE_REMOVED, want: "unavailable"},
+		{rv: pkcs11.CKR_SESSION_COUNT, want: "throttled"},
+		{rv: pkcs11.CKR_WRAPPED_KEY_INVALID, want: "invalid_ciphertext"},
+		// configuration errors
+		{rv: pkcs11.CKR_MECHANISM_INVALID, want: "other"},
+		{rv: pkcs11.CKR_KEY_TYPE_INCONSISTENT, want: "other"},
+	}
+	for _, tt := range tests {
+		err := pkcs11Error(fmt.Errorf("C_WrapKey: %w", pkcs11.Error(tt.rv)))
+		if got := ErrorClass(err); got != tt.want {
+			t.Fatalf("pkcs11Error of %v has class %q, want %q", pkcs11.Error(tt.rv), got, tt.want)
+		}
+	}
+}
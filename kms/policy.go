@@ -0,0 +1,219 @@
+package kms
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RetryPolicy configures retries of provider calls failing with a retryable error,
+// which are ErrUnavailable, ErrThrottled and calls timing out.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts of a call, 0 and 1 disable retries.
+	MaxAttempts int
+	// InitialBackoff is the maximum wait before the first retry, it doubles for every further retry.
+	// The wait is chosen randomly up to the maximum (full jitter).
+	InitialBackoff time.Duration
+	// MaxBackoff caps the maximum wait before a retry.
+	MaxBackoff time.Duration
+}
+
+// CircuitBreakerPolicy configures the circuit breaker, which fails calls fast while the kms is down.
+type CircuitBreakerPolicy struct {
+	// FailureThreshold is the number of consecutive retryable failures opening the circuit, 0 disables the circuit breaker.
+	FailureThreshold int
+	// OpenTimeout is how long the circuit stays open, before a single trial call may close it again.
+	OpenTimeout time.Duration
+}
+
+// CallObserver is called after every attempt of a provider call with the name of the provider,
+// the called method, the duration and the error of the attempt, e.g. to record metrics.
+type CallObserver func(provider string, operation string, duration time.Duration, err error)
+
+// ErrCircuitOpen is returned without calling the kms while the circuit breaker is open.
+var ErrCircuitOpen = &Error{Kind: ErrUnavailable, Err: errors.New("circuit breaker is open")}
+
+// policyProvider applies the timeout, retry and circuit breaker policies to the calls of a provider,
+// traces the calls and reports every attempt to the observer.
+type policyProvider struct {
+	Provider
+	name     string
+	timeout  time.Duration
+	retry    RetryPolicy
+	breaker  *circuitBreaker
+	observer CallObserver
+}
+
+func newPolicyProvider(provider Provider, name string, cfg Config) Provider {
+	p := &policyProvider{Provider: provider, name: name, timeout: cfg.Timeout, retry: cfg.Retry, observer: cfg.Observer}
+	if cfg.CircuitBreaker.FailureThreshold > 0 {
+		p.breaker = &circuitBreaker{policy: cfg.CircuitBreaker}
+	}
+	return p
+}
+
+func (p *policyProvider) Encrypt(ctx context.Context, plain []byte, keyId string, encCtx EncryptionContext) ([]byte, error) {
+	return callWithPolicy(ctx, p, "Encrypt", keyId, func(ctx context.Context) ([]byte, error) {
+		return p.Provider.Encrypt(ctx, plain, keyId, encCtx)
+	})
+}
+
+func (p *policyProvider) Decrypt(ctx context.Context, cipher []byte, keyId string, encCtx EncryptionContext) ([]byte, error) {
+	return callWithPolicy(ctx, p, "Decrypt", keyId, func(ctx context.Context) ([]byte, error) {
+		return p.Provider.Decrypt(ctx, cipher, keyId, encCtx)
+	})
+}
+
+// policyAsymmetricProvider applies the policies of a policyProvider to its asymmetric calls.
+type policyAsymmetricProvider struct {
+	AsymmetricProvider
+	policy *policyProvider
+}
+
+func (p *policyAsymmetricProvider) PublicKey(ctx context.Context, keyId string, algorithm string) (crypto.PublicKey, error) {
+	return callWithPolicy(ctx, p.policy, "PublicKey", keyId, func(ctx context.Context) (crypto.PublicKey, error) {
+		return p.AsymmetricProvider.PublicKey(ctx, keyId, algorithm)
+	})
+}
+
+func (p *policyAsymmetricProvider) DecryptAsymmetric(ctx context.Context, cipher []byte, keyId string, algorithm string) ([]byte, error) {
+	return callWithPolicy(ctx, p.policy, "DecryptAsymmetric", keyId, func(ctx context.Context) ([]byte, error) {
+		return p.AsymmetricProvider.DecryptAsymmetric(ctx, cipher, keyId, algorithm)
+	})
+}
+
+// callWithPolicy calls fn until it succeeds, fails with an error that is not retryable or runs out of attempts.
+func callWithPolicy[T any](ctx context.Context, p *policyProvider, operation string, keyId string, fn func(ctx context.Context) (T, error)) (result T, err error) {
+	ctx, span := startCallSpan(ctx, p.name, operation, keyId)
+	tried := 0
+	defer func() { endCallSpan(span, tried, err) }()
+
+	var zero T
+	attempts := max(p.retry.MaxAttempts, 1)
+	for attempt := 0; ; attempt++ {
+		trial := false
+		if p.breaker != nil {
+			if trial, err = p.breaker.allow(); err != nil {
+				return zero, err
+			}
+		}
+		start := time.Now()
+		result, err = attemptWithTimeout(ctx, p.timeout, attempts-attempt, fn)
+		tried++
+		if p.observer != nil {
+			p.observer(p.name, operation, time.Since(start), err)
+		}
+		if p.breaker != nil {
+			// a call canceled by the caller says nothing about the kms
+			p.breaker.record(trial, err, ctx.Err() != nil)
+		}
+		if err == nil || ctx.Err() != nil || !retryable(err) || attempt+1 >= attempts {
+			return result, err
+		}
+		addRetryEvent(span, err)
+		if !sleep(ctx, p.backoff(attempt)) {
+			return zero, err
+		}
+	}
+}
+
+// attemptWithTimeout calls fn bounded by the timeout and the share of the time left until the deadline of ctx.
+func attemptWithTimeout[T any](ctx context.Context, timeout time.Duration, attemptsLeft int, fn func(ctx context.Context) (T, error)) (T, error) {
+	if deadline, ok := ctx.Deadline(); ok && attemptsLeft > 1 {
+		// leave time for the remaining attempts
+		if share := time.Until(deadline) / time.Duration(attemptsLeft); timeout <= 0 || share < timeout {
+			timeout = share
+		}
+	}
+	if timeout <= 0 {
+		return fn(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return fn(ctx)
+}
+
+// backoff returns a random wait before the retry after the attempt, up to the exponential maximum.
+func (p *policyProvider) backoff(attempt int) time.Duration {
+	maxWait := p.retry.InitialBackoff
+	for i := 0; i < attempt && (p.retry.MaxBackoff <= 0 || maxWait < p.retry.MaxBackoff); i++ {
+		maxWait *= 2
+	}
+	if p.retry.MaxBackoff > 0 && maxWait > p.retry.MaxBackoff {
+		maxWait = p.retry.MaxBackoff
+	}
+	if maxWait <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(maxWait) + 1))
+}
+
+// sleep waits for d, it returns false if the deadline of ctx is reached first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < d {
+		return false
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// retryable reports whether a call failing with err may succeed when it is retried.
+func retryable(err error) bool {
+	return errors.Is(err, ErrUnavailable) || errors.Is(err, ErrThrottled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// circuitBreaker opens after consecutive retryable failures. While it is open, calls fail with ErrCircuitOpen.
+// After the open timeout, a single trial call is let through: its success closes the circuit, its failure opens it again.
+type circuitBreaker struct {
+	policy CircuitBreakerPolicy
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool
+}
+
+// allow returns ErrCircuitOpen if the call must fail fast. trial reports whether the call is the trial call.
+func (b *circuitBreaker) allow() (trial bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.policy.FailureThreshold {
+		return false, nil
+	}
+	if time.Now().Before(b.openUntil) || b.trial {
+		return false, ErrCircuitOpen
+	}
+	b.trial = true
+	return true, nil
+}
+
+// record counts the result of a call. Canceled trial calls are only released, so another trial may follow.
+// Calls started before the circuit opened may finish during the trial, they don't release it.
+func (b *circuitBreaker) record(trial bool, err error, canceled bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if trial {
+		b.trial = false
+	}
+	if canceled {
+		return
+	}
+	// errors like a denied permission show the kms is up
+	if err == nil || !retryable(err) {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.policy.FailureThreshold {
+		b.openUntil = time.Now().Add(b.policy.OpenTimeout)
+	}
+}
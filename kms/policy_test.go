@@ -0,0 +1,278 @@
+package kms
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// faultyProvider is a provider failing its calls with the errors of fault, which is called with the
+// number of the call and its context. Successful calls return the plaintext.
+type faultyProvider struct {
+	fault func(call int, ctx context.Context) error
+
+	mu    sync.Mutex
+	calls int
+	// timeLeft is the time left until the deadline of every call, -1 without deadline
+	timeLeft []time.Duration
+}
+
+func (f *faultyProvider) call(ctx context.Context) error {
+	f.mu.Lock()
+	f.calls++
+	call := f.calls
+	timeLeft := time.Duration(-1)
+	if deadline, ok := ctx.Deadline(); ok {
+		timeLeft = time.Until(deadline)
+	}
+	f.timeLeft = append(f.timeLeft, timeLeft)
+	f.mu.Unlock()
+	if f.fault == nil {
+		return nil
+	}
+	return f.fault(call, ctx)
+}
+
+func (f *faultyProvider) Encrypt(ctx context.Context, plain []byte, _ string, _ EncryptionContext) ([]byte, error) {
+	if err := f.call(ctx); err != nil {
+		return nil, err
+	}
+	return plain, nil
+}
+
+func (f *faultyProvider) Decrypt(ctx context.Context, cipher []byte, _ string, _ EncryptionContext) ([]byte, error) {
+	if err := f.call(ctx); err != nil {
+		return nil, err
+	}
+	return cipher, nil
+}
+
+func (f *faultyProvider) SupportsEncryptionContext() bool {
+	return false
+}
+
+func (f *faultyProvider) callCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+// failFirst fails the first n calls with err.
+func failFirst(n int, err error) func(int, context.Context) error {
+	return func(call int, _ context.Context) error {
+		if call <= n {
+			return err
+		}
+		return nil
+	}
+}
+
+// waitForDeadline blocks every call until its context is done.
+func waitForDeadline(_ int, ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+var testRetryPolicy = RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+
+func TestPolicyRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		fault     func(int, context.Context) error
+		wantCalls int
+		wantErr   error
+	}{
+		{name: "success", wantCalls: 1},
+		{name: "unavailable", fault: failFirst(2, &Error{Kind: ErrUnavailable, Err: errors.New("503")}), wantCalls: 3},
+		{name: "throttled", fault: failFirst(1, &Error{Kind: ErrThrottled, Err: errors.New("429")}), wantCalls: 2},
+		{name: "attempts exhausted", fault: failFirst(5, &Error{Kind: ErrUnavailable, Err: errors.New("503")}), wantCalls: 3, wantErr: ErrUnavailable},
+		// only retryable errors are retried
+		{name: "permission denied", fault: failFirst(5, &Error{Kind: ErrPermissionDenied, Err: errors.New("403")}), wantCalls: 1, wantErr: ErrPermissionDenied},
+		{name: "invalid ciphertext", fault: failFirst(5, &Error{Kind: ErrInvalidCiphertext, Err: errors.New("400")}), wantCalls: 1, wantErr: ErrInvalidCiphertext},
+		{name: "unclassified", fault: failFirst(5, errors.New("unexpected")), wantCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &faultyProvider{fault: tt.fault}
+			var observed []error
+			p := newPolicyProvider(fake, "fake", Config{
+				Retry:    testRetryPolicy,
+				Observer: func(_ string, _ string, _ time.Duration, err error) { observed = append(observed, err) },
+			})
+
+			plain, err := p.Encrypt(context.Background(), []byte("layer key"), "layers", nil)
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Encrypt returned %v, want %v", err, tt.wantErr)
+			}
+			if tt.fault == nil && (err != nil || !bytes.Equal(plain, []byte("layer key"))) {
+				t.Fatalf("Encrypt returned %q, %v", plain, err)
+			}
+			if fake.calls != tt.wantCalls || len(observed) != tt.wantCalls {
+				t.Fatalf("Encrypt made %d calls and observed %d, want %d", fake.calls, len(observed), tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestPolicyBackoff(t *testing.T) {
+	p := &policyProvider{retry: RetryPolicy{MaxAttempts: 5, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 30 * time.Millisecond}}
+	for attempt, maxWait := range []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 30 * time.Millisecond, 30 * time.Millisecond} {
+		var longest time.Duration
+		for i := 0; i < 1000; i++ {
+			wait := p.backoff(attempt)
+			if wait < 0 || wait > maxWait {
+				t.Fatalf("backoff after attempt %d is %v, want at most %v", attempt, wait, maxWait)
+			}
+			longest = max(longest, wait)
+		}
+		// full jitter spreads the waits up to the maximum
+		if longest < maxWait/2 {
+			t.Fatalf("longest backoff after attempt %d is %v of at most %v", attempt, longest, maxWait)
+		}
+	}
+
+	if wait := (&policyProvider{}).backoff(3); wait != 0 {
+		t.Fatalf("backoff without initial backoff is %v, want 0", wait)
+	}
+}
+
+func TestPolicyDeadline(t *testing.T) {
+	t.Run("shared between attempts", func(t *testing.T) {
+		fake := &faultyProvider{fault: waitForDeadline}
+		p := newPolicyProvider(fake, "fake", Config{Retry: testRetryPolicy})
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		defer cancel()
+
+		_, err := p.Encrypt(ctx, []byte("layer key"), "layers", nil)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Encrypt returned %v, want %v", err, context.DeadlineExceeded)
+		}
+		if fake.calls != 3 {
+			t.Fatalf("Encrypt made %d calls before the deadline, want 3", fake.calls)
+		}
+		// the first attempt gets a third of the time left, the last one the rest
+		if fake.timeLeft[0] > 100*time.Millisecond {
+			t.Fatalf("first attempt had %v, want at most a third of the deadline", fake.timeLeft[0])
+		}
+	})
+
+	t.Run("bounded by timeout", func(t *testing.T) {
+		fake := &faultyProvider{fault: waitForDeadline}
+		p := newPolicyProvider(fake, "fake", Config{Timeout: 20 * time.Millisecond})
+
+		_, err := p.Encrypt(context.Background(), []byte("layer key"), "layers", nil)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Encrypt returned %v, want %v", err, context.DeadlineExceeded)
+		}
+		if fake.timeLeft[0] < 0 || fake.timeLeft[0] > 20*time.Millisecond {
+			t.Fatalf("attempt had %v, want at most the timeout", fake.timeLeft[0])
+		}
+	})
+
+	t.Run("canceled by caller", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		fake := &faultyProvider{fault: func(int, context.Context) error {
+			cancel()
+			return &Error{Kind: ErrUnavailable, Err: errors.New("503")}
+		}}
+		p := newPolicyProvider(fake, "fake", Config{Retry: testRetryPolicy})
+
+		if _, err := p.Encrypt(ctx, []byte("layer key"), "layers", nil); err == nil {
+			t.Fatal("Encrypt succeeded")
+		}
+		if fake.calls != 1 {
+			t.Fatalf("Encrypt made %d calls after the caller gave up, want 1", fake.calls)
+		}
+	})
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	unavailable := &Error{Kind: ErrUnavailable, Err: errors.New("503")}
+	var failing bool
+	release := make(chan struct{})
+	fake := &faultyProvider{fault: func(_ int, ctx context.Context) error {
+		if ctx.Value(blockKey{}) != nil {
+			<-release
+		}
+		if failing {
+			return unavailable
+		}
+		return nil
+	}}
+	p := newPolicyProvider(fake, "fake", Config{CircuitBreaker: CircuitBreakerPolicy{FailureThreshold: 2, OpenTimeout: 20 * time.Millisecond}})
+	ctx := context.Background()
+	encrypt := func(ctx context.Context) error {
+		_, err := p.Encrypt(ctx, []byte("layer key"), "layers", nil)
+		return err
+	}
+
+	// consecutive failures open the circuit
+	failing = true
+	for i := 0; i < 2; i++ {
+		if err := encrypt(ctx); !errors.Is(err, ErrUnavailable) || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("call %d returned %v, want %v", i, err, unavailable)
+		}
+	}
+	if err := encrypt(ctx); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("call with open circuit returned %v, want %v", err, ErrCircuitOpen)
+	}
+	if fake.callCount() != 2 {
+		t.Fatalf("open circuit called the kms, %d calls", fake.callCount())
+	}
+
+	// after the open timeout a failing trial opens the circuit again
+	time.Sleep(20 * time.Millisecond)
+	if err := encrypt(ctx); errors.Is(err, ErrCircuitOpen) || !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("trial call returned %v, want %v", err, unavailable)
+	}
+	if err := encrypt(ctx); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("call after a failed trial returned %v, want %v", err, ErrCircuitOpen)
+	}
+
+	// only one trial call is let through, a successful trial closes the circuit
+	time.Sleep(20 * time.Millisecond)
+	failing = false
+	trial := make(chan error)
+	go func() { trial <- encrypt(context.WithValue(ctx, blockKey{}, true)) }()
+	for fake.callCount() != 4 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := encrypt(ctx); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("call during the trial returned %v, want %v", err, ErrCircuitOpen)
+	}
+	close(release)
+	if err := <-trial; err != nil {
+		t.Fatalf("trial call returned %v", err)
+	}
+	if err := encrypt(ctx); err != nil {
+		t.Fatalf("call after a successful trial returned %v", err)
+	}
+}
+
+type blockKey struct{}
+
+func TestCircuitBreakerTrialRelease(t *testing.T) {
+	b := &circuitBreaker{policy: CircuitBreakerPolicy{FailureThreshold: 1, OpenTimeout: time.Millisecond}}
+	b.record(false, &Error{Kind: ErrUnavailable, Err: errors.New("503")}, false)
+	time.Sleep(time.Millisecond)
+
+	trial, err := b.allow()
+	if err != nil || !trial {
+		t.Fatalf("allow after the open timeout returned %v, %v, want a trial call", trial, err)
+	}
+	// a call started before the circuit opened finishes during the trial
+	b.record(false, &Error{Kind: ErrUnavailable, Err: errors.New("503")}, false)
+	time.Sleep(time.Millisecond)
+	if trial, err := b.allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("allow during the trial returned %v, %v, want %v", trial, err, ErrCircuitOpen)
+	}
+
+	// a canceled trial releases the trial without counting
+	b.record(true, context.Canceled, true)
+	if trial, err := b.allow(); err != nil || !trial {
+		t.Fatalf("allow after a canceled trial returned %v, %v, want a trial call", trial, err)
+	}
+}
@@ -0,0 +1,54 @@
+package kms
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of provider calls with the global tracer provider.
+var tracer = otel.Tracer("github.com/hown3d/kms-ocicrypt/kms")
+
+// startCallSpan starts the span of a provider call. The key is only recorded as hash of its key url,
+// which identifies the key across spans without exposing account ids or key names.
+func startCallSpan(ctx context.Context, provider string, operation string, keyId string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "kms."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("kms.provider", provider),
+			attribute.String("kms.operation", operation),
+			attribute.String("kms.key_url_hash", KeyURLHash(KeyURL{Provider: provider, KeyId: keyId})),
+		),
+	)
+}
+
+// endCallSpan records the outcome of a provider call and ends its span.
+// Errors are only recorded by class, since the messages of the kms often contain the key.
+func endCallSpan(span trace.Span, attempts int, err error) {
+	outcome := "ok"
+	if err != nil {
+		outcome = ErrorClass(err)
+		span.SetStatus(codes.Error, outcome)
+	}
+	span.SetAttributes(
+		attribute.String("kms.outcome", outcome),
+		attribute.Int("kms.attempts", attempts),
+	)
+	span.End()
+}
+
+// addRetryEvent records that a failed attempt of a call is retried.
+func addRetryEvent(span trace.Span, err error) {
+	span.AddEvent("retry", trace.WithAttributes(attribute.String("kms.error", ErrorClass(err))))
+}
+
+// KeyURLHash returns a short hash of the key url, to correlate calls with a key without logging the key url.
+func KeyURLHash(url KeyURL) string {
+	sum := sha256.Sum256([]byte(url.String()))
+	return hex.EncodeToString(sum[:8])
+}
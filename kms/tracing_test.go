@@ -0,0 +1,120 @@
+package kms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestCallSpans(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+
+	keyId := "projects/p/locations/global/keyRings/ring/cryptoKeys/layers"
+	fake := &faultyProvider{fault: func(call int, _ context.Context) error {
+		if call == 1 {
+			return nil
+		}
+		// kms errors name the key
+		return &Error{Kind: ErrUnavailable, Err: fmt.Errorf("%s is unavailable", keyId)}
+	}}
+	p := newPolicyProvider(fake, "gcp", Config{Retry: RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}})
+	ctx := context.Background()
+
+	if _, err := p.Encrypt(ctx, []byte("layer key"), keyId, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Decrypt(ctx, []byte("wrapped"), keyId, nil); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("Decrypt returned %v, want %v", err, ErrUnavailable)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("recorded %d spans, want 2", len(spans))
+	}
+	hash := KeyURLHash(KeyURL{Provider: "gcp", KeyId: keyId})
+	tests := []struct {
+		name    string
+		attrs   map[string]attribute.Value
+		status  codes.Code
+		retries int
+	}{
+		{
+			name: "kms.Encrypt",
+			attrs: map[string]attribute.Value{
+				"kms.provider":     attribute.StringValue("gcp"),
+				"kms.operation":    attribute.StringValue("Encrypt"),
+				"kms.key_url_hash": attribute.StringValue(hash),
+				"kms.outcome":      attribute.StringValue("ok"),
+				"kms.attempts":     attribute.IntValue(1),
+			},
+			status: codes.Unset,
+		},
+		{
+			name: "kms.Decrypt",
+			attrs: map[string]attribute.Value{
+				"kms.provider":     attribute.StringValue("gcp"),
+				"kms.operation":    attribute.StringValue("Decrypt"),
+				"kms.key_url_hash": attribute.StringValue(hash),
+				"kms.outcome":      attribute.StringValue("unavailable"),
+				"kms.attempts":     attribute.IntValue(2),
+			},
+			status:  codes.Error,
+			retries: 1,
+		},
+	}
+	for i, tt := range tests {
+		span := spans[i]
+		if span.Name != tt.name || span.SpanKind != trace.SpanKindClient {
+			t.Fatalf("span %d is %s of kind %s, want %s of kind %s", i, span.Name, span.SpanKind, tt.name, trace.SpanKindClient)
+		}
+		attrs := map[string]attribute.Value{}
+		for _, attr := range span.Attributes {
+			attrs[string(attr.Key)] = attr.Value
+		}
+		for key, want := range tt.attrs {
+			if got := attrs[key]; got != want {
+				t.Fatalf("span %s has %s=%v, want %v", span.Name, key, got.Emit(), want.Emit())
+			}
+		}
+		if span.Status.Code != tt.status {
+			t.Fatalf("span %s has status %v, want %v", span.Name, span.Status.Code, tt.status)
+		}
+		retries := 0
+		for _, event := range span.Events {
+			if event.Name == "retry" {
+				retries++
+			}
+		}
+		if retries != tt.retries {
+			t.Fatalf("span %s has %d retry events, want %d", span.Name, retries, tt.retries)
+		}
+
+		// the key is only recorded as hash, neither in attributes, events nor the status
+		recorded := []string{span.Status.Description}
+		for _, attr := range span.Attributes {
+			recorded = append(recorded, attr.Value.Emit())
+		}
+		for _, event := range span.Events {
+			recorded = append(recorded, event.Name)
+			for _, attr := range event.Attributes {
+				recorded = append(recorded, attr.Value.Emit())
+			}
+		}
+		for _, value := range recorded {
+			if strings.Contains(value, "layers") {
+				t.Fatalf("span %s records the key in %q", span.Name, value)
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package kms
+
+import (
+	"fmt"
+	"strings"
+)
+
+// KeyURL identifies a key together with the provider it belongs to, e.g.
+// awskms://alias/layers, gcpkms://projects/p/locations/l/keyRings/r/cryptoKeys/k,
+// azurekms://myvault.vault.azure.net/keys/layers, vault://transit/layers,
+// pkcs11:token=kms;object=layers or file://layers.
+type KeyURL struct {
+	// Provider is the name of the provider the key belongs to.
+	Provider string
+	// KeyId is the key as passed to the provider.
+	KeyId string
+}
+
+type keyURLScheme struct {
+	scheme   string
+	provider string
+	// opaque schemes are not followed by "//" and are part of the keyId (pkcs11: URIs)
+	opaque bool
+	// keyIdPrefix replaces the scheme in the keyId
+	keyIdPrefix string
+}
+
+var keyURLSchemes = []keyURLScheme{
+	{scheme: "awskms", provider: "aws"},
+	{scheme: "gcpkms", provider: "gcp"},
+	{scheme: "azurekms", provider: "azure", keyIdPrefix: "https://"},
+	{scheme: "vault", provider: "vault"},
+	{scheme: "pkcs11", provider: "pkcs11", opaque: true},
+	{scheme: "file", provider: "local"},
+}
+
+func (s keyURLScheme) prefix() string {
+	if s.opaque {
+		return s.scheme + ":"
+	}
+	return s.scheme + "://"
+}
+
+// ParseKeyURL parses a scheme qualified key URL. ok is false if the key has no known scheme.
+func ParseKeyURL(key string) (url KeyURL, ok bool, err error) {
+	for _, s := range keyURLSchemes {
+		if !strings.HasPrefix(key, s.prefix()) {
+			continue
+		}
+		keyId := strings.TrimPrefix(key, s.prefix())
+		if s.opaque {
+			keyId = key
+		} else {
+			keyId = s.keyIdPrefix + keyId
+		}
+		if keyId == "" || keyId == s.keyIdPrefix {
+			return KeyURL{}, true, fmt.Errorf("key url %q contains no key", key)
+		}
+		return KeyURL{Provider: s.provider, KeyId: keyId}, true, nil
+	}
+	return KeyURL{}, false, nil
+}
+
+// String returns the scheme qualified key URL. The PIN attributes of pkcs11 URIs are removed,
+// since the key url is stored in annotations and included in errors.
+func (u KeyURL) String() string {
+	for _, s := range keyURLSchemes {
+		if s.provider != u.Provider {
+			continue
+		}
+		if s.opaque {
+			return withoutPIN(u.KeyId)
+		}
+		return s.prefix() + strings.TrimPrefix(u.KeyId, s.keyIdPrefix)
+	}
+	return u.KeyId
+}
+
+// pinAttributes are the query attributes of pkcs11 URIs holding the PIN of the token or the file it is read from.
+var pinAttributes = map[string]bool{"pin-value": true, "pin-source": true}
+
+// withoutPIN removes the PIN attributes from the query of a pkcs11 URI.
+func withoutPIN(uri string) string {
+	path, query, ok := strings.Cut(uri, "?")
+	if !ok {
+		return uri
+	}
+	var kept []string
+	for _, attr := range strings.Split(query, "&") {
+		name, _, _ := strings.Cut(attr, "=")
+		if !pinAttributes[name] {
+			kept = append(kept, attr)
+		}
+	}
+	if len(kept) == 0 {
+		return path
+	}
+	return path + "?" + strings.Join(kept, "&")
+}
@@ -0,0 +1,58 @@
+package kms
+
+import "testing"
+
+func TestParseKeyURL(t *testing.T) {
+	tests := []struct {
+		key      string
+		provider string
+		keyId    string
+		url      string
+	}{
+		{key: "awskms://alias/layers", provider: "aws", keyId: "alias/layers", url: "awskms://alias/layers"},
+		{key: "gcpkms://projects/p/locations/l/keyRings/r/cryptoKeys/k", provider: "gcp", keyId: "projects/p/locations/l/keyRings/r/cryptoKeys/k", url: "gcpkms://projects/p/locations/l/keyRings/r/cryptoKeys/k"},
+		{key: "azurekms://vault.vault.azure.net/keys/layers", provider: "azure", keyId: "https://vault.vault.azure.net/keys/layers", url: "azurekms://vault.vault.azure.net/keys/layers"},
+		{key: "vault://transit/layers", provider: "vault", keyId: "transit/layers", url: "vault://transit/layers"},
+		{key: "file://layers", provider: "local", keyId: "layers", url: "file://layers"},
+		{key: "pkcs11:token=kms;object=layers", provider: "pkcs11", keyId: "pkcs11:token=kms;object=layers", url: "pkcs11:token=kms;object=layers"},
+		{
+			key:      "pkcs11:token=kms;object=layers?module-name=softhsm2&pin-value=1234",
+			provider: "pkcs11",
+			keyId:    "pkcs11:token=kms;object=layers?module-name=softhsm2&pin-value=1234",
+			url:      "pkcs11:token=kms;object=layers?module-name=softhsm2",
+		},
+		{
+			key:      "pkcs11:token=kms;object=layers?pin-source=/etc/kms-crypt/pin&module-name=softhsm2&pin-value=1234",
+			provider: "pkcs11",
+			keyId:    "pkcs11:token=kms;object=layers?pin-source=/etc/kms-crypt/pin&module-name=softhsm2&pin-value=1234",
+			url:      "pkcs11:token=kms;object=layers?module-name=softhsm2",
+		},
+		{
+			key:      "pkcs11:token=kms;object=layers?pin-value=1234",
+			provider: "pkcs11",
+			keyId:    "pkcs11:token=kms;object=layers?pin-value=1234",
+			url:      "pkcs11:token=kms;object=layers",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			url, ok, err := ParseKeyURL(tt.key)
+			if !ok || err != nil {
+				t.Fatalf("ParseKeyURL returned ok %v, error %v", ok, err)
+			}
+			if url.Provider != tt.provider || url.KeyId != tt.keyId {
+				t.Fatalf("ParseKeyURL returned provider %q, key %q, want %q, %q", url.Provider, url.KeyId, tt.provider, tt.keyId)
+			}
+			if got := url.String(); got != tt.url {
+				t.Fatalf("String returned %q, want %q", got, tt.url)
+			}
+		})
+	}
+
+	if _, ok, err := ParseKeyURL("alias/layers"); ok || err != nil {
+		t.Fatalf("ParseKeyURL of a key without scheme returned ok %v, error %v", ok, err)
+	}
+	if _, ok, err := ParseKeyURL("awskms://"); !ok || err == nil {
+		t.Fatalf("ParseKeyURL of a key url without key returned ok %v, error %v", ok, err)
+	}
+}
@@ -0,0 +1,407 @@
+package kms
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	register("vault", newVault)
+}
+
+const (
+	defaultVaultAddress      = "https://127.0.0.1:8200"
+	defaultVaultTransitMount = "transit"
+	kubernetesTokenPath      = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+	// vaultTokenRenewSkew is subtracted from the lease duration of a login token
+	// so that it is renewed before Vault rejects it.
+	vaultTokenRenewSkew = 30 * time.Second
+)
+
+// vaultKms wraps keys with the Transit secrets engine of HashiCorp Vault or OpenBao.
+type vaultKms struct {
+	client       *http.Client
+	address      string
+	namespace    string
+	transitMount string
+	auth         vaultAuth
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+// Interface compliance
+var _ Provider = (*vaultKms)(nil)
+
+// vaultAuth obtains a Vault token. A zero ttl means the token does not expire.
+type vaultAuth interface {
+	login(ctx context.Context, v *vaultKms) (token string, ttl time.Duration, err error)
+}
+
+// Encrypt implements kms.KMS.
+// The keyId is the name of the transit key, optionally prefixed with the mount
+// path ("<mount>/<name>") and suffixed with the key version to encrypt with ("<name>@<version>").
+func (v *vaultKms) Encrypt(ctx context.Context, plain []byte, keyId string, encCtx EncryptionContext) ([]byte, error) {
+	mount, name, version, err := parseVaultKeyId(keyId, v.transitMount)
+	if err != nil {
+		return nil, err
+	}
+	req := vaultEncryptRequest{
+		Plaintext:      base64.StdEncoding.EncodeToString(plain),
+		KeyVersion:     version,
+		AssociatedData: vaultAssociatedData(encCtx),
+	}
+	var resp struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+			KeyVersion int    `json:"key_version"`
+		} `json:"data"`
+	}
+	err = v.do(ctx, path.Join(mount, "encrypt", name), req, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := vaultCiphertextVersion(resp.Data.Ciphertext); err != nil {
+		return nil, err
+	}
+	return []byte(resp.Data.Ciphertext), nil
+}
+
+// Decrypt implements kms.KMS.
+// The key version is taken from the "vault:v<version>:" prefix of the ciphertext.
+func (v *vaultKms) Decrypt(ctx context.Context, cipher []byte, keyId string, encCtx EncryptionContext) ([]byte, error) {
+	mount, name, _, err := parseVaultKeyId(keyId, v.transitMount)
+	if err != nil {
+		return nil, err
+	}
+	version, err := vaultCiphertextVersion(string(cipher))
+	if err != nil {
+		return nil, classified(ErrInvalidCiphertext, err)
+	}
+	req := vaultDecryptRequest{
+		Ciphertext:     string(cipher),
+		AssociatedData: vaultAssociatedData(encCtx),
+	}
+	var resp struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	err = v.do(ctx, path.Join(mount, "decrypt", name), req, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting with version %d of key %s: %w", version, name, err)
+	}
+	plain, err := base64.StdEncoding.DecodeString(resp.Data.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("decoding plaintext: %w", err)
+	}
+	return plain, nil
+}
+
+// SupportsEncryptionContext implements kms.KMS.
+// The encryption context is passed as associated data, which requires a transit key with an AEAD key type.
+func (v *vaultKms) SupportsEncryptionContext() bool {
+	return true
+}
+
+type vaultEncryptRequest struct {
+	Plaintext      string `json:"plaintext"`
+	KeyVersion     int    `json:"key_version,omitempty"`
+	AssociatedData string `json:"associated_data,omitempty"`
+}
+
+type vaultDecryptRequest struct {
+	Ciphertext     string `json:"ciphertext"`
+	AssociatedData string `json:"associated_data,omitempty"`
+}
+
+func vaultAssociatedData(encCtx EncryptionContext) string {
+	aad := encCtx.AAD()
+	if aad == nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(aad)
+}
+
+// parseVaultKeyId splits a keyId of the form [<mount>/]<name>[@<version>].
+func parseVaultKeyId(keyId string, defaultMount string) (mount string, name string, version int, err error) {
+	name = keyId
+	if i := strings.LastIndex(name, "@"); i >= 0 {
+		version, err = strconv.Atoi(name[i+1:])
+		if err != nil || version < 1 {
+			return "", "", 0, fmt.Errorf("invalid key version in vault key %q", keyId)
+		}
+		name = name[:i]
+	}
+	mount = defaultMount
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		mount, name = strings.Trim(name[:i], "/"), name[i+1:]
+	}
+	if name == "" || mount == "" {
+		return "", "", 0, fmt.Errorf("invalid vault key %q", keyId)
+	}
+	return mount, name, version, nil
+}
+
+// vaultCiphertextVersion returns the key version of a transit ciphertext of the form vault:v<version>:<data>.
+func vaultCiphertextVersion(ciphertext string) (int, error) {
+	parts := strings.SplitN(ciphertext, ":", 3)
+	if len(parts) != 3 || parts[0] != "vault" || !strings.HasPrefix(parts[1], "v") {
+		return 0, errors.New("malformed vault transit ciphertext")
+	}
+	version, err := strconv.Atoi(strings.TrimPrefix(parts[1], "v"))
+	if err != nil || version < 1 {
+		return 0, errors.New("malformed key version in vault transit ciphertext")
+	}
+	return version, nil
+}
+
+// do sends an authenticated request to the Vault API and decodes the response into out.
+// If Vault rejects the token, a login method other than a static token gets one retry with a fresh token.
+func (v *vaultKms) do(ctx context.Context, apiPath string, in any, out any) error {
+	token, err := v.getToken(ctx, false)
+	if err != nil {
+		return err
+	}
+	status, err := v.request(ctx, apiPath, token, in, out)
+	if status == http.StatusForbidden {
+		if _, static := v.auth.(*vaultTokenAuth); !static {
+			token, err = v.getToken(ctx, true)
+			if err != nil {
+				return err
+			}
+			_, err = v.request(ctx, apiPath, token, in, out)
+		}
+	}
+	return err
+}
+
+func (v *vaultKms) request(ctx context.Context, apiPath string, token string, in any, out any) (int, error) {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.address+"/v1/"+strings.TrimPrefix(apiPath, "/"), bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vault-Request", "true")
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		err, _ = classifyTransport(err)
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var errResp struct {
+			Errors []string `json:"errors"`
+		}
+		_ = json.Unmarshal(respBody, &errResp)
+		return resp.StatusCode, vaultError(resp.StatusCode, errResp.Errors, fmt.Errorf("vault %s: %d %s", apiPath, resp.StatusCode, strings.Join(errResp.Errors, "; ")))
+	}
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return resp.StatusCode, fmt.Errorf("decoding vault response: %w", err)
+	}
+	return resp.StatusCode, nil
+}
+
+// vaultError classifies the errors of the Vault API by status code and, since transit returns
+// 400 Bad Request for most failures, by error message.
+func vaultError(statusCode int, messages []string, err error) error {
+	switch {
+	case statusCode == http.StatusNotFound:
+		return classified(ErrNotFound, err)
+	case statusCode == http.StatusForbidden || statusCode == http.StatusUnauthorized:
+		return classified(ErrPermissionDenied, err)
+	case statusCode == http.StatusTooManyRequests:
+		return classified(ErrThrottled, err)
+	case statusCode >= 500:
+		// including 503 of a sealed or standby vault
+		return classified(ErrUnavailable, err)
+	}
+	message := strings.ToLower(strings.Join(messages, "; "))
+	switch {
+	case strings.Contains(message, "key not found"):
+		return classified(ErrNotFound, err)
+	case strings.Contains(message, "message authentication failed"), strings.Contains(message, "invalid ciphertext"),
+		strings.Contains(message, "ciphertext version is disallowed"), strings.Contains(message, "invalid key version"):
+		return classified(ErrInvalidCiphertext, err)
+	}
+	return err
+}
+
+// getToken returns the cached token, logging in again if it expired or forceLogin is set.
+func (v *vaultKms) getToken(ctx context.Context, forceLogin bool) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if !forceLogin && v.token != "" && (v.tokenExpiry.IsZero() || time.Now().Before(v.tokenExpiry)) {
+		return v.token, nil
+	}
+	token, ttl, err := v.auth.login(ctx, v)
+	if err != nil {
+		return "", fmt.Errorf("vault login: %w", err)
+	}
+	v.token = token
+	v.tokenExpiry = time.Time{}
+	if ttl > 0 {
+		v.tokenExpiry = time.Now().Add(ttl - min(vaultTokenRenewSkew, ttl/2))
+	}
+	return v.token, nil
+}
+
+type vaultTokenAuth struct {
+	token string
+}
+
+func (a *vaultTokenAuth) login(context.Context, *vaultKms) (string, time.Duration, error) {
+	return a.token, 0, nil
+}
+
+type vaultAppRoleAuth struct {
+	mount    string
+	roleId   string
+	secretId string
+}
+
+func (a *vaultAppRoleAuth) login(ctx context.Context, v *vaultKms) (string, time.Duration, error) {
+	req := map[string]string{
+		"role_id":   a.roleId,
+		"secret_id": a.secretId,
+	}
+	return vaultLogin(ctx, v, a.mount, req)
+}
+
+type vaultKubernetesAuth struct {
+	mount     string
+	role      string
+	tokenPath string
+}
+
+func (a *vaultKubernetesAuth) login(ctx context.Context, v *vaultKms) (string, time.Duration, error) {
+	// the projected service account token is rotated by the kubelet, so it is read on every login
+	jwt, err := os.ReadFile(a.tokenPath)
+	if err != nil {
+		return "", 0, fmt.Errorf("reading service account token: %w", err)
+	}
+	req := map[string]string{
+		"role": a.role,
+		"jwt":  strings.TrimSpace(string(jwt)),
+	}
+	return vaultLogin(ctx, v, a.mount, req)
+}
+
+func vaultLogin(ctx context.Context, v *vaultKms, mount string, req any) (string, time.Duration, error) {
+	var resp struct {
+		Auth struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int    `json:"lease_duration"`
+		} `json:"auth"`
+	}
+	_, err := v.request(ctx, path.Join("auth", mount, "login"), "", req, &resp)
+	if err != nil {
+		return "", 0, err
+	}
+	if resp.Auth.ClientToken == "" {
+		return "", 0, errors.New("vault login response contains no token")
+	}
+	return resp.Auth.ClientToken, time.Duration(resp.Auth.LeaseDuration) * time.Second, nil
+}
+
+// newVault configures the provider from the environment variables known from the vault CLI
+// (VAULT_ADDR, VAULT_TOKEN, VAULT_NAMESPACE, VAULT_CACERT, VAULT_SKIP_VERIFY) and
+// VAULT_AUTH_METHOD (token, approle or kubernetes) with its method specific settings.
+// The endpoint of the configuration takes precedence over VAULT_ADDR.
+func newVault(_ context.Context, cfg Config) (Provider, error) {
+	address := cfg.Endpoint
+	if address == "" {
+		address = envOrDefault("VAULT_ADDR", defaultVaultAddress)
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caCert := os.Getenv("VAULT_CACERT"); caCert != "" {
+		pem, err := os.ReadFile(caCert)
+		if err != nil {
+			return nil, fmt.Errorf("reading VAULT_CACERT: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caCert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if skip, _ := strconv.ParseBool(os.Getenv("VAULT_SKIP_VERIFY")); skip {
+		tlsConfig.InsecureSkipVerify = true
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	authMethod := envOrDefault("VAULT_AUTH_METHOD", "token")
+	authMount := envOrDefault("VAULT_AUTH_MOUNT", authMethod)
+	var auth vaultAuth
+	switch authMethod {
+	case "token":
+		token := os.Getenv("VAULT_TOKEN")
+		if token == "" {
+			return nil, errors.New("VAULT_TOKEN is not set")
+		}
+		auth = &vaultTokenAuth{token: token}
+	case "approle":
+		auth = &vaultAppRoleAuth{
+			mount:    authMount,
+			roleId:   os.Getenv("VAULT_ROLE_ID"),
+			secretId: os.Getenv("VAULT_SECRET_ID"),
+		}
+	case "kubernetes":
+		auth = &vaultKubernetesAuth{
+			mount:     authMount,
+			role:      os.Getenv("VAULT_KUBERNETES_ROLE"),
+			tokenPath: envOrDefault("VAULT_KUBERNETES_TOKEN_PATH", kubernetesTokenPath),
+		}
+	default:
+		return nil, fmt.Errorf("unknown VAULT_AUTH_METHOD %q", authMethod)
+	}
+
+	return &vaultKms{
+		client:       &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		address:      strings.TrimRight(address, "/"),
+		namespace:    os.Getenv("VAULT_NAMESPACE"),
+		transitMount: envOrDefault("VAULT_TRANSIT_MOUNT", defaultVaultTransitMount),
+		auth:         auth,
+	}, nil
+}
+
+func envOrDefault(key string, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,248 @@
+package kms
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const fakeVaultToken = "test-token"
+
+// fakeTransit is an in-process stand-in for the encrypt and decrypt endpoints of the Vault Transit engine.
+// Keys are created on first use, except for the names of the failure responses.
+type fakeTransit struct {
+	mu   sync.Mutex
+	keys map[string][]byte
+	// failures maps key names to the status code and error message returned for them
+	failures map[string]fakeVaultFailure
+}
+
+type fakeVaultFailure struct {
+	status  int
+	message string
+}
+
+func newFakeTransit(t *testing.T) (*fakeTransit, *httptest.Server) {
+	f := &fakeTransit{keys: map[string][]byte{}, failures: map[string]fakeVaultFailure{}}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return f, server
+}
+
+func (f *fakeTransit) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Vault-Token") != fakeVaultToken {
+		vaultErrorResponse(w, http.StatusForbidden, "permission denied")
+		return
+	}
+	// /v1/<mount>/<operation>/<name>
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/"), "/")
+	if len(parts) != 3 || parts[0] != "transit" {
+		vaultErrorResponse(w, http.StatusNotFound, "no handler for route")
+		return
+	}
+	operation, name := parts[1], parts[2]
+	f.mu.Lock()
+	failure, failed := f.failures[name]
+	f.mu.Unlock()
+	if failed {
+		vaultErrorResponse(w, failure.status, failure.message)
+		return
+	}
+
+	var req struct {
+		Plaintext      string `json:"plaintext"`
+		Ciphertext     string `json:"ciphertext"`
+		AssociatedData string `json:"associated_data"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		vaultErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	aad, _ := base64.StdEncoding.DecodeString(req.AssociatedData)
+	key := f.key(name)
+
+	switch operation {
+	case "encrypt":
+		plain, err := base64.StdEncoding.DecodeString(req.Plaintext)
+		if err != nil {
+			vaultErrorResponse(w, http.StatusBadRequest, "failed to base64-decode plaintext")
+			return
+		}
+		nonce, ciphertext, err := sealAESGCM(key, plain, aad)
+		if err != nil {
+			vaultErrorResponse(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		vaultResponse(w, map[string]any{
+			"ciphertext":  "vault:v1:" + base64.StdEncoding.EncodeToString(append(nonce, ciphertext...)),
+			"key_version": 1,
+		})
+	case "decrypt":
+		data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(req.Ciphertext, "vault:v1:"))
+		if err != nil || len(data) < 12 {
+			vaultErrorResponse(w, http.StatusBadRequest, "invalid ciphertext: unable to decode")
+			return
+		}
+		plain, err := openAESGCM(key, data[:12], data[12:], aad)
+		if err != nil {
+			vaultErrorResponse(w, http.StatusBadRequest, "cipher: message authentication failed")
+			return
+		}
+		vaultResponse(w, map[string]any{"plaintext": base64.StdEncoding.EncodeToString(plain)})
+	default:
+		vaultErrorResponse(w, http.StatusNotFound, "no handler for route")
+	}
+}
+
+func (f *fakeTransit) key(name string) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key, ok := f.keys[name]
+	if !ok {
+		key = make([]byte, 32)
+		rand.Read(key)
+		f.keys[name] = key
+	}
+	return key
+}
+
+// fail returns the failure responses for the key names.
+func (f *fakeTransit) fail(failures map[string]fakeVaultFailure) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for name, failure := range failures {
+		f.failures[name] = failure
+	}
+}
+
+func vaultResponse(w http.ResponseWriter, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"data": data})
+}
+
+func vaultErrorResponse(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"errors": []string{message}})
+}
+
+func newTestVault(t *testing.T, address string) Provider {
+	t.Setenv("VAULT_AUTH_METHOD", "token")
+	t.Setenv("VAULT_TOKEN", fakeVaultToken)
+	provider, err := newVault(context.Background(), Config{Endpoint: address})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+func TestVaultWrapUnwrap(t *testing.T) {
+	_, server := newFakeTransit(t)
+	vault := newTestVault(t, server.URL)
+	ctx := context.Background()
+	plain := []byte("layer key")
+	encCtx := EncryptionContext{"repository": "registry.example.com/app"}
+
+	for _, keyId := range []string{"layers", "transit/layers", "layers@1"} {
+		t.Run(keyId, func(t *testing.T) {
+			cipher, err := vault.Encrypt(ctx, plain, keyId, encCtx)
+			if err != nil {
+				t.Fatalf("Encrypt: %v", err)
+			}
+			if !strings.HasPrefix(string(cipher), "vault:v1:") {
+				t.Fatalf("ciphertext %q has no version prefix", cipher)
+			}
+			decrypted, err := vault.Decrypt(ctx, cipher, keyId, encCtx)
+			if err != nil {
+				t.Fatalf("Decrypt: %v", err)
+			}
+			if !bytes.Equal(decrypted, plain) {
+				t.Fatalf("Decrypt returned %q, want %q", decrypted, plain)
+			}
+		})
+	}
+
+	cipher, err := vault.Encrypt(ctx, plain, "layers", encCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = vault.Decrypt(ctx, cipher, "layers", EncryptionContext{"repository": "other"})
+	if !errors.Is(err, ErrInvalidCiphertext) {
+		t.Fatalf("Decrypt with another encryption context returned %v, want %v", err, ErrInvalidCiphertext)
+	}
+}
+
+func TestVaultErrorClassification(t *testing.T) {
+	fake, server := newFakeTransit(t)
+	fake.fail(map[string]fakeVaultFailure{
+		"missing":   {status: http.StatusBadRequest, message: "encryption key not found"},
+		"deleted":   {status: http.StatusNotFound, message: ""},
+		"denied":    {status: http.StatusForbidden, message: "permission denied"},
+		"throttled": {status: http.StatusTooManyRequests, message: "rate limit quota exceeded"},
+		"sealed":    {status: http.StatusServiceUnavailable, message: "Vault is sealed"},
+		"rotated":   {status: http.StatusBadRequest, message: "ciphertext version is disallowed by policy (too old)"},
+		"other":     {status: http.StatusBadRequest, message: "unexpected"},
+	})
+	vault := newTestVault(t, server.URL)
+	ctx := context.Background()
+
+	tests := []struct {
+		keyId string
+		want  string
+	}{
+		{keyId: "missing", want: "not_found"},
+		{keyId: "deleted", want: "not_found"},
+		{keyId: "denied", want: "permission_denied"},
+		{keyId: "throttled", want: "throttled"},
+		{keyId: "sealed", want: "unavailable"},
+		{keyId: "rotated", want: "invalid_ciphertext"},
+		{keyId: "other", want: "other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.keyId, func(t *testing.T) {
+			_, err := vault.Decrypt(ctx, []byte("vault:v1:AAAA"), tt.keyId, nil)
+			if err == nil {
+				t.Fatal("Decrypt succeeded")
+			}
+			if got := ErrorClass(err); got != tt.want {
+				t.Fatalf("Decrypt returned %v of class %s, want %s", err, got, tt.want)
+			}
+		})
+	}
+
+	t.Run("malformed ciphertext", func(t *testing.T) {
+		_, err := vault.Decrypt(ctx, []byte("not a transit ciphertext"), "layers", nil)
+		if !errors.Is(err, ErrInvalidCiphertext) {
+			t.Fatalf("Decrypt returned %v, want %v", err, ErrInvalidCiphertext)
+		}
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		unreachable := httptest.NewServer(http.NotFoundHandler())
+		unreachable.Close()
+		_, err := newTestVault(t, unreachable.URL).Encrypt(ctx, []byte("layer key"), "layers", nil)
+		if !errors.Is(err, ErrUnavailable) {
+			t.Fatalf("Encrypt returned %v, want %v", err, ErrUnavailable)
+		}
+	})
+
+	t.Run("wrong token", func(t *testing.T) {
+		t.Setenv("VAULT_TOKEN", "wrong")
+		provider, err := newVault(ctx, Config{Endpoint: server.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = provider.Encrypt(ctx, []byte("layer key"), "layers", nil)
+		if !errors.Is(err, ErrPermissionDenied) {
+			t.Fatalf("Encrypt returned %v, want %v", err, ErrPermissionDenied)
+		}
+	})
+}
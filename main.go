@@ -1,33 +1,89 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"log"
 	"log/slog"
 	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	keyproviderconfig "github.com/containers/ocicrypt/config/keyprovider-config"
 	"github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors/logging"
 
+	"github.com/hown3d/kms-ocicrypt/audit"
 	keyproviderpb "github.com/hown3d/kms-ocicrypt/gen/go/utils/keyprovider"
 	"github.com/hown3d/kms-ocicrypt/kms"
 	"github.com/hown3d/kms-ocicrypt/service"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 var (
-	port                    = flag.Int("port", 9666, "port to bind grpc server to")
-	keyProviderName *string = flag.String("keyprovider-name", "kms-crypt", "name of the keyprovider in ocicrypt config")
-	kmsProviderName *string = flag.String("kms-provider", "aws", "which kms provider to use. Implemented providers: aws")
+	port                       = flag.Int("port", 9666, "port to bind grpc server to")
+	keyProviderName    *string = flag.String("keyprovider-name", "kms-crypt", "name of the keyprovider in ocicrypt config")
+	kmsProviderNames           = flag.String("kms-provider", "aws", "comma separated kms providers to enable, the first one handles keys without key url scheme. Implemented providers: "+strings.Join(kms.Names(), ", "))
+	kmsRegion                  = flag.String("kms-region", "", "region (aws) or location (gcp) of the kms keys")
+	kmsEndpoint                = flag.String("kms-endpoint", "", "override the API endpoint of the kms provider")
+	kmsProfile                 = flag.String("kms-profile", "", "named configuration profile to load kms credentials from (aws)")
+	kmsTimeout                 = providerDurationFlag("kms-timeout", 0, "timeout of a single kms call attempt, 0 disables the timeout")
+	kmsRetryAttempts           = providerIntFlag("kms-retry-attempts", 3, "maximum attempts of kms calls failing with a retryable error, 1 disables retries")
+	kmsRetryBackoff            = providerDurationFlag("kms-retry-backoff", 100*time.Millisecond, "maximum wait before the first retry, doubled for every further retry")
+	kmsRetryMaxBackoff         = providerDurationFlag("kms-retry-max-backoff", 2*time.Second, "maximum wait before a retry")
+	kmsCircuitFailures         = providerIntFlag("kms-circuit-failures", 5, "consecutive retryable kms failures that open the circuit breaker, 0 disables it")
+	kmsCircuitOpen             = providerDurationFlag("kms-circuit-open", 30*time.Second, "how long the open circuit breaker fails kms calls before a trial call")
+	socketPath                 = flag.String("socket", "", "unix socket path to serve grpc on instead of the tcp port")
+	socketMode                 = flag.Uint("socket-mode", 0o660, "file mode of the unix socket")
+	socketOwner                = flag.String("socket-owner", "", "owner of the unix socket as <user>[:<group>], by name or id")
+	allowedPeerUIDs            = flag.String("allowed-peer-uids", "", "comma separated uids allowed to call on the unix socket, checked with SO_PEERCRED")
+	allowedPeerGIDs            = flag.String("allowed-peer-gids", "", "comma separated gids allowed to call on the unix socket, checked with SO_PEERCRED")
+	allowedPeerPIDs            = flag.String("allowed-peer-pids", "", "comma separated pids allowed to call on the unix socket, checked with SO_PEERCRED")
+	tlsCert                    = flag.String("tls-cert", "", "certificate file of the grpc server, enables tls together with -tls-key")
+	tlsKey                     = flag.String("tls-key", "", "private key file of the grpc server certificate")
+	tlsClientCA                = flag.String("tls-client-ca", "", "CA bundle to verify client certificates against, enables mutual tls")
+	cacheTTL                   = flag.Duration("cache-ttl", 0, "cache unwrapped layer keys in memory for this duration, 0 disables the cache")
+	cacheMaxEntries            = flag.Int("cache-max-entries", 1024, "maximum number of cached unwrapped layer keys")
+	encryptionContext          = flag.String("encryption-context", "", "comma separated sources of the encryption context wrapped keys are bound to. Sources: keyprovider, label, repository")
+	metricsAddress             = flag.String("metrics-address", "", "address to serve prometheus metrics on at /metrics, e.g. :9667, empty disables metrics")
+	auditLogPath               = flag.String("audit-log", "", "file to append an audit event of every wrap and unwrap to as JSON lines")
+	auditLogMaxSize            = flag.Int64("audit-log-max-size", 100, "size in MiB after which the audit log file is rotated, 0 disables the rotation (not in cmd mode)")
+	auditLogMaxBackups         = flag.Int("audit-log-max-backups", 5, "number of rotated audit log files to keep")
+	auditSyslog                = flag.String("audit-syslog", "", `send audit events to syslog instead of a file, "local" or <network>://<host>:<port>`)
+	healthAddress              = flag.String("health-address", "", "address to serve the /healthz and /readyz endpoints on, e.g. :9668, empty disables them")
+	healthCanaryKeys           = flag.String("health-canary-keys", "", "comma separated keys to encrypt and decrypt with periodically, the service is ready once all succeed")
+	healthInterval             = flag.Duration("health-interval", 30*time.Second, "interval of the canary checks")
+	healthTimeout              = flag.Duration("health-timeout", 10*time.Second, "timeout of the canary check of a key")
+	shutdownTimeout            = flag.Duration("shutdown-timeout", 25*time.Second, "how long running requests may finish on SIGTERM before they are canceled")
+	cmdMode                    = flag.Bool("cmd", false, "serve a single ocicrypt cmd keyprovider request from stdin to stdout instead of running the grpc server")
+	ocicryptConfigPath         = flag.String("ocicrypt-config", "/etc/containerd/ocicrypt/ocicrypt_keyprovider.conf", "path of the generated ocicrypt keyprovider config")
+	ocicryptConfigMode         = flag.String("ocicrypt-config-mode", "grpc", `keyprovider entry of the generated ocicrypt config. "grpc" points ocicrypt to this server, "cmd" runs this binary with -cmd per request and exits after writing the config`)
 )
 
 // InterceptorLogger adapts slog logger to interceptor logger.
 // This code is simple enough to be copied and not imported.
+// The error of the request is redacted like in the audit log, status messages may contain key urls with credentials.
 func InterceptorLogger(l *slog.Logger) logging.Logger {
 	return logging.LoggerFunc(func(ctx context.Context, lvl logging.Level, msg string, fields ...any) {
+		fields = slices.Clone(fields)
+		for i := 0; i+1 < len(fields); i += 2 {
+			if text, ok := fields[i+1].(string); ok && fields[i] == "grpc.error" {
+				fields[i+1] = audit.RedactText(text)
+			}
+		}
 		l.Log(ctx, slog.Level(lvl), msg, fields...)
 	})
 }
@@ -35,70 +91,411 @@ func InterceptorLogger(l *slog.Logger) logging.Logger {
 func main() {
 	flag.Parse()
 
-	err := createOcicryptKeyproviderConfig()
-	if err != nil {
-		log.Fatalf("error creating ocicrypt keyprovider config: %s", err)
+	if *cmdMode {
+		if err := serveCmd(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *ocicryptConfigMode == "cmd" {
+		if _, err := createOcicryptKeyproviderConfig(); err != nil {
+			log.Fatalf("error creating ocicrypt keyprovider config: %s", err)
+		}
+		return
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	if err := run(ctx); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run serves the grpc server until ctx is done and drains it.
+// Every resource is released when run returns, also after a failed start.
+func run(ctx context.Context) error {
+	// all phases of the shutdown share one deadline of -shutdown-timeout, from the signal or a failed start on
+	var shutdownCtx context.Context
+	var cancelShutdown context.CancelFunc = func() {}
+	defer func() { cancelShutdown() }()
+	shutdownDeadline := func() context.Context {
+		if shutdownCtx == nil {
+			shutdownCtx, cancelShutdown = context.WithTimeout(context.Background(), *shutdownTimeout)
+		}
+		return shutdownCtx
 	}
 
-	lis, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", *port))
+	removeConfig, err := createOcicryptKeyproviderConfig()
 	if err != nil {
-		log.Fatalf("Failed to listen on port %v: %v", *port, err)
+		return fmt.Errorf("error creating ocicrypt keyprovider config: %w", err)
 	}
+	restoreConfig := sync.OnceFunc(func() {
+		if err := removeConfig(); err != nil {
+			slog.Error("removing the keyprovider from the ocicrypt config", "error", err)
+		}
+	})
+	defer restoreConfig()
 
-	grpcServer := grpc.NewServer(
-		grpc.ChainUnaryInterceptor(
-			logging.UnaryServerInterceptor(InterceptorLogger(slog.Default())),
-		),
+	var serverOpts []grpc.ServerOption
+	var lis net.Listener
+	if *socketPath != "" {
+		lis, err = listenUnix(*socketPath, fs.FileMode(*socketMode), *socketOwner)
+		if err != nil {
+			return fmt.Errorf("failed to listen on socket %v: %w", *socketPath, err)
+		}
+		allowlist, err := parsePeerAllowlist()
+		if err != nil {
+			lis.Close()
+			return err
+		}
+		if !allowlist.empty() {
+			serverOpts = append(serverOpts, grpc.Creds(newPeerCredentials(allowlist)))
+		}
+	} else {
+		lis, err = net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", *port))
+		if err != nil {
+			return fmt.Errorf("failed to listen on port %v: %w", *port, err)
+		}
+	}
+	// closes the listener if the server doesn't start, the grpc server closes it otherwise
+	defer lis.Close()
+
+	if *tlsCert != "" || *tlsKey != "" {
+		if len(serverOpts) > 0 {
+			return errors.New("tls can't be combined with the peer credential allowlist")
+		}
+		reloader, err := newTLSReloader(*tlsCert, *tlsKey, *tlsClientCA)
+		if err != nil {
+			return err
+		}
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(reloader.serverConfig())))
+		// ocicrypt dials keyproviders without transport security and has no tls settings
+		slog.Warn("tls is enabled, but the ocicrypt grpc client only connects without tls. Clients of the generated ocicrypt config can't connect")
+	} else if *tlsClientCA != "" {
+		return errors.New("-tls-client-ca needs -tls-cert and -tls-key")
+	}
+
+	unaryInterceptors := []grpc.UnaryServerInterceptor{
+		logging.UnaryServerInterceptor(InterceptorLogger(slog.Default())),
+	}
+	var observer kms.CallObserver
+	var serverMetrics *metrics
+	if *metricsAddress != "" {
+		serverMetrics = newMetrics()
+		unaryInterceptors = append(unaryInterceptors, serverMetrics.unaryInterceptor)
+		observer = serverMetrics.observeKMSCall
+	}
+
+	if tracingEnabled() {
+		shutdownTracing, err := setupTracing(context.Background())
+		if err != nil {
+			return err
+		}
+		defer func() {
+			// an unreachable collector must not block the exit past the grace period
+			if err := shutdownTracing(shutdownDeadline()); err != nil {
+				slog.Error("flushing traces", "error", err)
+			}
+		}()
+		serverOpts = append(serverOpts, tracingServerOption())
+	}
+
+	grpcServer := grpc.NewServer(append(serverOpts,
+		grpc.ChainUnaryInterceptor(unaryInterceptors...),
 		grpc.ChainStreamInterceptor(
 			logging.StreamServerInterceptor(InterceptorLogger(slog.Default())),
 		),
-	)
+	)...)
 
-	kmsProvider, ok := kms.Providers[*kmsProviderName]
-	if !ok {
-		log.Fatalf("specified kms provider %v is not registered", *kmsProviderName)
+	auditLog, err := newAuditLogger(true)
+	if err != nil {
+		return err
 	}
-	keyproviderpb.RegisterKeyProviderServiceServer(grpcServer, service.NewKeyProviderService(kmsProvider, *keyProviderName))
+	if auditLog != nil {
+		defer func() {
+			if err := auditLog.Close(); err != nil {
+				slog.Error("closing audit log", "error", err)
+			}
+		}()
+	}
+	keyProviderService, err := newKeyProviderService(observer, auditLog)
+	if err != nil {
+		return err
+	}
+	defer keyProviderService.Close()
+	keyproviderpb.RegisterKeyProviderServiceServer(grpcServer, keyProviderService)
 
-	slog.Info(fmt.Sprintf("serving grpc server on :%d", *port))
-	if err := grpcServer.Serve(lis); err != nil {
-		log.Fatalf("Failed to serve grpc server: %s", err)
+	var canaryKeys []string
+	if *healthCanaryKeys != "" {
+		canaryKeys = strings.Split(*healthCanaryKeys, ",")
 	}
-}
+	readiness := newReadiness(keyProviderService, canaryKeys, *healthInterval, *healthTimeout)
+	readiness.start()
+	defer readiness.close()
+	healthpb.RegisterHealthServer(grpcServer, readiness.grpc)
 
-type OcicryptKeyproviderConfig struct {
-	KeyProviders map[string]struct {
-		GRPC string `json:"grpc"`
-	} `json:"key-providers"`
+	httpServers := newHTTPServers()
+	defer func() {
+		httpServers.shutdown(shutdownDeadline())
+	}()
+	if serverMetrics != nil {
+		serverMetrics.registerCacheStats(keyProviderService)
+		httpServers.handle(*metricsAddress, "/metrics", serverMetrics.handler())
+	}
+	if *healthAddress != "" {
+		httpServers.handle(*healthAddress, "/healthz", readiness.liveHandler())
+		httpServers.handle(*healthAddress, "/readyz", readiness.readyHandler())
+	}
+	if err := httpServers.serve(); err != nil {
+		return fmt.Errorf("failed to serve http: %w", err)
+	}
+
+	slog.Info("serving grpc server", "address", lis.Addr().String())
+	served := make(chan error, 1)
+	go func() {
+		served <- grpcServer.Serve(lis)
+	}()
+	select {
+	case err := <-served:
+		return fmt.Errorf("failed to serve grpc server: %w", err)
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down, draining requests", "timeout", *shutdownTimeout)
+	readiness.shutdown()
+	drainGRPCServer(shutdownDeadline(), grpcServer)
+	// ocicrypt stops calling this server before the http endpoints and the tracing are shut down
+	restoreConfig()
+	return nil
 }
 
-const keyproviderFilepath = "/etc/containerd/ocicrypt/ocicrypt_keyprovider.conf"
+// drainGRPCServer stops accepting requests and waits for the running requests until ctx is done,
+// before they are canceled.
+func drainGRPCServer(ctx context.Context, server *grpc.Server) {
+	drained := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		slog.Info("drained grpc server")
+	case <-ctx.Done():
+		slog.Warn("draining the grpc server timed out, canceling the remaining requests")
+		server.Stop()
+		<-drained
+	}
+}
 
-func createOcicryptKeyproviderConfig() error {
-	ip := os.Getenv("POD_IP")
-	cfg := OcicryptKeyproviderConfig{
-		KeyProviders: map[string]struct {
-			GRPC string `json:"grpc"`
-		}{
-			*keyProviderName: {
-				GRPC: fmt.Sprintf("%v:%d", ip, *port),
+// newKeyProviderService creates the kms providers and the service of the flags.
+// The observer is called for every kms call attempt and requests are recorded in the audit log, if set.
+func newKeyProviderService(observer kms.CallObserver, auditLog *audit.Logger) (*service.KeyProviderService, error) {
+	providerNames := strings.Split(*kmsProviderNames, ",")
+	kmsProviders := make(map[string]kms.Provider, len(providerNames))
+	for _, name := range providerNames {
+		kmsProvider, err := kms.New(context.Background(), name, kms.Config{
+			Region:   *kmsRegion,
+			Endpoint: *kmsEndpoint,
+			Profile:  *kmsProfile,
+			Timeout:  kmsTimeout.get(name),
+			Retry: kms.RetryPolicy{
+				MaxAttempts:    kmsRetryAttempts.get(name),
+				InitialBackoff: kmsRetryBackoff.get(name),
+				MaxBackoff:     kmsRetryMaxBackoff.get(name),
 			},
-		},
+			CircuitBreaker: kms.CircuitBreakerPolicy{
+				FailureThreshold: kmsCircuitFailures.get(name),
+				OpenTimeout:      kmsCircuitOpen.get(name),
+			},
+			Observer: observer,
+		})
+		if err != nil {
+			return nil, err
+		}
+		kmsProviders[name] = kmsProvider
+	}
+	var opts []service.Option
+	if *encryptionContext != "" {
+		opts = append(opts, service.WithEncryptionContext(strings.Split(*encryptionContext, ",")))
+	}
+	if *cacheTTL > 0 {
+		opts = append(opts, service.WithKeyCache(*cacheTTL, *cacheMaxEntries))
+	}
+	if auditLog != nil {
+		opts = append(opts, service.WithAuditLog(auditLog))
 	}
+	return service.NewKeyProviderService(kmsProviders, providerNames[0], *keyProviderName, opts...)
+}
+
+// newAuditLogger creates the audit logger of the sink of the flags, nil if auditing is disabled.
+// Without rotate, the audit log file is never rotated by the process.
+func newAuditLogger(rotate bool) (*audit.Logger, error) {
+	switch {
+	case *auditLogPath != "" && *auditSyslog != "":
+		return nil, errors.New("-audit-log and -audit-syslog can't be combined")
+	case *auditLogPath != "":
+		maxSize := *auditLogMaxSize << 20
+		if !rotate {
+			maxSize = 0
+		}
+		sink, err := audit.NewFileSink(*auditLogPath, maxSize, *auditLogMaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		return audit.NewLogger(sink), nil
+	case *auditSyslog != "":
+		sink, err := audit.NewSyslogSink(*auditSyslog, "kms-ocicrypt")
+		if err != nil {
+			return nil, err
+		}
+		return audit.NewLogger(sink), nil
+	}
+	return nil, nil
+}
+
+func parsePeerAllowlist() (peerAllowlist, error) {
+	var allowlist peerAllowlist
+	var err error
+	if allowlist.uids, err = parseIDs[uint32](*allowedPeerUIDs); err != nil {
+		return peerAllowlist{}, fmt.Errorf("-allowed-peer-uids: %w", err)
+	}
+	if allowlist.gids, err = parseIDs[uint32](*allowedPeerGIDs); err != nil {
+		return peerAllowlist{}, fmt.Errorf("-allowed-peer-gids: %w", err)
+	}
+	if allowlist.pids, err = parseIDs[int32](*allowedPeerPIDs); err != nil {
+		return peerAllowlist{}, fmt.Errorf("-allowed-peer-pids: %w", err)
+	}
+	return allowlist, nil
+}
+
+type OcicryptKeyproviderConfig struct {
+	KeyProviders map[string]keyproviderconfig.KeyProviderAttrs `json:"key-providers"`
+}
+
+// createOcicryptKeyproviderConfig adds the keyprovider to the ocicrypt config, keeping the other keyproviders of the file.
+// remove removes the keyprovider again, or restores the entry of the same name it replaced. If the file was
+// written in the meantime, e.g. by the next pod of the daemonset with the same entry, it is kept.
+func createOcicryptKeyproviderConfig() (remove func() error, err error) {
+	attrs, err := keyproviderAttrs()
+	if err != nil {
+		return nil, err
+	}
+	cfg, existed, err := readOcicryptKeyproviderConfig(*ocicryptConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	previous, replaced := cfg.KeyProviders[*keyProviderName]
+	if replaced && reflect.DeepEqual(previous, attrs) {
+		// left behind by a previous run of this keyprovider
+		replaced = false
+	}
+	cfg.KeyProviders[*keyProviderName] = attrs
 	slog.Info("generateOcicryptKeyproviderConfig", "config", cfg)
-	cfgBytes, err := json.MarshalIndent(cfg, "", "\t")
+	written, err := writeOcicryptKeyproviderConfig(*ocicryptConfigPath, cfg)
 	if err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		// every write replaces the file, so another inode or modification time is another writer
+		info, err := os.Stat(*ocicryptConfigPath)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !os.SameFile(info, written) || !info.ModTime().Equal(written.ModTime()) {
+			slog.Info("the ocicrypt config was written by another process, keeping it", "path", *ocicryptConfigPath)
+			return nil
+		}
+		cfg, _, err := readOcicryptKeyproviderConfig(*ocicryptConfigPath)
+		if err != nil {
+			return err
+		}
+		if replaced {
+			cfg.KeyProviders[*keyProviderName] = previous
+		} else {
+			delete(cfg.KeyProviders, *keyProviderName)
+		}
+		if len(cfg.KeyProviders) == 0 && !existed {
+			return os.Remove(*ocicryptConfigPath)
+		}
+		_, err = writeOcicryptKeyproviderConfig(*ocicryptConfigPath, cfg)
 		return err
+	}, nil
+}
+
+// keyproviderAttrs returns the ocicrypt config entry of the keyprovider for the config mode.
+func keyproviderAttrs() (keyproviderconfig.KeyProviderAttrs, error) {
+	switch *ocicryptConfigMode {
+	case "grpc":
+		address := fmt.Sprintf("%v:%d", os.Getenv("POD_IP"), *port)
+		if *socketPath != "" {
+			socket, err := filepath.Abs(*socketPath)
+			if err != nil {
+				return keyproviderconfig.KeyProviderAttrs{}, err
+			}
+			address = "unix://" + socket
+		}
+		return keyproviderconfig.KeyProviderAttrs{Grpc: address}, nil
+	case "cmd":
+		command, err := keyproviderCommand()
+		if err != nil {
+			return keyproviderconfig.KeyProviderAttrs{}, err
+		}
+		return keyproviderconfig.KeyProviderAttrs{Command: command}, nil
+	default:
+		return keyproviderconfig.KeyProviderAttrs{}, fmt.Errorf("unknown ocicrypt config mode %q, expected grpc or cmd", *ocicryptConfigMode)
 	}
+}
 
-	f, err := os.Create(keyproviderFilepath)
+// readOcicryptKeyproviderConfig reads the config file, a missing file is an empty config.
+func readOcicryptKeyproviderConfig(path string) (cfg OcicryptKeyproviderConfig, existed bool, err error) {
+	cfgBytes, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return OcicryptKeyproviderConfig{KeyProviders: map[string]keyproviderconfig.KeyProviderAttrs{}}, false, nil
+	}
 	if err != nil {
-		return err
+		return OcicryptKeyproviderConfig{}, false, err
+	}
+	if len(bytes.TrimSpace(cfgBytes)) > 0 {
+		if err := json.Unmarshal(cfgBytes, &cfg); err != nil {
+			return OcicryptKeyproviderConfig{}, true, fmt.Errorf("parsing %s: %w", path, err)
+		}
+	}
+	if cfg.KeyProviders == nil {
+		cfg.KeyProviders = map[string]keyproviderconfig.KeyProviderAttrs{}
 	}
+	return cfg, true, nil
+}
 
-	_, err = f.Write(cfgBytes)
+// writeOcicryptKeyproviderConfig replaces the config file atomically, so ocicrypt never reads a partial file.
+// It returns the info of the written file, which identifies it until the file is replaced again.
+func writeOcicryptKeyproviderConfig(path string, cfg OcicryptKeyproviderConfig) (fs.FileInfo, error) {
+	cfgBytes, err := json.MarshalIndent(cfg, "", "\t")
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(cfgBytes); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Chmod(0o644); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(f.Name())
+	if err != nil {
+		return nil, err
+	}
+	return info, os.Rename(f.Name(), path)
 }
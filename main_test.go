@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	keyproviderconfig "github.com/containers/ocicrypt/config/keyprovider-config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// TestMain runs main instead of the tests in the processes started by startMain,
+// so they run the binary linked with all packages of the build.
+func TestMain(m *testing.M) {
+	if os.Getenv("KMS_OCICRYPT_TEST_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// startMain returns the command running main with the arguments and the local provider on keyDir.
+func startMain(keyDir string, args ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], append([]string{"-kms-provider=local", "-keyprovider-name=kms"}, args...)...)
+	cmd.Env = append(os.Environ(), "KMS_OCICRYPT_TEST_MAIN=1", "LOCAL_KMS_KEY_DIR="+keyDir)
+	return cmd
+}
+
+func TestMainCmd(t *testing.T) {
+	keyDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(keyDir, "a"), bytes.Repeat([]byte{1}, 32), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	layerKey := []byte("layer key")
+	parameters := map[string][][]byte{"kms": {[]byte("file://a")}}
+
+	wrap := startMain(keyDir, "-cmd")
+	wrap.Stdin = bytes.NewReader(mustMarshal(t, map[string]any{
+		"op":            "keywrap",
+		"keywrapparams": map[string]any{"ec": map[string]any{"Parameters": parameters}, "optsdata": layerKey},
+	}))
+	output, err := wrap.Output()
+	if err != nil {
+		t.Fatalf("keywrap: %v: %s", err, stderr(err))
+	}
+	var wrapped struct {
+		KeyWrapResults struct {
+			Annotation []byte `json:"annotation"`
+		} `json:"keywrapresults"`
+	}
+	if err := json.Unmarshal(output, &wrapped); err != nil {
+		t.Fatalf("keywrap wrote %q: %v", output, err)
+	}
+
+	unwrap := startMain(keyDir, "-cmd")
+	unwrap.Stdin = bytes.NewReader(mustMarshal(t, map[string]any{
+		"op":              "keyunwrap",
+		"keyunwrapparams": map[string]any{"dc": map[string]any{"Parameters": parameters}, "annotation": wrapped.KeyWrapResults.Annotation},
+	}))
+	output, err = unwrap.Output()
+	if err != nil {
+		t.Fatalf("keyunwrap: %v: %s", err, stderr(err))
+	}
+	var unwrapped struct {
+		KeyUnwrapResults struct {
+			OptsData []byte `json:"optsdata"`
+		} `json:"keyunwrapresults"`
+	}
+	if err := json.Unmarshal(output, &unwrapped); err != nil || !bytes.Equal(unwrapped.KeyUnwrapResults.OptsData, layerKey) {
+		t.Fatalf("keyunwrap wrote %q, %v, want the layer key", output, err)
+	}
+}
+
+func TestMainServer(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stopping the server needs SIGTERM")
+	}
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "kms-ocicrypt.sock")
+	configPath := filepath.Join(dir, "ocicrypt_keyprovider.conf")
+	server := startMain(t.TempDir(), "-socket="+socket, "-ocicrypt-config="+configPath)
+	var serverStderr bytes.Buffer
+	server.Stderr = &serverStderr
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- server.Wait()
+	}()
+	t.Cleanup(func() {
+		server.Process.Kill()
+	})
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := os.Stat(socket); err == nil {
+			break
+		}
+		select {
+		case err := <-exited:
+			t.Fatalf("server exited with %v before serving: %s", err, serverStderr.Bytes())
+		case <-time.After(10 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server didn't create the socket: %s", serverStderr.Bytes())
+		}
+	}
+
+	conn, err := grpc.Dial("unix://"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	response, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil || response.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("health check returned %v, %v, want %v", response, err, healthpb.HealthCheckResponse_SERVING)
+	}
+	if _, err := os.Stat(configPath); err != nil {
+		t.Fatalf("server didn't write the ocicrypt config: %v", err)
+	}
+
+	if err := server.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Fatalf("server exited with %v: %s", err, serverStderr.Bytes())
+		}
+	case <-ctx.Done():
+		t.Fatalf("server didn't exit on SIGTERM: %s", serverStderr.Bytes())
+	}
+	if _, err := os.Stat(configPath); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("server didn't remove the ocicrypt config it created: %v", err)
+	}
+}
+
+func mustMarshal(t *testing.T, v any) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// stderr returns the output of a failed command on stderr.
+func stderr(err error) []byte {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.Stderr
+	}
+	return nil
+}
+
+// setFlag sets the flag variable for the test.
+func setFlag[T any](t *testing.T, flag *T, value T) {
+	previous := *flag
+	*flag = value
+	t.Cleanup(func() { *flag = previous })
+}
+
+// setupOcicryptConfig points the ocicrypt config flags to a file in a temporary directory, written with the
+// keyproviders if not nil.
+func setupOcicryptConfig(t *testing.T, keyProviders map[string]keyproviderconfig.KeyProviderAttrs) string {
+	path := filepath.Join(t.TempDir(), "ocicrypt_keyprovider.conf")
+	setFlag(t, ocicryptConfigPath, path)
+	setFlag(t, ocicryptConfigMode, "grpc")
+	setFlag(t, keyProviderName, "kms")
+	setFlag(t, socketPath, "")
+	setFlag(t, port, 9666)
+	t.Setenv("POD_IP", "10.0.0.1")
+	if keyProviders != nil {
+		if _, err := writeOcicryptKeyproviderConfig(path, OcicryptKeyproviderConfig{KeyProviders: keyProviders}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func readTestConfig(t *testing.T, path string) map[string]keyproviderconfig.KeyProviderAttrs {
+	cfg, existed, err := readOcicryptKeyproviderConfig(path)
+	if err != nil || !existed {
+		t.Fatalf("reading the ocicrypt config: %v, existed %v", err, existed)
+	}
+	return cfg.KeyProviders
+}
+
+func TestOcicryptConfigCreate(t *testing.T) {
+	path := setupOcicryptConfig(t, nil)
+	remove, err := createOcicryptKeyproviderConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]keyproviderconfig.KeyProviderAttrs{"kms": {Grpc: "10.0.0.1:9666"}}
+	if got := readTestConfig(t, path); !reflect.DeepEqual(got, want) {
+		t.Fatalf("config has keyproviders %+v, want %+v", got, want)
+	}
+
+	// the config file didn't exist and is removed again
+	if err := remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("config file exists after remove: %v", err)
+	}
+}
+
+func TestOcicryptConfigKeepOthers(t *testing.T) {
+	other := keyproviderconfig.KeyProviderAttrs{Command: &keyproviderconfig.Command{Path: "/usr/bin/other-keyprovider"}}
+	path := setupOcicryptConfig(t, map[string]keyproviderconfig.KeyProviderAttrs{"other": other})
+	setFlag(t, socketPath, "/run/kms-ocicrypt.sock")
+	remove, err := createOcicryptKeyproviderConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]keyproviderconfig.KeyProviderAttrs{"other": other, "kms": {Grpc: "unix:///run/kms-ocicrypt.sock"}}
+	if got := readTestConfig(t, path); !reflect.DeepEqual(got, want) {
+		t.Fatalf("config has keyproviders %+v, want %+v", got, want)
+	}
+
+	if err := remove(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestConfig(t, path); !reflect.DeepEqual(got, map[string]keyproviderconfig.KeyProviderAttrs{"other": other}) {
+		t.Fatalf("config has keyproviders %+v after remove, want only other", got)
+	}
+}
+
+func TestOcicryptConfigReplaceAndRestore(t *testing.T) {
+	previous := keyproviderconfig.KeyProviderAttrs{Grpc: "10.0.0.2:9666"}
+	path := setupOcicryptConfig(t, map[string]keyproviderconfig.KeyProviderAttrs{"kms": previous})
+	remove, err := createOcicryptKeyproviderConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestConfig(t, path)["kms"]; got.Grpc != "10.0.0.1:9666" {
+		t.Fatalf("config has keyprovider %+v, want the address of this process", got)
+	}
+
+	if err := remove(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestConfig(t, path); !reflect.DeepEqual(got, map[string]keyproviderconfig.KeyProviderAttrs{"kms": previous}) {
+		t.Fatalf("config has keyproviders %+v after remove, want the replaced entry", got)
+	}
+}
+
+func TestOcicryptConfigLeftBehind(t *testing.T) {
+	// the entry of a previous run of this keyprovider is not restored
+	path := setupOcicryptConfig(t, map[string]keyproviderconfig.KeyProviderAttrs{"kms": {Grpc: "10.0.0.1:9666"}})
+	remove, err := createOcicryptKeyproviderConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remove(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestConfig(t, path); len(got) != 0 {
+		t.Fatalf("config has keyproviders %+v after remove, want none", got)
+	}
+}
+
+func TestOcicryptConfigWrittenByOthers(t *testing.T) {
+	path := setupOcicryptConfig(t, nil)
+	remove, err := createOcicryptKeyproviderConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the next pod of a surge rollout with host network writes the same entry
+	cfg, _, err := readOcicryptKeyproviderConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writeOcicryptKeyproviderConfig(path, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := remove(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestConfig(t, path); !reflect.DeepEqual(got, cfg.KeyProviders) {
+		t.Fatalf("config has keyproviders %+v after remove, want the entry of the other process", got)
+	}
+
+	// a removed file stays removed
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := remove(); err != nil {
+		t.Fatalf("remove of a removed config: %v", err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("config file exists after remove: %v", err)
+	}
+}
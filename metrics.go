@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+
+	"github.com/hown3d/kms-ocicrypt/kms"
+	"github.com/hown3d/kms-ocicrypt/service"
+)
+
+const metricsNamespace = "kms_ocicrypt"
+
+// metrics are the prometheus metrics of the grpc server and the kms calls.
+type metrics struct {
+	registry        *prometheus.Registry
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	inflight        *prometheus.GaugeVec
+	kmsDuration     *prometheus.HistogramVec
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "grpc_requests_total",
+			Help:      "Handled keyprovider requests by method and grpc status code.",
+		}, []string{"method", "code"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "grpc_request_duration_seconds",
+			Help:      "Duration of keyprovider requests by method and grpc status code.",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+		}, []string{"method", "code"}),
+		inflight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "grpc_requests_in_flight",
+			Help:      "Keyprovider requests currently being handled by method.",
+		}, []string{"method"}),
+		kmsDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "kms_call_duration_seconds",
+			Help:      "Duration of kms call attempts by provider, operation and error class, which is empty for successful calls.",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+		}, []string{"provider", "operation", "error"}),
+	}
+	m.registry.MustRegister(
+		m.requests,
+		m.requestDuration,
+		m.inflight,
+		m.kmsDuration,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// unaryInterceptor counts the requests and records their duration and the requests in flight.
+func (m *metrics) unaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	method := path.Base(info.FullMethod)
+	inflight := m.inflight.WithLabelValues(method)
+	inflight.Inc()
+	defer inflight.Dec()
+
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	code := status.Code(err).String()
+	m.requests.WithLabelValues(method, code).Inc()
+	m.requestDuration.WithLabelValues(method, code).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+// observeKMSCall implements kms.CallObserver.
+func (m *metrics) observeKMSCall(provider string, operation string, duration time.Duration, err error) {
+	m.kmsDuration.WithLabelValues(provider, operation, kms.ErrorClass(err)).Observe(duration.Seconds())
+}
+
+// registerCacheStats exports the counters of the unwrapped key cache, if it is enabled.
+func (m *metrics) registerCacheStats(s *service.KeyProviderService) {
+	if _, ok := s.CacheStats(); !ok {
+		return
+	}
+	stat := func(get func(service.KeyCacheStats) float64) func() float64 {
+		return func() float64 {
+			stats, _ := s.CacheStats()
+			return get(stats)
+		}
+	}
+	m.registry.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "cache_hits_total",
+			Help:      "Unwraps served from the key cache.",
+		}, stat(func(stats service.KeyCacheStats) float64 { return float64(stats.Hits) })),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "cache_misses_total",
+			Help:      "Unwraps not found in the key cache.",
+		}, stat(func(stats service.KeyCacheStats) float64 { return float64(stats.Misses) })),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "cache_evictions_total",
+			Help:      "Keys evicted from the key cache.",
+		}, stat(func(stats service.KeyCacheStats) float64 { return float64(stats.Evictions) })),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "cache_entries",
+			Help:      "Keys currently in the key cache.",
+		}, stat(func(stats service.KeyCacheStats) float64 { return float64(stats.Entries) })),
+	)
+}
+
+// handler serves the metrics in the prometheus exposition format.
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
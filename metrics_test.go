@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/hown3d/kms-ocicrypt/kms"
+)
+
+// gatherMetrics returns the metrics of the family in the registry of m by their labels, e.g. `code="OK",method="WrapKey"`.
+func gatherMetrics(t *testing.T, m *metrics, name string) map[string]*dto.Metric {
+	families, err := m.registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := map[string]*dto.Metric{}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			var labels []string
+			for _, label := range metric.GetLabel() {
+				labels = append(labels, fmt.Sprintf("%s=%q", label.GetName(), label.GetValue()))
+			}
+			sort.Strings(labels)
+			metrics[strings.Join(labels, ",")] = metric
+		}
+	}
+	return metrics
+}
+
+func TestMetricsUnaryInterceptor(t *testing.T) {
+	m := newMetrics()
+	call := func(method string, err error) {
+		info := &grpc.UnaryServerInfo{FullMethod: "/keyprovider.KeyProviderService/" + method}
+		_, gotErr := m.unaryInterceptor(context.Background(), nil, info, func(context.Context, any) (any, error) {
+			if inflight := gatherMetrics(t, m, "kms_ocicrypt_grpc_requests_in_flight")[fmt.Sprintf("method=%q", method)]; inflight.GetGauge().GetValue() != 1 {
+				t.Errorf("%s in flight is %v while handled, want 1", method, inflight.GetGauge().GetValue())
+			}
+			return nil, err
+		})
+		if gotErr != err {
+			t.Fatalf("interceptor returned %v, want %v", gotErr, err)
+		}
+	}
+	call("WrapKey", nil)
+	call("WrapKey", nil)
+	call("UnWrapKey", status.Error(codes.PermissionDenied, "denied"))
+
+	want := map[string]uint64{
+		`code="OK",method="WrapKey"`:                 2,
+		`code="PermissionDenied",method="UnWrapKey"`: 1,
+	}
+	requests := gatherMetrics(t, m, "kms_ocicrypt_grpc_requests_total")
+	durations := gatherMetrics(t, m, "kms_ocicrypt_grpc_request_duration_seconds")
+	if len(requests) != len(want) || len(durations) != len(want) {
+		t.Fatalf("got request counters %v and histograms %v, want %v", keys(requests), keys(durations), want)
+	}
+	for labels, count := range want {
+		if got := requests[labels].GetCounter().GetValue(); got != float64(count) {
+			t.Errorf("request counter {%s} is %v, want %d", labels, got, count)
+		}
+		if got := durations[labels].GetHistogram().GetSampleCount(); got != count {
+			t.Errorf("request duration histogram {%s} has %d samples, want %d", labels, got, count)
+		}
+	}
+	for labels, inflight := range gatherMetrics(t, m, "kms_ocicrypt_grpc_requests_in_flight") {
+		if inflight.GetGauge().GetValue() != 0 {
+			t.Errorf("requests in flight {%s} is %v after the requests, want 0", labels, inflight.GetGauge().GetValue())
+		}
+	}
+}
+
+func TestMetricsKMSCalls(t *testing.T) {
+	m := newMetrics()
+	m.observeKMSCall("aws", "encrypt", 10*time.Millisecond, nil)
+	m.observeKMSCall("aws", "decrypt", time.Second, fmt.Errorf("decrypting: %w", kms.ErrPermissionDenied))
+	m.observeKMSCall("aws", "decrypt", time.Second, fmt.Errorf("decrypting: %w", kms.ErrPermissionDenied))
+
+	want := map[string]uint64{
+		`error="",operation="encrypt",provider="aws"`:                  1,
+		`error="permission_denied",operation="decrypt",provider="aws"`: 2,
+	}
+	durations := gatherMetrics(t, m, "kms_ocicrypt_kms_call_duration_seconds")
+	if len(durations) != len(want) {
+		t.Fatalf("got kms call histograms %v, want %v", keys(durations), want)
+	}
+	for labels, count := range want {
+		if got := durations[labels].GetHistogram().GetSampleCount(); got != count {
+			t.Errorf("kms call histogram {%s} has %d samples, want %d", labels, got, count)
+		}
+	}
+}
+
+func keys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// getPeerCred reads the peer credentials of a unix socket connection with SO_PEERCRED.
+func getPeerCred(conn net.Conn) (peerCred, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return peerCred{}, errors.New("not a unix socket connection")
+	}
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return peerCred{}, err
+	}
+	var ucred *unix.Ucred
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		ucred, sockErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return peerCred{}, err
+	}
+	if sockErr != nil {
+		return peerCred{}, sockErr
+	}
+	return peerCred{uid: ucred.Uid, gid: ucred.Gid, pid: ucred.Pid}, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// peerHealthServer reports the auth info of the caller of Check.
+type peerHealthServer struct {
+	*health.Server
+	authInfo chan any
+}
+
+func (s peerHealthServer) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	if p, ok := peer.FromContext(ctx); ok {
+		s.authInfo <- p.AuthInfo
+	}
+	return s.Server.Check(ctx, req)
+}
+
+// checkOverSocket serves the health service on a unix socket with the allowlist and calls it.
+func checkOverSocket(t *testing.T, allowlist peerAllowlist) (any, error) {
+	path := filepath.Join(t.TempDir(), "kms-ocicrypt.sock")
+	lis, err := listenUnix(path, 0o600, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer(grpc.Creds(newPeerCredentials(allowlist)))
+	healthServer := peerHealthServer{Server: health.NewServer(), authInfo: make(chan any, 1)}
+	healthpb.RegisterHealthServer(server, healthServer)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	conn, err := grpc.Dial("unix://"+path, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+		return nil, err
+	}
+	return <-healthServer.authInfo, nil
+}
+
+func TestPeerCredentials(t *testing.T) {
+	uid, gid, pid := uint32(os.Getuid()), uint32(os.Getgid()), int32(os.Getpid())
+
+	authInfo, err := checkOverSocket(t, peerAllowlist{uids: []uint32{uid}, pids: []int32{pid}})
+	if err != nil {
+		t.Fatalf("allowed peer: %v", err)
+	}
+	want := peerCredAuthInfo{Uid: uid, Gid: gid, Pid: pid}
+	if info, ok := authInfo.(peerCredAuthInfo); !ok || info.Uid != want.Uid || info.Gid != want.Gid || info.Pid != want.Pid {
+		t.Fatalf("allowed peer has auth info %+v, want %+v", authInfo, want)
+	}
+
+	for name, allowlist := range map[string]peerAllowlist{
+		"uid": {uids: []uint32{uid + 1}},
+		"gid": {uids: []uint32{uid}, gids: []uint32{gid + 1}},
+		"pid": {pids: []int32{pid + 1}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := checkOverSocket(t, allowlist)
+			if status.Code(err) != codes.Unavailable {
+				t.Fatalf("peer with another %s got %v, want %v", name, err, codes.Unavailable)
+			}
+		})
+	}
+}
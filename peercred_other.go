@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// getPeerCred is only supported on linux.
+func getPeerCred(net.Conn) (peerCred, error) {
+	return peerCred{}, errors.New("peer credentials are only supported on linux")
+}
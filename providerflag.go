@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// providerFlag is a flag with a default value and per provider overrides, e.g. "3", "aws=5" or "3,aws=5,vault=1".
+type providerFlag[T any] struct {
+	value     T
+	providers map[string]T
+	parse     func(string) (T, error)
+}
+
+func providerFlagVar[T any](name string, value T, usage string, parse func(string) (T, error)) *providerFlag[T] {
+	f := &providerFlag[T]{value: value, providers: map[string]T{}, parse: parse}
+	flag.Var(f, name, usage+`, optionally per provider as "<default>,<provider>=<value>,..."`)
+	return f
+}
+
+func providerDurationFlag(name string, value time.Duration, usage string) *providerFlag[time.Duration] {
+	return providerFlagVar(name, value, usage, time.ParseDuration)
+}
+
+func providerIntFlag(name string, value int, usage string) *providerFlag[int] {
+	return providerFlagVar(name, value, usage, strconv.Atoi)
+}
+
+// get returns the value for a provider.
+func (f *providerFlag[T]) get(provider string) T {
+	if value, ok := f.providers[provider]; ok {
+		return value
+	}
+	return f.value
+}
+
+// String implements flag.Value.
+func (f *providerFlag[T]) String() string {
+	if f == nil {
+		return ""
+	}
+	values := []string{fmt.Sprint(f.value)}
+	for provider, value := range f.providers {
+		values = append(values, fmt.Sprintf("%s=%v", provider, value))
+	}
+	return strings.Join(values, ",")
+}
+
+// Set implements flag.Value.
+func (f *providerFlag[T]) Set(s string) error {
+	for _, part := range strings.Split(s, ",") {
+		provider, rawValue, perProvider := strings.Cut(part, "=")
+		if !perProvider {
+			rawValue = provider
+		}
+		value, err := f.parse(strings.TrimSpace(rawValue))
+		if err != nil {
+			return err
+		}
+		if perProvider {
+			f.providers[strings.TrimSpace(provider)] = value
+		} else {
+			f.value = value
+		}
+	}
+	return nil
+}
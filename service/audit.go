@@ -0,0 +1,53 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/hown3d/kms-ocicrypt/audit"
+	keyproviderpb "github.com/hown3d/kms-ocicrypt/gen/go/utils/keyprovider"
+	"google.golang.org/grpc/status"
+)
+
+// WithAuditLog records every wrap and unwrap request with the caller, keys, wrapped key fingerprint and outcome.
+func WithAuditLog(logger *audit.Logger) Option {
+	return func(s *KeyProviderService) error {
+		s.auditLog = logger
+		return nil
+	}
+}
+
+// audited runs a request and records it in the audit log, if enabled.
+// The request fills in the keys and the wrapped key fingerprint of the event as far as it gets.
+func (s *KeyProviderService) audited(ctx context.Context, operation audit.Operation, run func(event *audit.Event) (*keyproviderpb.KeyProviderKeyWrapProtocolOutput, error)) (*keyproviderpb.KeyProviderKeyWrapProtocolOutput, error) {
+	if s.auditLog == nil {
+		return run(&audit.Event{})
+	}
+	start := time.Now()
+	event := audit.Event{Time: start, Operation: operation, Caller: audit.Caller(ctx)}
+	output, err := run(&event)
+	event.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	event.Outcome = status.Code(err).String()
+	if err != nil {
+		event.Error = status.Convert(err).Message()
+	}
+	if logErr := s.auditLog.Log(event); logErr != nil {
+		slog.Error("writing audit log", "operation", operation, "error", logErr)
+	}
+	return output, err
+}
+
+// auditKeys returns the key urls of the keys of a request.
+func (s *KeyProviderService) auditKeys(kmsKeys []string) []audit.Key {
+	keys := make([]audit.Key, 0, len(kmsKeys))
+	for _, key := range kmsKeys {
+		keyURL, err := s.parseKey(key)
+		if err != nil {
+			keys = append(keys, audit.Key{URL: key})
+			continue
+		}
+		keys = append(keys, audit.Key{URL: keyURL.String(), Provider: keyURL.Provider})
+	}
+	return keys
+}
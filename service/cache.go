@@ -0,0 +1,207 @@
+package service
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hown3d/kms-ocicrypt/kms"
+)
+
+// KeyCacheStats are the counters of the unwrapped key cache.
+type KeyCacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+}
+
+// WithKeyCache caches unwrapped layer keys in memory for ttl, so pulling the same image again doesn't call the kms.
+// At most maxEntries keys are cached, the least recently used key is evicted first.
+// Cached keys are held in locked memory where possible, zeroed on eviction and never written to disk.
+func WithKeyCache(ttl time.Duration, maxEntries int) Option {
+	return func(s *KeyProviderService) error {
+		if ttl <= 0 || maxEntries <= 0 {
+			return fmt.Errorf("key cache needs a positive ttl and max entries, got %s and %d", ttl, maxEntries)
+		}
+		s.cache = newKeyCache(ttl, maxEntries)
+		return nil
+	}
+}
+
+// CacheStats returns the counters of the unwrapped key cache, ok is false if the cache is disabled.
+func (s *KeyProviderService) CacheStats() (stats KeyCacheStats, ok bool) {
+	if s.cache == nil {
+		return KeyCacheStats{}, false
+	}
+	return s.cache.stats(), true
+}
+
+// keyCache is a LRU cache of unwrapped layer keys with expiry.
+type keyCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]*list.Element
+	lru     *list.List
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+
+	stop chan struct{}
+	once sync.Once
+}
+
+type keyCacheEntry struct {
+	id      [sha256.Size]byte
+	value   *lockedBuffer
+	expires time.Time
+}
+
+func newKeyCache(ttl time.Duration, maxEntries int) *keyCache {
+	c := &keyCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[[sha256.Size]byte]*list.Element, maxEntries),
+		lru:        list.New(),
+		stop:       make(chan struct{}),
+	}
+	go c.expireLoop()
+	return c
+}
+
+// unwrapID identifies an unwrap request by a hash of the wrapped keys with their key urls,
+// the supplied keys and the expected encryption context. A cached key is only returned to
+// requests supplying the same keys and encryption context as the request that unwrapped it,
+// concurrent requests with the same id share one unwrap.
+func unwrapID(packet annotationPacket, kmsKeys []string, encCtx kms.EncryptionContext) [sha256.Size]byte {
+	h := sha256.New()
+	write := func(b []byte) {
+		h.Write(binary.AppendUvarint(nil, uint64(len(b))))
+		h.Write(b)
+	}
+	write(binary.AppendUvarint(nil, uint64(packet.Threshold)))
+	for _, r := range packet.Recipients {
+		write([]byte(r.Algorithm))
+		write([]byte(r.KeyUrl))
+		write(r.WrappedKey)
+		write(r.EncryptionContext.AAD())
+	}
+	keys := append([]string(nil), kmsKeys...)
+	sort.Strings(keys)
+	for _, key := range keys {
+		write([]byte(key))
+	}
+	write(encCtx.AAD())
+
+	var id [sha256.Size]byte
+	h.Sum(id[:0])
+	return id
+}
+
+// get returns a copy of the cached key.
+func (c *keyCache) get(id [sha256.Size]byte) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[id]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	entry := elem.Value.(*keyCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(elem)
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	c.hits.Add(1)
+	return append([]byte(nil), entry.value.bytes()...), true
+}
+
+// put caches a copy of the key.
+func (c *keyCache) put(id [sha256.Size]byte, key []byte) {
+	value, err := newLockedBuffer(len(key))
+	if err != nil {
+		slog.Warn("cannot allocate memory for the key cache", "error", err)
+		return
+	}
+	copy(value.bytes(), key)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[id]; ok {
+		c.remove(elem)
+	}
+	for c.lru.Len() >= c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+	c.entries[id] = c.lru.PushFront(&keyCacheEntry{id: id, value: value, expires: time.Now().Add(c.ttl)})
+}
+
+// remove evicts an entry and zeroes its key, c.mu must be held.
+func (c *keyCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*keyCacheEntry)
+	delete(c.entries, entry.id)
+	entry.value.destroy()
+	c.evictions.Add(1)
+}
+
+// expireLoop evicts expired keys, so they don't stay in memory until the next request.
+func (c *keyCache) expireLoop() {
+	ticker := time.NewTicker(max(c.ttl/2, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.expire()
+		}
+	}
+}
+
+func (c *keyCache) expire() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for elem := c.lru.Back(); elem != nil; {
+		prev := elem.Prev()
+		if now.After(elem.Value.(*keyCacheEntry).expires) {
+			c.remove(elem)
+		}
+		elem = prev
+	}
+}
+
+// close stops the expiry and zeroes all cached keys.
+func (c *keyCache) close() {
+	c.once.Do(func() {
+		close(c.stop)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for c.lru.Len() > 0 {
+			c.remove(c.lru.Back())
+		}
+	})
+}
+
+func (c *keyCache) stats() KeyCacheStats {
+	c.mu.Lock()
+	entries := c.lru.Len()
+	c.mu.Unlock()
+	return KeyCacheStats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+		Entries:   entries,
+	}
+}
@@ -0,0 +1,159 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hown3d/kms-ocicrypt/kms"
+)
+
+func newTestKeyCache(t *testing.T, ttl time.Duration, maxEntries int) *keyCache {
+	c := newKeyCache(ttl, maxEntries)
+	t.Cleanup(c.close)
+	return c
+}
+
+// cachedBuffer returns the locked buffer of a cached key.
+func cachedBuffer(t *testing.T, c *keyCache, id [sha256.Size]byte) *lockedBuffer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[id]
+	if !ok {
+		t.Fatalf("key %x is not cached", id[:4])
+	}
+	return elem.Value.(*keyCacheEntry).value
+}
+
+func TestKeyCacheCopies(t *testing.T) {
+	c := newTestKeyCache(t, time.Minute, 10)
+	id := sha256.Sum256([]byte("a"))
+	key := []byte("layer key")
+
+	c.put(id, key)
+	// the caller zeroes its key after use
+	clear(key)
+	got, ok := c.get(id)
+	if !ok || !bytes.Equal(got, []byte("layer key")) {
+		t.Fatalf("get returned %q, %v, want the cached key", got, ok)
+	}
+	clear(got)
+	if got, _ := c.get(id); !bytes.Equal(got, []byte("layer key")) {
+		t.Fatalf("get after changing the returned key returned %q", got)
+	}
+}
+
+func TestKeyCacheExpiry(t *testing.T) {
+	c := newTestKeyCache(t, 20*time.Millisecond, 10)
+	a, b := sha256.Sum256([]byte("a")), sha256.Sum256([]byte("b"))
+	c.put(a, []byte("key a"))
+	c.put(b, []byte("key b"))
+	bufferB := cachedBuffer(t, c, b)
+	time.Sleep(30 * time.Millisecond)
+
+	// expired keys are missed on get and evicted in the background
+	if got, ok := c.get(a); ok {
+		t.Fatalf("get of an expired key returned %q", got)
+	}
+	c.expire()
+	if bufferB.mem != nil {
+		t.Fatal("expired key was not zeroed")
+	}
+	if stats := c.stats(); stats.Entries != 0 || stats.Evictions != 2 || stats.Misses != 1 {
+		t.Fatalf("stats after expiry are %+v, want 0 entries, 2 evictions and 1 miss", stats)
+	}
+}
+
+func TestKeyCacheMaxEntries(t *testing.T) {
+	c := newTestKeyCache(t, time.Minute, 2)
+	a, b, d := sha256.Sum256([]byte("a")), sha256.Sum256([]byte("b")), sha256.Sum256([]byte("d"))
+	c.put(a, []byte("key a"))
+	c.put(b, []byte("key b"))
+	bufferB := cachedBuffer(t, c, b)
+	// a is used more recently than b
+	if _, ok := c.get(a); !ok {
+		t.Fatal("key a is not cached")
+	}
+	c.put(d, []byte("key d"))
+
+	if _, ok := c.get(b); ok {
+		t.Fatal("least recently used key was not evicted")
+	}
+	if bufferB.mem != nil {
+		t.Fatal("evicted key was not zeroed")
+	}
+	for _, id := range [][sha256.Size]byte{a, d} {
+		if _, ok := c.get(id); !ok {
+			t.Fatalf("key %x was evicted", id[:4])
+		}
+	}
+	want := KeyCacheStats{Hits: 3, Misses: 1, Evictions: 1, Entries: 2}
+	if stats := c.stats(); stats != want {
+		t.Fatalf("stats are %+v, want %+v", stats, want)
+	}
+}
+
+func TestKeyCacheClose(t *testing.T) {
+	c := newKeyCache(time.Minute, 10)
+	id := sha256.Sum256([]byte("a"))
+	c.put(id, []byte("layer key"))
+	buffer := cachedBuffer(t, c, id)
+
+	c.close()
+	if buffer.mem != nil {
+		t.Fatal("cached key was not zeroed on close")
+	}
+	if stats := c.stats(); stats.Entries != 0 {
+		t.Fatalf("cache has %d entries after close", stats.Entries)
+	}
+	// closing twice is fine
+	c.close()
+}
+
+func TestUnwrapID(t *testing.T) {
+	packet := annotationPacket{Threshold: 1, Recipients: []recipient{{Algorithm: kms.AlgorithmDefault, KeyUrl: "file://a", WrappedKey: []byte("wrapped")}}}
+	encCtx := kms.EncryptionContext{EncryptionContextRepository: "registry.example.com/app"}
+	id := unwrapID(packet, []string{"file://a", "file://b"}, encCtx)
+
+	if other := unwrapID(packet, []string{"file://b", "file://a"}, encCtx); other != id {
+		t.Fatal("the order of the supplied keys changes the id")
+	}
+	for name, other := range map[string][sha256.Size]byte{
+		"encryption context":    unwrapID(packet, []string{"file://a", "file://b"}, kms.EncryptionContext{EncryptionContextRepository: "registry.example.com/other"}),
+		"no encryption context": unwrapID(packet, []string{"file://a", "file://b"}, nil),
+		"keys":                  unwrapID(packet, []string{"file://a"}, encCtx),
+		"wrapped key": unwrapID(annotationPacket{Threshold: 1, Recipients: []recipient{{Algorithm: kms.AlgorithmDefault, KeyUrl: "file://a", WrappedKey: []byte("other")}}},
+			[]string{"file://a", "file://b"}, encCtx),
+	} {
+		if other == id {
+			t.Fatalf("another %s has the same id", name)
+		}
+	}
+}
+
+func TestUnwrapCached(t *testing.T) {
+	s := newTestService(t, filepath.Join("testdata", "keys"), WithKeyCache(time.Minute, 10), WithEncryptionContext([]string{EncryptionContextRepository}))
+	annotation, err := wrap(s, goldenLayerKey, "file://a", "repository=registry.example.com/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		got, err := unwrap(s, annotation, "file://a", "repository=registry.example.com/app")
+		if err != nil || !bytes.Equal(got, goldenLayerKey) {
+			t.Fatalf("UnWrapKey %d returned %q, %v", i, got, err)
+		}
+	}
+	if stats, _ := s.CacheStats(); stats.Hits != 1 || stats.Misses != 1 || stats.Entries != 1 {
+		t.Fatalf("cache stats are %+v, want 1 hit, 1 miss and 1 entry", stats)
+	}
+
+	// the cached key is not returned for another encryption context
+	if _, err := unwrap(s, annotation, "file://a", "repository=registry.example.com/other"); err == nil {
+		t.Fatal("UnWrapKey with another repository returned the cached key")
+	}
+	if stats, _ := s.CacheStats(); stats.Hits != 1 {
+		t.Fatalf("cache stats are %+v, want no further hit", stats)
+	}
+}
@@ -0,0 +1,39 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	keyproviderpb "github.com/hown3d/kms-ocicrypt/gen/go/utils/keyprovider"
+)
+
+// RunCmd serves a single request of the ocicrypt cmd keyprovider protocol.
+// ocicrypt writes the keyprovider protocol input to in and reads the output from out.
+func (s *KeyProviderService) RunCmd(ctx context.Context, in io.Reader, out io.Writer) error {
+	inputBytes, err := io.ReadAll(in)
+	if err != nil {
+		return fmt.Errorf("reading keyprovider input: %w", err)
+	}
+	var input keyWrapProtocolInput
+	if err := json.Unmarshal(inputBytes, &input); err != nil {
+		return fmt.Errorf("unmarshaling keyprovider input: %w", err)
+	}
+
+	request := &keyproviderpb.KeyProviderKeyWrapProtocolInput{KeyProviderKeyWrapProtocolInput: inputBytes}
+	var output *keyproviderpb.KeyProviderKeyWrapProtocolOutput
+	switch input.Operation {
+	case opKeyWrap:
+		output, err = s.WrapKey(ctx, request)
+	case opKeyUnwrap:
+		output, err = s.UnWrapKey(ctx, request)
+	default:
+		return fmt.Errorf("unknown keyprovider operation %q", input.Operation)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(output.KeyProviderKeyWrapProtocolOutput)
+	return err
+}
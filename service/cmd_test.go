@@ -0,0 +1,76 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/containers/ocicrypt/config"
+)
+
+// runCmd runs a cmd keyprovider request and decodes its output.
+func runCmd(t *testing.T, s *KeyProviderService, input keyWrapProtocolInput) keyWrapProtocolOutput {
+	inputBytes, err := json.Marshal(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := s.RunCmd(context.Background(), bytes.NewReader(inputBytes), &out); err != nil {
+		t.Fatalf("RunCmd %s: %v", input.Operation, err)
+	}
+	var output keyWrapProtocolOutput
+	if err := json.Unmarshal(out.Bytes(), &output); err != nil {
+		t.Fatalf("RunCmd %s wrote invalid output %q: %v", input.Operation, out.Bytes(), err)
+	}
+	return output
+}
+
+func TestRunCmd(t *testing.T) {
+	keyDir := t.TempDir()
+	writeTestKeys(t, keyDir, "a")
+	s := newTestService(t, keyDir)
+	layerKey := []byte("layer key")
+
+	wrapped := runCmd(t, s, keyWrapProtocolInput{
+		Operation: opKeyWrap,
+		KeyWrapParams: keyWrapParams{
+			Ec:       &config.EncryptConfig{Parameters: keyProviderParameters([]string{"file://a"})},
+			OptsData: layerKey,
+		},
+	})
+	unwrapped := runCmd(t, s, keyWrapProtocolInput{
+		Operation: opKeyUnwrap,
+		KeyUnwrapParams: keyUnwrapParams{
+			Dc:         &config.DecryptConfig{Parameters: keyProviderParameters([]string{"file://a"})},
+			Annotation: wrapped.KeyWrapResults.Annotation,
+		},
+	})
+	if !bytes.Equal(unwrapped.KeyUnwrapResults.OptsData, layerKey) {
+		t.Fatalf("RunCmd unwrapped %q, want %q", unwrapped.KeyUnwrapResults.OptsData, layerKey)
+	}
+
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{name: "invalid json", input: "{", want: "unmarshaling keyprovider input"},
+		{name: "unknown operation", input: `{"op":"keyrotate"}`, want: `unknown keyprovider operation "keyrotate"`},
+		{name: "missing encryption parameters", input: `{"op":"keywrap"}`, want: "missing encryption parameters"},
+		{name: "missing decryption parameters", input: `{"op":"keyunwrap"}`, want: "missing decryption parameters"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := s.RunCmd(context.Background(), strings.NewReader(tt.input), &out)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("RunCmd returned %v, want an error containing %q", err, tt.want)
+			}
+			if out.Len() > 0 {
+				t.Fatalf("RunCmd wrote %q on error", out.Bytes())
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/hown3d/kms-ocicrypt/kms"
+)
+
+// Sources of the encryption context, which binds wrapped keys to the image they belong to.
+const (
+	// EncryptionContextKeyProvider adds the name of the keyprovider.
+	EncryptionContextKeyProvider = "keyprovider"
+	// EncryptionContextLabel adds the label=<value> parameter.
+	EncryptionContextLabel = "label"
+	// EncryptionContextRepository adds the repository=<name> parameter.
+	EncryptionContextRepository = "repository"
+)
+
+// WithEncryptionContext binds wrapped keys to an encryption context built from the sources.
+// Providers that support an encryption context pass it to the kms, it is stored in the annotation packet
+// and unwrapping requires the parameters of the request to match it.
+func WithEncryptionContext(sources []string) Option {
+	return func(s *KeyProviderService) error {
+		for _, source := range sources {
+			switch source {
+			case EncryptionContextKeyProvider, EncryptionContextLabel, EncryptionContextRepository:
+			default:
+				return fmt.Errorf("unknown encryption context source %q", source)
+			}
+		}
+		s.encryptionContextSources = sources
+		return nil
+	}
+}
+
+// encryptionContext builds the encryption context of a request from the configured sources.
+func (s *KeyProviderService) encryptionContext(params keyParameters) (kms.EncryptionContext, error) {
+	if len(s.encryptionContextSources) == 0 {
+		return nil, nil
+	}
+	encCtx := kms.EncryptionContext{}
+	for _, source := range s.encryptionContextSources {
+		var value string
+		switch source {
+		case EncryptionContextKeyProvider:
+			value = s.keyProviderName
+		case EncryptionContextLabel:
+			value = params.label
+		case EncryptionContextRepository:
+			value = params.repository
+		}
+		if value == "" {
+			return nil, fmt.Errorf("parameter %s=<value> is required for the encryption context", source)
+		}
+		encCtx[source] = value
+	}
+	return encCtx, nil
+}
+
+// verifyEncryptionContext checks that the encryption context stored with a recipient matches the expected one.
+// Recipients without encryption context were wrapped before it was configured or by a provider without support.
+func verifyEncryptionContext(stored kms.EncryptionContext, expected kms.EncryptionContext) error {
+	if len(stored) == 0 {
+		return nil
+	}
+	for key, value := range expected {
+		storedValue, ok := stored[key]
+		if !ok {
+			return fmt.Errorf("%w, it has no %s", errEncryptionContextMismatch, key)
+		}
+		if storedValue != value {
+			return fmt.Errorf("%w, %s is %q, not %q", errEncryptionContextMismatch, key, storedValue, value)
+		}
+	}
+	return nil
+}
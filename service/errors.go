@@ -0,0 +1,61 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/hown3d/kms-ocicrypt/kms"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errorDomain is the domain of the ErrorInfo details of kms errors.
+const errorDomain = "kms-ocicrypt"
+
+var (
+	// errEncryptionContextMismatch is returned for recipients bound to another encryption context than the one of the request.
+	errEncryptionContextMismatch = errors.New("encryption context does not match")
+	// errUnsupportedAlgorithm is returned for recipients wrapped with an algorithm this release or the provider can't unwrap.
+	errUnsupportedAlgorithm = errors.New("unsupported algorithm")
+	// errProviderNotEnabled is returned for keys of a provider that is not enabled.
+	errProviderNotEnabled = errors.New("not enabled")
+)
+
+// kmsErrorCodes maps kms errors to gRPC codes. When several keys failed with different errors,
+// the first matching one is reported, so errors worth retrying come first.
+var kmsErrorCodes = []struct {
+	err    error
+	code   codes.Code
+	reason string
+}{
+	{err: kms.ErrUnavailable, code: codes.Unavailable, reason: "KMS_UNAVAILABLE"},
+	{err: context.DeadlineExceeded, code: codes.DeadlineExceeded, reason: "KMS_TIMEOUT"},
+	{err: kms.ErrThrottled, code: codes.ResourceExhausted, reason: "KMS_THROTTLED"},
+	{err: kms.ErrPermissionDenied, code: codes.PermissionDenied, reason: "KMS_PERMISSION_DENIED"},
+	{err: kms.ErrKeyDisabled, code: codes.FailedPrecondition, reason: "KMS_KEY_DISABLED"},
+	{err: kms.ErrNotFound, code: codes.NotFound, reason: "KMS_KEY_NOT_FOUND"},
+	{err: kms.ErrInvalidCiphertext, code: codes.InvalidArgument, reason: "KMS_INVALID_CIPHERTEXT"},
+	{err: errEncryptionContextMismatch, code: codes.InvalidArgument, reason: "ENCRYPTION_CONTEXT_MISMATCH"},
+	{err: errUnsupportedAlgorithm, code: codes.FailedPrecondition, reason: "UNSUPPORTED_ALGORITHM"},
+	{err: errProviderNotEnabled, code: codes.FailedPrecondition, reason: "KMS_PROVIDER_NOT_ENABLED"},
+	{err: context.Canceled, code: codes.Canceled, reason: "KMS_CANCELED"},
+}
+
+// kmsStatus returns the status of a failed kms operation, with the code derived from the kms error and
+// an ErrorInfo detail naming the reason. Unclassified errors are internal.
+func kmsStatus(err error, operation string) error {
+	st := status.New(codes.Internal, fmt.Sprintf("%s: %s", operation, err))
+	for _, c := range kmsErrorCodes {
+		if !errors.Is(err, c.err) {
+			continue
+		}
+		st = status.New(c.code, fmt.Sprintf("%s: %s", operation, err))
+		if detailed, detailErr := st.WithDetails(&errdetails.ErrorInfo{Reason: c.reason, Domain: errorDomain}); detailErr == nil {
+			st = detailed
+		}
+		break
+	}
+	return st.Err()
+}
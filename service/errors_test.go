@@ -0,0 +1,87 @@
+package service
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/hown3d/kms-ocicrypt/kms"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errorReason returns the reason of the ErrorInfo detail of a status error.
+func errorReason(err error) string {
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			return info.Reason
+		}
+	}
+	return ""
+}
+
+func TestKMSStatus(t *testing.T) {
+	tests := []struct {
+		err    error
+		code   codes.Code
+		reason string
+	}{
+		{err: fmt.Errorf("decrypting: %w", kms.ErrNotFound), code: codes.NotFound, reason: "KMS_KEY_NOT_FOUND"},
+		{err: fmt.Errorf("decrypting: %w", kms.ErrThrottled), code: codes.ResourceExhausted, reason: "KMS_THROTTLED"},
+		{err: fmt.Errorf("recipient file://a: %w", errEncryptionContextMismatch), code: codes.InvalidArgument, reason: "ENCRYPTION_CONTEXT_MISMATCH"},
+		{err: fmt.Errorf("recipient file://a: %w", errUnsupportedAlgorithm), code: codes.FailedPrecondition, reason: "UNSUPPORTED_ALGORITHM"},
+		{err: fmt.Errorf("kms provider aws is %w", errProviderNotEnabled), code: codes.FailedPrecondition, reason: "KMS_PROVIDER_NOT_ENABLED"},
+		// retryable errors are reported first
+		{err: fmt.Errorf("%w, %w", errProviderNotEnabled, kms.ErrUnavailable), code: codes.Unavailable, reason: "KMS_UNAVAILABLE"},
+		{err: fmt.Errorf("unexpected"), code: codes.Internal},
+	}
+	for _, tt := range tests {
+		err := kmsStatus(tt.err, "decrypting key")
+		if status.Code(err) != tt.code || errorReason(err) != tt.reason {
+			t.Fatalf("kmsStatus of %v returned %v with reason %q, want %v with reason %q", tt.err, status.Code(err), errorReason(err), tt.code, tt.reason)
+		}
+	}
+}
+
+func TestUnwrapErrorCodes(t *testing.T) {
+	keyDir := filepath.Join("testdata", "keys")
+	s := newTestService(t, keyDir, WithEncryptionContext([]string{EncryptionContextRepository}))
+	annotation, err := wrap(s, goldenLayerKey, "file://a", "repository=registry.example.com/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsupported, err := encodeAnnotationPacket(annotationPacket{Threshold: 1, Recipients: []recipient{
+		{Provider: "local", Algorithm: "RSAES_PKCS1_V1_5", KeyUrl: "file://a", WrappedKey: []byte("wrapped")},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		annotation []byte
+		params     []string
+		code       codes.Code
+		reason     string
+	}{
+		{name: "encryption context mismatch", annotation: annotation, params: []string{"file://a", "repository=registry.example.com/other"}, code: codes.InvalidArgument, reason: "ENCRYPTION_CONTEXT_MISMATCH"},
+		{name: "unsupported algorithm", annotation: unsupported, params: []string{"file://a", "repository=registry.example.com/app"}, code: codes.FailedPrecondition, reason: "UNSUPPORTED_ALGORITHM"},
+		{name: "provider not enabled", annotation: annotation, params: []string{"awskms://alias/layers", "repository=registry.example.com/app"}, code: codes.FailedPrecondition, reason: "KMS_PROVIDER_NOT_ENABLED"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := unwrap(s, tt.annotation, tt.params...)
+			if status.Code(err) != tt.code || errorReason(err) != tt.reason {
+				t.Fatalf("UnWrapKey returned %v with reason %q, want %v with reason %q", err, errorReason(err), tt.code, tt.reason)
+			}
+		})
+	}
+
+	t.Run("wrap with provider not enabled", func(t *testing.T) {
+		_, err := wrap(s, goldenLayerKey, "awskms://alias/layers", "repository=registry.example.com/app")
+		if status.Code(err) != codes.FailedPrecondition || errorReason(err) != "KMS_PROVIDER_NOT_ENABLED" {
+			t.Fatalf("WrapKey returned %v with reason %q, want %v", err, errorReason(err), codes.FailedPrecondition)
+		}
+	})
+}
@@ -0,0 +1,100 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"sync"
+)
+
+// unwrapGroup deduplicates concurrent unwraps of the same request, so only one of them calls the kms.
+type unwrapGroup struct {
+	mu    sync.Mutex
+	calls map[[sha256.Size]byte]*unwrapCall
+}
+
+// unwrapCall is an unwrap in flight, shared by all callers waiting for it.
+type unwrapCall struct {
+	done    chan struct{}
+	key     []byte
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+func newUnwrapGroup() *unwrapGroup {
+	return &unwrapGroup{calls: map[[sha256.Size]byte]*unwrapCall{}}
+}
+
+// do runs fn once for concurrent callers with the same id, every caller receives a copy of the key or the same error.
+// fn runs detached from the cancellation of the caller who started it, a caller giving up returns its context error
+// without affecting the others. fn keeps the deadline of that caller and is canceled when all callers gave up.
+func (g *unwrapGroup) do(ctx context.Context, id [sha256.Size]byte, fn func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	g.mu.Lock()
+	c, ok := g.calls[id]
+	if !ok {
+		callCtx, cancel := detach(ctx)
+		c = &unwrapCall{done: make(chan struct{}), cancel: cancel}
+		g.calls[id] = c
+		go g.run(callCtx, id, c, fn)
+	}
+	c.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	c.waiters--
+	select {
+	case <-c.done:
+	default:
+		if c.waiters == 0 {
+			// nobody waits anymore, later callers start a new unwrap instead of joining the canceled one
+			c.cancel()
+			delete(g.calls, id)
+		}
+		return nil, ctx.Err()
+	}
+
+	var key []byte
+	if c.err == nil {
+		key = bytes.Clone(c.key)
+	}
+	if c.waiters == 0 {
+		c.release()
+	}
+	return key, c.err
+}
+
+// detach returns a context with the values and the deadline of ctx, which isn't canceled with ctx.
+func detach(ctx context.Context) (context.Context, context.CancelFunc) {
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(context.WithoutCancel(ctx), deadline)
+	}
+	return context.WithCancel(context.WithoutCancel(ctx))
+}
+
+func (g *unwrapGroup) run(ctx context.Context, id [sha256.Size]byte, c *unwrapCall, fn func(ctx context.Context) ([]byte, error)) {
+	key, err := fn(ctx)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	c.key, c.err = key, err
+	if g.calls[id] == c {
+		delete(g.calls, id)
+	}
+	if c.waiters == 0 {
+		c.release()
+	}
+	close(c.done)
+}
+
+// release zeroes the shared key once every waiter copied it, g.mu must be held.
+func (c *unwrapCall) release() {
+	clear(c.key)
+	c.cancel()
+}
@@ -0,0 +1,99 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestUnwrapGroupKeepsDeadline(t *testing.T) {
+	g := newUnwrapGroup()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	want, _ := ctx.Deadline()
+
+	_, err := g.do(ctx, sha256.Sum256([]byte("id")), func(ctx context.Context) ([]byte, error) {
+		if got, ok := ctx.Deadline(); !ok || !got.Equal(want) {
+			t.Errorf("unwrap has deadline %v, want %v", got, want)
+		}
+		return []byte("layer key"), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnwrapGroupShared(t *testing.T) {
+	g := newUnwrapGroup()
+	id := sha256.Sum256([]byte("id"))
+	started := make(chan struct{})
+	release := make(chan struct{})
+	calls := 0
+	fn := func(ctx context.Context) ([]byte, error) {
+		calls++
+		close(started)
+		select {
+		case <-release:
+			return []byte("layer key"), nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	// the caller starting the unwrap gives up, the one joining it gets the key
+	first, cancelFirst := context.WithCancel(context.Background())
+	firstErr := make(chan error)
+	go func() {
+		_, err := g.do(first, id, fn)
+		firstErr <- err
+	}()
+	<-started
+	second := make(chan []byte)
+	go func() {
+		key, _ := g.do(context.Background(), id, fn)
+		second <- key
+	}()
+	for {
+		g.mu.Lock()
+		waiters := g.calls[id].waiters
+		g.mu.Unlock()
+		if waiters == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancelFirst()
+	if err := <-firstErr; !errors.Is(err, context.Canceled) {
+		t.Fatalf("first caller returned %v, want %v", err, context.Canceled)
+	}
+	close(release)
+	if key := <-second; !bytes.Equal(key, []byte("layer key")) {
+		t.Fatalf("second caller returned %q, want the layer key", key)
+	}
+	if calls != 1 {
+		t.Fatalf("unwrap ran %d times, want 1", calls)
+	}
+}
+
+func TestUnwrapGroupCanceled(t *testing.T) {
+	g := newUnwrapGroup()
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error)
+	go g.do(ctx, sha256.Sum256([]byte("id")), func(ctx context.Context) ([]byte, error) {
+		cancel()
+		<-ctx.Done()
+		canceled <- ctx.Err()
+		return nil, ctx.Err()
+	})
+	select {
+	case err := <-canceled:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("unwrap was canceled with %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("unwrap was not canceled after all callers gave up")
+	}
+}
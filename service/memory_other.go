@@ -0,0 +1,22 @@
+//go:build !unix
+
+package service
+
+// lockedBuffer is heap memory on platforms without mlock.
+type lockedBuffer struct {
+	mem []byte
+}
+
+func newLockedBuffer(length int) (*lockedBuffer, error) {
+	return &lockedBuffer{mem: make([]byte, length)}, nil
+}
+
+func (b *lockedBuffer) bytes() []byte {
+	return b.mem
+}
+
+// destroy zeroes the memory.
+func (b *lockedBuffer) destroy() {
+	clear(b.mem)
+	b.mem = nil
+}
@@ -0,0 +1,44 @@
+//go:build unix
+
+package service
+
+import (
+	"log/slog"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+var mlockWarning sync.Once
+
+// lockedBuffer is memory outside of the go heap, which is locked so it is never swapped to disk.
+type lockedBuffer struct {
+	mem    []byte
+	length int
+}
+
+func newLockedBuffer(length int) (*lockedBuffer, error) {
+	// mmap needs a non-zero length, the mapping is rounded up to whole pages
+	mem, err := unix.Mmap(-1, 0, max(length, 1), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Mlock(mem); err != nil {
+		mlockWarning.Do(func() {
+			slog.Warn("cannot lock cached keys in memory, they may be swapped to disk. Raise RLIMIT_MEMLOCK or grant CAP_IPC_LOCK", "error", err)
+		})
+	}
+	return &lockedBuffer{mem: mem, length: length}, nil
+}
+
+func (b *lockedBuffer) bytes() []byte {
+	return b.mem[:b.length]
+}
+
+// destroy zeroes and unmaps the memory.
+func (b *lockedBuffer) destroy() {
+	clear(b.mem)
+	_ = unix.Munlock(b.mem)
+	_ = unix.Munmap(b.mem)
+	b.mem = nil
+}
@@ -0,0 +1,124 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/hown3d/kms-ocicrypt/kms"
+)
+
+// annotationPacketVersion is the version of the annotation packets written by WrapKey.
+//
+// Every version ever written must stay decodable, so images encrypted by older releases can still be decrypted:
+//   - 0: unversioned {key_url, wrapped_key} with a single key
+//   - 1: list of recipients, each wrapping the layer key
+//   - 2: like 1 plus a threshold, the recipients wrap Shamir shares of the layer key
+//   - 3: self-describing recipients with provider, algorithm, optional encryption context and metadata
+const annotationPacketVersion = 3
+
+// Annotation packet, which goes into container image manifest
+type annotationPacket struct {
+	Version int `json:"version"`
+	// Threshold is the number of recipients needed to unwrap the layer key.
+	// With a threshold of two or more, the recipients wrap Shamir shares of the layer key.
+	Threshold  int               `json:"threshold"`
+	Recipients []recipient       `json:"recipients"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+}
+
+// recipient is the layer key, or a share of it, wrapped with one kms key.
+type recipient struct {
+	// Provider is the name of the kms provider of the key.
+	Provider string `json:"provider"`
+	// Algorithm identifies how the key was wrapped.
+	Algorithm  string `json:"algorithm"`
+	KeyUrl     string `json:"key_url"`
+	WrappedKey []byte `json:"wrapped_key"`
+	// EncryptionContext is the non-secret encryption context the wrapped key is bound to.
+	EncryptionContext kms.EncryptionContext `json:"encryption_context,omitempty"`
+	Metadata          map[string]string     `json:"metadata,omitempty"`
+}
+
+// shamirSplit reports whether the recipients hold shares of the layer key.
+func (p annotationPacket) shamirSplit() bool {
+	return p.Threshold > 1
+}
+
+func encodeAnnotationPacket(p annotationPacket) ([]byte, error) {
+	p.Version = annotationPacketVersion
+	return json.Marshal(p)
+}
+
+// decodeAnnotationPacket decodes an annotation packet of any version into the current format.
+func decodeAnnotationPacket(data []byte) (annotationPacket, error) {
+	var header struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return annotationPacket{}, err
+	}
+
+	var packet annotationPacket
+	switch header.Version {
+	case 0:
+		var legacy struct {
+			KeyUrl     string `json:"key_url"`
+			WrappedKey []byte `json:"wrapped_key"`
+		}
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return annotationPacket{}, err
+		}
+		packet = annotationPacket{
+			Threshold:  1,
+			Recipients: []recipient{legacyRecipient(legacy.KeyUrl, legacy.WrappedKey)},
+		}
+	case 1, 2:
+		var legacy struct {
+			Threshold  int `json:"threshold"`
+			Recipients []struct {
+				KeyUrl     string `json:"key_url"`
+				WrappedKey []byte `json:"wrapped_key"`
+			} `json:"recipients"`
+		}
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return annotationPacket{}, err
+		}
+		packet.Threshold = 1
+		if header.Version == 2 {
+			packet.Threshold = legacy.Threshold
+		}
+		for _, r := range legacy.Recipients {
+			packet.Recipients = append(packet.Recipients, legacyRecipient(r.KeyUrl, r.WrappedKey))
+		}
+	case annotationPacketVersion:
+		if err := json.Unmarshal(data, &packet); err != nil {
+			return annotationPacket{}, err
+		}
+	default:
+		return annotationPacket{}, fmt.Errorf("unsupported annotation packet version %d, the key was wrapped by a newer release", header.Version)
+	}
+	packet.Version = header.Version
+
+	if len(packet.Recipients) == 0 {
+		return annotationPacket{}, errors.New("annotation packet has no recipients")
+	}
+	if packet.Threshold < 1 || packet.Threshold > len(packet.Recipients) {
+		return annotationPacket{}, fmt.Errorf("invalid threshold %d for %d recipients", packet.Threshold, len(packet.Recipients))
+	}
+	return packet, nil
+}
+
+// legacyRecipient converts a recipient of a packet without provider and algorithm.
+// Keys of version 0 packets may lack a key url scheme, their provider is left empty and resolved to the default provider.
+func legacyRecipient(keyUrl string, wrappedKey []byte) recipient {
+	r := recipient{
+		Algorithm:  kms.AlgorithmDefault,
+		KeyUrl:     keyUrl,
+		WrappedKey: wrappedKey,
+	}
+	if url, ok, err := kms.ParseKeyURL(keyUrl); ok && err == nil {
+		r.Provider = url.Provider
+	}
+	return r
+}
@@ -0,0 +1,134 @@
+package service
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// goldenLayerKey is the layer key wrapped in the golden packets of testdata, with the keys of testdata/keys.
+var goldenLayerKey = []byte("0123456789abcdef0123456789abcdef")
+
+// The golden packets are in the format of every packet version ever written and must stay decodable.
+// They are never regenerated.
+var goldenPackets = []struct {
+	file      string
+	version   int
+	threshold int
+	keys      []string
+}{
+	// version 0 stored the bare key of the default provider
+	{file: "packet-v0.json", version: 0, threshold: 1, keys: []string{"layers"}},
+	{file: "packet-v1.json", version: 1, threshold: 1, keys: []string{"file://b"}},
+	{file: "packet-v2.json", version: 2, threshold: 2, keys: []string{"file://a", "file://c"}},
+	{file: "packet-v3.json", version: 3, threshold: 2, keys: []string{"file://b", "file://c"}},
+}
+
+func TestGoldenPackets(t *testing.T) {
+	// packets written before the encryption context was configured unwrap with it as well
+	s := newTestService(t, filepath.Join("testdata", "keys"), WithEncryptionContext([]string{EncryptionContextRepository}))
+
+	for _, tt := range goldenPackets {
+		params := append([]string{"repository=registry.example.com/app"}, tt.keys...)
+		t.Run(tt.file, func(t *testing.T) {
+			annotation, err := os.ReadFile(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			packet, err := decodeAnnotationPacket(annotation)
+			if err != nil {
+				t.Fatalf("decodeAnnotationPacket: %v", err)
+			}
+			if packet.Version != tt.version || packet.Threshold != tt.threshold {
+				t.Fatalf("decoded version %d with threshold %d, want version %d with threshold %d", packet.Version, packet.Threshold, tt.version, tt.threshold)
+			}
+
+			got, err := unwrap(s, annotation, params...)
+			if err != nil {
+				t.Fatalf("UnWrapKey: %v", err)
+			}
+			if !bytes.Equal(got, goldenLayerKey) {
+				t.Fatalf("UnWrapKey returned %q, want %q", got, goldenLayerKey)
+			}
+
+			// re-encoding upgrades the packet to the current version without changing the recipients
+			encoded, err := encodeAnnotationPacket(packet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reencoded, err := decodeAnnotationPacket(encoded)
+			if err != nil {
+				t.Fatalf("decodeAnnotationPacket of the re-encoded packet: %v", err)
+			}
+			if reencoded.Version != annotationPacketVersion {
+				t.Fatalf("re-encoded packet has version %d, want %d", reencoded.Version, annotationPacketVersion)
+			}
+			reencoded.Version = packet.Version
+			if !reflect.DeepEqual(reencoded, packet) {
+				t.Fatalf("re-encoded packet decoded to %+v, want %+v", reencoded, packet)
+			}
+			got, err = unwrap(s, encoded, params...)
+			if err != nil {
+				t.Fatalf("UnWrapKey of the re-encoded packet: %v", err)
+			}
+			if !bytes.Equal(got, goldenLayerKey) {
+				t.Fatalf("UnWrapKey of the re-encoded packet returned %q, want %q", got, goldenLayerKey)
+			}
+		})
+	}
+}
+
+func TestWrappedPacketRoundTrip(t *testing.T) {
+	s := newTestService(t, filepath.Join("testdata", "keys"), WithEncryptionContext([]string{EncryptionContextRepository}))
+
+	annotation, err := wrap(s, goldenLayerKey, "threshold=2", "file://a", "file://b", "layers", "repository=registry.example.com/app")
+	if err != nil {
+		t.Fatalf("WrapKey: %v", err)
+	}
+	packet, err := decodeAnnotationPacket(annotation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packet.Version != annotationPacketVersion {
+		t.Fatalf("wrapped packet has version %d, want %d", packet.Version, annotationPacketVersion)
+	}
+	for _, r := range packet.Recipients {
+		if r.Provider != "local" || r.EncryptionContext[EncryptionContextRepository] != "registry.example.com/app" {
+			t.Fatalf("recipient %s has provider %q and encryption context %v", r.KeyUrl, r.Provider, r.EncryptionContext)
+		}
+	}
+	encoded, err := encodeAnnotationPacket(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(encoded, annotation) {
+		t.Fatalf("re-encoded packet is\n%s\nwant\n%s", encoded, annotation)
+	}
+
+	// a different repository does not match the encryption context of the recipients
+	if _, err := unwrap(s, annotation, "file://a", "layers", "repository=registry.example.com/other"); err == nil {
+		t.Fatal("UnWrapKey with another repository succeeded")
+	}
+}
+
+func TestDecodeAnnotationPacketInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet string
+	}{
+		{name: "not json", packet: "layers"},
+		{name: "newer version", packet: `{"version":4,"threshold":1,"recipients":[{"key_url":"file://a"}]}`},
+		{name: "no recipients", packet: `{"version":3,"threshold":1,"recipients":[]}`},
+		{name: "threshold above recipients", packet: `{"version":2,"threshold":3,"recipients":[{"key_url":"file://a"},{"key_url":"file://b"}]}`},
+		{name: "threshold zero", packet: `{"version":3,"threshold":0,"recipients":[{"key_url":"file://a"}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeAnnotationPacket([]byte(tt.packet)); err == nil {
+				t.Fatal("decodeAnnotationPacket succeeded")
+			}
+		})
+	}
+}
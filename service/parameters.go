@@ -0,0 +1,107 @@
+package service
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hown3d/kms-ocicrypt/kms"
+)
+
+// Parameters given as <name>=<value> next to the keys.
+const (
+	// thresholdParameter switches WrapKey to threshold mode: with threshold=<m> and n keys, the layer key
+	// is split into n shares, each wrapped with one key, and any m of them are needed to unwrap it.
+	thresholdParameter = "threshold"
+	// labelParameter is a user supplied label for the encryption context.
+	labelParameter = "label"
+	// repositoryParameter is the repository name for the encryption context.
+	repositoryParameter = "repository"
+	// algorithmParameter selects how the keys wrap, e.g. algorithm=RSAES_OAEP_SHA_256 wraps offline with the public keys.
+	algorithmParameter = "algorithm"
+	// publicKeyParameter supplies the PEM encoded public key of a single asymmetric key, optionally base64 encoded.
+	publicKeyParameter = "public-key"
+)
+
+// keyParameters are the parameters passed to the keyprovider, split into kms keys and options.
+type keyParameters struct {
+	kmsKeys    []string
+	threshold  int
+	label      string
+	repository string
+	algorithm  string
+	publicKey  []byte
+}
+
+func parseKeyParameters(params []string) (keyParameters, error) {
+	var p keyParameters
+	seen := map[string]bool{}
+	for _, param := range params {
+		name, value, ok := strings.Cut(param, "=")
+		switch {
+		case !ok:
+		case name == thresholdParameter, name == labelParameter, name == repositoryParameter,
+			name == algorithmParameter, name == publicKeyParameter:
+			if seen[name] {
+				return keyParameters{}, fmt.Errorf("parameter %s is set more than once", name)
+			}
+			seen[name] = true
+		default:
+			ok = false
+		}
+		if !ok {
+			p.kmsKeys = append(p.kmsKeys, param)
+			continue
+		}
+
+		switch name {
+		case thresholdParameter:
+			threshold, err := strconv.Atoi(value)
+			if err != nil || threshold < 1 {
+				return keyParameters{}, fmt.Errorf("invalid threshold %q", value)
+			}
+			p.threshold = threshold
+		case labelParameter:
+			p.label = value
+		case repositoryParameter:
+			p.repository = value
+		case algorithmParameter:
+			p.algorithm = value
+		case publicKeyParameter:
+			p.publicKey = []byte(value)
+		}
+	}
+	if len(p.kmsKeys) == 0 {
+		return keyParameters{}, fmt.Errorf("missing key")
+	}
+	if p.publicKey != nil {
+		if len(p.kmsKeys) != 1 {
+			return keyParameters{}, fmt.Errorf("parameter %s needs exactly one key, got %d", publicKeyParameter, len(p.kmsKeys))
+		}
+		if p.algorithm == "" {
+			p.algorithm = kms.AlgorithmRSAOAEPSHA256
+		}
+	}
+	switch p.algorithm {
+	case "":
+		p.algorithm = kms.AlgorithmDefault
+	case kms.AlgorithmDefault, kms.AlgorithmRSAOAEPSHA256:
+	default:
+		return keyParameters{}, fmt.Errorf("unsupported algorithm %q", p.algorithm)
+	}
+	if p.publicKey != nil && p.algorithm == kms.AlgorithmDefault {
+		return keyParameters{}, fmt.Errorf("parameter %s needs an asymmetric algorithm", publicKeyParameter)
+	}
+	return p, nil
+}
+
+// checkThreshold returns an error if the threshold can't be reached with the keys.
+func (p keyParameters) checkThreshold() error {
+	if p.threshold == 0 {
+		return nil
+	}
+	if p.threshold < 2 || p.threshold > len(p.kmsKeys) {
+		return fmt.Errorf("threshold %d needs at least %d keys and must be at least 2, got %d keys", p.threshold, p.threshold, len(p.kmsKeys))
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hown3d/kms-ocicrypt/kms"
+)
+
+func TestParseKeyParameters(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  []string
+		want    keyParameters
+		wantErr bool
+	}{
+		{
+			name:   "single key",
+			params: []string{"awskms://alias/layers"},
+			want:   keyParameters{kmsKeys: []string{"awskms://alias/layers"}, algorithm: kms.AlgorithmDefault},
+		},
+		{
+			name:   "threshold",
+			params: []string{"threshold=2", "file://a", "file://b", "file://c"},
+			want:   keyParameters{kmsKeys: []string{"file://a", "file://b", "file://c"}, threshold: 2, algorithm: kms.AlgorithmDefault},
+		},
+		{
+			name:   "encryption context",
+			params: []string{"file://a", "label=prod", "repository=registry.example.com/app"},
+			want:   keyParameters{kmsKeys: []string{"file://a"}, label: "prod", repository: "registry.example.com/app", algorithm: kms.AlgorithmDefault},
+		},
+		{
+			name:   "keys containing =",
+			params: []string{"pkcs11:token=kms;object=layers?pin-value=1234"},
+			want:   keyParameters{kmsKeys: []string{"pkcs11:token=kms;object=layers?pin-value=1234"}, algorithm: kms.AlgorithmDefault},
+		},
+		{
+			name:   "asymmetric algorithm",
+			params: []string{"algorithm=RSAES_OAEP_SHA_256", "file://a"},
+			want:   keyParameters{kmsKeys: []string{"file://a"}, algorithm: kms.AlgorithmRSAOAEPSHA256},
+		},
+		{
+			name:   "public key implies asymmetric algorithm",
+			params: []string{"file://a", "public-key=PEM"},
+			want:   keyParameters{kmsKeys: []string{"file://a"}, algorithm: kms.AlgorithmRSAOAEPSHA256, publicKey: []byte("PEM")},
+		},
+		{name: "no key", params: []string{"threshold=2"}, wantErr: true},
+		{name: "invalid threshold", params: []string{"threshold=two", "file://a"}, wantErr: true},
+		{name: "threshold below one", params: []string{"threshold=0", "file://a"}, wantErr: true},
+		{name: "repeated parameter", params: []string{"label=a", "label=b", "file://a"}, wantErr: true},
+		{name: "unsupported algorithm", params: []string{"algorithm=RSAES_PKCS1_V1_5", "file://a"}, wantErr: true},
+		{name: "public key with default algorithm", params: []string{"algorithm=default", "public-key=PEM", "file://a"}, wantErr: true},
+		{name: "public key with several keys", params: []string{"public-key=PEM", "file://a", "file://b"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseKeyParameters(tt.params)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseKeyParameters returned %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseKeyParameters: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("parseKeyParameters returned %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckThreshold(t *testing.T) {
+	tests := []struct {
+		threshold int
+		keys      int
+		wantErr   bool
+	}{
+		{threshold: 0, keys: 1},
+		{threshold: 2, keys: 2},
+		{threshold: 2, keys: 3},
+		{threshold: 1, keys: 2, wantErr: true},
+		{threshold: 3, keys: 2, wantErr: true},
+	}
+	for _, tt := range tests {
+		p := keyParameters{threshold: tt.threshold, kmsKeys: make([]string, tt.keys)}
+		if err := p.checkThreshold(); (err != nil) != tt.wantErr {
+			t.Fatalf("checkThreshold of %d with %d keys returned %v, want error %v", tt.threshold, tt.keys, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package service
+
+import "github.com/containers/ocicrypt/config"
+
+// The JSON messages of the keyprovider protocol, as defined by github.com/containers/ocicrypt/keywrap/keyprovider.
+// They are declared here, since that package links the generated keyprovider protobuf package of ocicrypt,
+// which registers the same proto file as gen/go/utils/keyprovider and panics on the conflict.
+
+type keyWrapProtocolOperation string
+
+const (
+	opKeyWrap   keyWrapProtocolOperation = "keywrap"
+	opKeyUnwrap keyWrapProtocolOperation = "keyunwrap"
+)
+
+// keyWrapProtocolInput is the input of the WrapKey and UnWrapKey methods.
+type keyWrapProtocolInput struct {
+	Operation       keyWrapProtocolOperation `json:"op"`
+	KeyWrapParams   keyWrapParams            `json:"keywrapparams,omitempty"`
+	KeyUnwrapParams keyUnwrapParams          `json:"keyunwrapparams,omitempty"`
+}
+
+// keyWrapProtocolOutput is the output of the WrapKey and UnWrapKey methods.
+type keyWrapProtocolOutput struct {
+	KeyWrapResults   keyWrapResults   `json:"keywrapresults,omitempty"`
+	KeyUnwrapResults keyUnwrapResults `json:"keyunwrapresults,omitempty"`
+}
+
+type keyWrapParams struct {
+	Ec       *config.EncryptConfig `json:"ec"`
+	OptsData []byte                `json:"optsdata"`
+}
+
+type keyUnwrapParams struct {
+	Dc         *config.DecryptConfig `json:"dc"`
+	Annotation []byte                `json:"annotation"`
+}
+
+type keyUnwrapResults struct {
+	OptsData []byte `json:"optsdata"`
+}
+
+type keyWrapResults struct {
+	Annotation []byte `json:"annotation"`
+}
@@ -1,33 +1,58 @@
 package service
 
 import (
+	"bytes"
 	"context"
+	"crypto"
+	"crypto/rand"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log/slog"
+	"sort"
 
-	"github.com/containers/ocicrypt/keywrap/keyprovider"
+	"github.com/hown3d/kms-ocicrypt/audit"
 	keyproviderpb "github.com/hown3d/kms-ocicrypt/gen/go/utils/keyprovider"
 	"github.com/hown3d/kms-ocicrypt/kms"
+	"github.com/hown3d/kms-ocicrypt/shamir"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
-// Mock annotation packet, which goes into container image manifest
-type annotationPacket struct {
-	KeyUrl     string `json:"key_url"`
-	WrappedKey []byte `json:"wrapped_key"`
-}
-
 type KeyProviderService struct {
-	kmsProvider     kms.Provider
-	keyProviderName string
+	kmsProviders             map[string]kms.Provider
+	defaultProvider          string
+	keyProviderName          string
+	encryptionContextSources []string
+	cache                    *keyCache
+	inflight                 *unwrapGroup
+	auditLog                 *audit.Logger
 }
 
-func NewKeyProviderService(kmsProvider kms.Provider, keyproviderName string) *KeyProviderService {
-	return &KeyProviderService{
-		kmsProvider:     kmsProvider,
+// Option configures optional behaviour of the KeyProviderService.
+type Option func(s *KeyProviderService) error
+
+// NewKeyProviderService creates the service with the enabled kms providers by name.
+// Keys without a key url scheme are passed to the default provider.
+func NewKeyProviderService(kmsProviders map[string]kms.Provider, defaultProvider string, keyproviderName string, opts ...Option) (*KeyProviderService, error) {
+	s := &KeyProviderService{
+		kmsProviders:    kmsProviders,
+		defaultProvider: defaultProvider,
 		keyProviderName: keyproviderName,
+		inflight:        newUnwrapGroup(),
+	}
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Close releases the resources of the service and zeroes cached keys.
+func (s *KeyProviderService) Close() {
+	if s.cache != nil {
+		s.cache.close()
 	}
 }
 
@@ -36,38 +61,53 @@ var _ keyproviderpb.KeyProviderServiceServer = (*KeyProviderService)(nil)
 
 // UnWrapKey implements keyprovider.KeyProviderServiceServer.
 func (s *KeyProviderService) UnWrapKey(ctx context.Context, input *keyproviderpb.KeyProviderKeyWrapProtocolInput) (*keyproviderpb.KeyProviderKeyWrapProtocolOutput, error) {
-	var protoInput keyprovider.KeyProviderKeyWrapProtocolInput
+	return s.audited(ctx, audit.OperationUnwrap, func(event *audit.Event) (*keyproviderpb.KeyProviderKeyWrapProtocolOutput, error) {
+		return s.unwrapKey(ctx, input, event)
+	})
+}
+
+func (s *KeyProviderService) unwrapKey(ctx context.Context, input *keyproviderpb.KeyProviderKeyWrapProtocolInput, event *audit.Event) (*keyproviderpb.KeyProviderKeyWrapProtocolOutput, error) {
+	var protoInput keyWrapProtocolInput
 	err := json.Unmarshal(input.KeyProviderKeyWrapProtocolInput, &protoInput)
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, "invalid protocol input")
 	}
 
-	if protoInput.Operation != keyprovider.OpKeyUnwrap {
+	if protoInput.Operation != opKeyUnwrap {
 		return nil, status.Error(codes.InvalidArgument, "wrong operation")
 	}
 
-	decryptionParams := protoInput.KeyUnwrapParams.Dc.Parameters
-	if decryptionParams == nil {
+	if protoInput.KeyUnwrapParams.Dc == nil || protoInput.KeyUnwrapParams.Dc.Parameters == nil {
 		return nil, status.Error(codes.InvalidArgument, "missing decryption parameters")
 	}
 
-	var packet annotationPacket
-	err = json.Unmarshal(protoInput.KeyUnwrapParams.Annotation, &packet)
+	event.WrappedKeyFingerprint = audit.Fingerprint(protoInput.KeyUnwrapParams.Annotation)
+	packet, err := decodeAnnotationPacket(protoInput.KeyUnwrapParams.Annotation)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "unmarshal annotationPacket: %v", err)
+		return nil, status.Errorf(codes.InvalidArgument, "decode annotationPacket: %v", err)
+	}
+	params, err := s.getKeyParameters(protoInput.KeyUnwrapParams.Dc.Parameters)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
-	kmsKey, err := s.getKmsKey(decryptionParams)
+	event.Keys = s.auditKeys(params.kmsKeys)
+	encCtx, err := s.encryptionContext(params)
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
-	decryptedKey, err := s.kmsProvider.Decrypt(ctx, packet.WrappedKey, kmsKey)
+	decryptedKey, err := s.sharedUnwrap(ctx, packet, params.kmsKeys, encCtx)
+	// the key may be unwrapped although the caller gave up meanwhile
+	defer clear(decryptedKey)
+	if ctx.Err() != nil {
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "decrypting key: %s", err)
+		return nil, kmsStatus(err, "decrypting key")
 	}
 
-	protoOutput := &keyprovider.KeyProviderKeyWrapProtocolOutput{
-		KeyUnwrapResults: keyprovider.KeyUnwrapResults{OptsData: decryptedKey},
+	protoOutput := &keyWrapProtocolOutput{
+		KeyUnwrapResults: keyUnwrapResults{OptsData: decryptedKey},
 	}
 	serialized, err := json.Marshal(protoOutput)
 	if err != nil {
@@ -81,42 +121,72 @@ func (s *KeyProviderService) UnWrapKey(ctx context.Context, input *keyproviderpb
 
 // WrapKey implements keyprovider.KeyProviderServiceServer.
 func (s *KeyProviderService) WrapKey(ctx context.Context, input *keyproviderpb.KeyProviderKeyWrapProtocolInput) (*keyproviderpb.KeyProviderKeyWrapProtocolOutput, error) {
-	var protoInput keyprovider.KeyProviderKeyWrapProtocolInput
+	return s.audited(ctx, audit.OperationWrap, func(event *audit.Event) (*keyproviderpb.KeyProviderKeyWrapProtocolOutput, error) {
+		return s.wrapKey(ctx, input, event)
+	})
+}
+
+func (s *KeyProviderService) wrapKey(ctx context.Context, input *keyproviderpb.KeyProviderKeyWrapProtocolInput, event *audit.Event) (*keyproviderpb.KeyProviderKeyWrapProtocolOutput, error) {
+	var protoInput keyWrapProtocolInput
 	err := json.Unmarshal(input.KeyProviderKeyWrapProtocolInput, &protoInput)
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, "invalid protocol input")
 	}
 
-	if protoInput.Operation != keyprovider.OpKeyWrap {
+	if protoInput.Operation != opKeyWrap {
 		return nil, status.Error(codes.InvalidArgument, "wrong operation")
 	}
 
-	encryptionParams := protoInput.KeyWrapParams.Ec.Parameters
-	if encryptionParams == nil {
+	if protoInput.KeyWrapParams.Ec == nil || protoInput.KeyWrapParams.Ec.Parameters == nil {
 		return nil, status.Error(codes.InvalidArgument, "missing encryption parameters")
 	}
 
-	kmsKey, err := s.getKmsKey(encryptionParams)
+	params, err := s.getKeyParameters(protoInput.KeyWrapParams.Ec.Parameters)
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
-
-	cipherText, err := s.kmsProvider.Encrypt(ctx, protoInput.KeyWrapParams.OptsData, kmsKey)
+	event.Keys = s.auditKeys(params.kmsKeys)
+	if err := params.checkThreshold(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	encCtx, err := s.encryptionContext(params)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	kmsKeys, threshold := params.kmsKeys, params.threshold
+
+	packet := annotationPacket{Threshold: 1}
+	secrets := make([][]byte, len(kmsKeys))
+	for i := range secrets {
+		secrets[i] = protoInput.KeyWrapParams.OptsData
+	}
+	if threshold > 0 {
+		if err := s.checkDistinctKeys(kmsKeys); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		secrets, err = shamir.Split(protoInput.KeyWrapParams.OptsData, len(kmsKeys), threshold)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		defer clearAll(secrets)
+		packet.Threshold = threshold
 	}
 
-	packet := annotationPacket{
-		KeyUrl:     kmsKey,
-		WrappedKey: cipherText,
+	for i, kmsKey := range kmsKeys {
+		r, err := s.wrapRecipient(ctx, kmsKey, params, secrets[i], encCtx)
+		if err != nil {
+			return nil, err
+		}
+		packet.Recipients = append(packet.Recipients, r)
 	}
-	packetJson, err := json.Marshal(packet)
+	packetJson, err := encodeAnnotationPacket(packet)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "marshal annotationPacket: %v", err)
 	}
+	event.WrappedKeyFingerprint = audit.Fingerprint(packetJson)
 
-	protoOutput := &keyprovider.KeyProviderKeyWrapProtocolOutput{
-		KeyWrapResults: keyprovider.KeyWrapResults{
+	protoOutput := &keyWrapProtocolOutput{
+		KeyWrapResults: keyWrapResults{
 			Annotation: packetJson,
 		},
 	}
@@ -130,14 +200,303 @@ func (s *KeyProviderService) WrapKey(ctx context.Context, input *keyproviderpb.K
 	}, nil
 }
 
-func (s *KeyProviderService) getKmsKey(params map[string][][]byte) (string, error) {
-	slog.Info("getKmsKey", "request params", params)
+// wrapRecipient wraps a secret with one key using the algorithm of the parameters.
+// Asymmetric algorithms encrypt with the supplied or fetched public key, without calling the kms to encrypt.
+func (s *KeyProviderService) wrapRecipient(ctx context.Context, kmsKey string, params keyParameters, secret []byte, encCtx kms.EncryptionContext) (recipient, error) {
+	keyURL, kmsProvider, err := s.resolveKey(kmsKey)
+	if errors.Is(err, errProviderNotEnabled) {
+		return recipient{}, kmsStatus(err, "resolving key")
+	}
+	if err != nil {
+		return recipient{}, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	var cipherText []byte
+	var recipientCtx kms.EncryptionContext
+	if params.algorithm == kms.AlgorithmDefault {
+		if kmsProvider.SupportsEncryptionContext() {
+			recipientCtx = encCtx
+		} else if len(encCtx) > 0 {
+			slog.Warn("kms provider does not support an encryption context, the wrapped key is not bound to it", "provider", keyURL.Provider)
+		}
+		cipherText, err = kmsProvider.Encrypt(ctx, secret, keyURL.KeyId, recipientCtx)
+		if err != nil {
+			return recipient{}, kmsStatus(err, fmt.Sprintf("encrypting key with %s", keyURL))
+		}
+	} else {
+		asymmetric, ok := kms.Asymmetric(kmsProvider)
+		if !ok {
+			return recipient{}, status.Errorf(codes.InvalidArgument, "kms provider %s has no asymmetric keys for %s", keyURL.Provider, params.algorithm)
+		}
+		var pub crypto.PublicKey
+		if params.publicKey != nil {
+			pub, err = kms.ParsePublicKey(params.publicKey)
+			if err != nil {
+				return recipient{}, status.Error(codes.InvalidArgument, err.Error())
+			}
+		} else {
+			pub, err = asymmetric.PublicKey(ctx, keyURL.KeyId, params.algorithm)
+			if err != nil {
+				return recipient{}, kmsStatus(err, fmt.Sprintf("fetching public key of %s", keyURL))
+			}
+		}
+		// the encryption context is bound by the data key encryption, which needs no kms support
+		recipientCtx = encCtx
+		cipherText, err = kms.WrapWithPublicKey(pub, params.algorithm, secret, recipientCtx)
+		if err != nil {
+			return recipient{}, status.Errorf(codes.InvalidArgument, "encrypting key with public key of %s: %s", keyURL, err)
+		}
+	}
+	return recipient{
+		Provider:          keyURL.Provider,
+		Algorithm:         params.algorithm,
+		KeyUrl:            keyURL.String(),
+		WrappedKey:        cipherText,
+		EncryptionContext: recipientCtx,
+	}, nil
+}
+
+func (s *KeyProviderService) getKeyParameters(params map[string][][]byte) (keyParameters, error) {
 	keys, ok := params[s.keyProviderName]
 	if !ok {
-		return "", errors.New("keyprovider is missing in parameters")
+		return keyParameters{}, errors.New("keyprovider is missing in parameters")
 	}
 	if len(keys) < 1 {
-		return "", errors.New("missing key")
+		return keyParameters{}, errors.New("missing key")
+	}
+	values := make([]string, 0, len(keys))
+	for _, key := range keys {
+		values = append(values, string(key))
+	}
+	return parseKeyParameters(values)
+}
+
+// sharedUnwrap returns the layer key from the key cache, if enabled, or unwraps and caches it.
+// Concurrent requests for the same layer key share one unwrap.
+func (s *KeyProviderService) sharedUnwrap(ctx context.Context, packet annotationPacket, kmsKeys []string, encCtx kms.EncryptionContext) ([]byte, error) {
+	id := unwrapID(packet, kmsKeys, encCtx)
+	if s.cache != nil {
+		if key, ok := s.cache.get(id); ok {
+			slog.Debug("unwrapped key cache hit")
+			return key, nil
+		}
+		slog.Debug("unwrapped key cache miss")
+	}
+	return s.inflight.do(ctx, id, func(ctx context.Context) ([]byte, error) {
+		key, err := s.unwrap(ctx, packet, kmsKeys, encCtx)
+		if err != nil {
+			return nil, err
+		}
+		if s.cache != nil {
+			s.cache.put(id, key)
+		}
+		return key, nil
+	})
+}
+
+// unwrap decrypts the layer key from the first recipient of the packet it can decrypt with the supplied keys.
+// For threshold packets, shares are decrypted until the threshold is reached and combined to the layer key.
+// The threshold is taken from the packet, a threshold parameter supplied for decryption is ignored.
+func (s *KeyProviderService) unwrap(ctx context.Context, packet annotationPacket, kmsKeys []string, encCtx kms.EncryptionContext) ([]byte, error) {
+	if !packet.shamirSplit() {
+		decrypted, err := s.decryptRecipients(ctx, packet.Recipients, kmsKeys, encCtx, 1)
+		if err != nil {
+			return nil, err
+		}
+		return decrypted[0], nil
+	}
+
+	shares, err := s.decryptRecipients(ctx, packet.Recipients, kmsKeys, encCtx, packet.Threshold)
+	if err != nil {
+		return nil, err
+	}
+	defer clearAll(shares)
+	return shamir.Combine(shares)
+}
+
+// decryptRecipients decrypts needed distinct recipients with the supplied keys.
+// Recipients are first tried with the supplied key matching their key url. If that fails,
+// every other combination of supplied key and recipient is tried.
+// Recipients bound to an encryption context not matching the expected one are skipped.
+func (s *KeyProviderService) decryptRecipients(ctx context.Context, recipients []recipient, kmsKeys []string, encCtx kms.EncryptionContext, needed int) ([][]byte, error) {
+	type attempt struct {
+		kmsKey    string
+		recipient int
+	}
+	var matching, others []attempt
+	for i, r := range recipients {
+		// packets written before key urls were introduced contain the bare key of the default provider
+		recipientKey := s.normalizeKey(r.KeyUrl)
+		for _, kmsKey := range kmsKeys {
+			if s.normalizeKey(kmsKey) == recipientKey {
+				matching = append(matching, attempt{kmsKey: kmsKey, recipient: i})
+			} else {
+				others = append(others, attempt{kmsKey: kmsKey, recipient: i})
+			}
+		}
+	}
+
+	var errs []error
+	var decrypted [][]byte
+	done := make(map[int]bool, len(recipients))
+	for _, a := range append(matching, others...) {
+		if done[a.recipient] {
+			continue
+		}
+		r := recipients[a.recipient]
+		if r.Algorithm != kms.AlgorithmDefault && r.Algorithm != kms.AlgorithmRSAOAEPSHA256 {
+			errs = append(errs, fmt.Errorf("recipient %s: %w %q", r.KeyUrl, errUnsupportedAlgorithm, r.Algorithm))
+			done[a.recipient] = true
+			continue
+		}
+		if err := verifyEncryptionContext(r.EncryptionContext, encCtx); err != nil {
+			errs = append(errs, fmt.Errorf("recipient %s: %w", r.KeyUrl, err))
+			done[a.recipient] = true
+			continue
+		}
+		keyURL, kmsProvider, err := s.resolveKey(a.kmsKey)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.normalizeKey(a.kmsKey), err))
+			continue
+		}
+		plain, err := unwrapRecipient(ctx, kmsProvider, r, keyURL.KeyId)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s for recipient %s: %w", keyURL, r.KeyUrl, err))
+			continue
+		}
+		done[a.recipient] = true
+		decrypted = append(decrypted, plain)
+		if len(decrypted) == needed {
+			return decrypted, nil
+		}
+	}
+	clearAll(decrypted)
+	return nil, fmt.Errorf("decrypted %d of %d needed recipients with %d supplied keys: %w", len(decrypted), needed, len(kmsKeys), errors.Join(errs...))
+}
+
+// unwrapRecipient decrypts the wrapped key of a recipient with the algorithm it was wrapped with.
+func unwrapRecipient(ctx context.Context, kmsProvider kms.Provider, r recipient, keyId string) ([]byte, error) {
+	if r.Algorithm == kms.AlgorithmDefault {
+		return kmsProvider.Decrypt(ctx, r.WrappedKey, keyId, r.EncryptionContext)
+	}
+	asymmetric, ok := kms.Asymmetric(kmsProvider)
+	if !ok {
+		return nil, fmt.Errorf("%w %s, kms provider %s has no asymmetric keys", errUnsupportedAlgorithm, r.Algorithm, r.Provider)
+	}
+	return kms.UnwrapAsymmetric(ctx, asymmetric, r.WrappedKey, keyId, r.Algorithm, r.EncryptionContext)
+}
+
+// checkDistinctKeys returns an error if two keys refer to the same key url.
+func (s *KeyProviderService) checkDistinctKeys(kmsKeys []string) error {
+	seen := make(map[string]bool, len(kmsKeys))
+	for _, kmsKey := range kmsKeys {
+		key := s.normalizeKey(kmsKey)
+		if seen[key] {
+			return fmt.Errorf("key %s is used for more than one share", key)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+func clearAll(secrets [][]byte) {
+	for _, secret := range secrets {
+		clear(secret)
+	}
+}
+
+// normalizeKey returns the scheme qualified key url of a key.
+func (s *KeyProviderService) normalizeKey(key string) string {
+	keyURL, err := s.parseKey(key)
+	if err != nil {
+		return key
+	}
+	return keyURL.String()
+}
+
+// resolveKey parses a key url and returns the enabled provider it belongs to.
+func (s *KeyProviderService) resolveKey(key string) (kms.KeyURL, kms.Provider, error) {
+	keyURL, err := s.parseKey(key)
+	if err != nil {
+		return kms.KeyURL{}, nil, err
+	}
+	kmsProvider, ok := s.kmsProviders[keyURL.Provider]
+	if !ok {
+		return kms.KeyURL{}, nil, fmt.Errorf("kms provider %v is %w", keyURL.Provider, errProviderNotEnabled)
+	}
+	return keyURL, kmsProvider, nil
+}
+
+// parseKey parses a key url. Keys without a known scheme belong to the default provider.
+func (s *KeyProviderService) parseKey(key string) (kms.KeyURL, error) {
+	keyURL, ok, err := kms.ParseKeyURL(key)
+	if err != nil {
+		return kms.KeyURL{}, err
+	}
+	if !ok {
+		keyURL = kms.KeyURL{Provider: s.defaultProvider, KeyId: key}
+	}
+	return keyURL, nil
+}
+
+// Providers returns the sorted names of the enabled kms providers.
+func (s *KeyProviderService) Providers() []string {
+	names := make([]string, 0, len(s.kmsProviders))
+	for name := range s.kmsProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CheckKey encrypts and decrypts random data with a key, to check that its kms is reachable and the key is usable.
+// Asymmetric keys, which can't encrypt, are checked by wrapping with their public key and unwrapping.
+// It returns the provider of the key.
+func (s *KeyProviderService) CheckKey(ctx context.Context, key string) (provider string, err error) {
+	keyURL, kmsProvider, err := s.resolveKey(key)
+	if err != nil {
+		return "", err
+	}
+	canary := make([]byte, 32)
+	if _, err := rand.Read(canary); err != nil {
+		return keyURL.Provider, err
+	}
+	cipherText, err := kmsProvider.Encrypt(ctx, canary, keyURL.KeyId, nil)
+	if err != nil {
+		if asymmetric, ok := kms.Asymmetric(kmsProvider); ok && ctx.Err() == nil && !errors.Is(err, kms.ErrUnavailable) && !errors.Is(err, kms.ErrThrottled) {
+			if checked, asymmetricErr := checkAsymmetricKey(ctx, asymmetric, keyURL, canary); checked {
+				return keyURL.Provider, asymmetricErr
+			}
+		}
+		return keyURL.Provider, fmt.Errorf("encrypting with %s: %w", keyURL, err)
+	}
+	plain, err := kmsProvider.Decrypt(ctx, cipherText, keyURL.KeyId, nil)
+	if err != nil {
+		return keyURL.Provider, fmt.Errorf("decrypting with %s: %w", keyURL, err)
+	}
+	if !bytes.Equal(plain, canary) {
+		return keyURL.Provider, fmt.Errorf("decrypting with %s returned different data", keyURL)
+	}
+	return keyURL.Provider, nil
+}
+
+// checkAsymmetricKey wraps the canary with the public key of an asymmetric key and unwraps it with the kms.
+// checked is false if the key has no public key, i.e. it isn't an asymmetric key.
+func checkAsymmetricKey(ctx context.Context, asymmetric kms.AsymmetricProvider, keyURL kms.KeyURL, canary []byte) (checked bool, err error) {
+	pub, err := asymmetric.PublicKey(ctx, keyURL.KeyId, kms.AlgorithmRSAOAEPSHA256)
+	if err != nil {
+		return false, err
+	}
+	cipherText, err := kms.WrapWithPublicKey(pub, kms.AlgorithmRSAOAEPSHA256, canary, nil)
+	if err != nil {
+		return true, fmt.Errorf("wrapping with the public key of %s: %w", keyURL, err)
+	}
+	plain, err := kms.UnwrapAsymmetric(ctx, asymmetric, cipherText, keyURL.KeyId, kms.AlgorithmRSAOAEPSHA256, nil)
+	if err != nil {
+		return true, fmt.Errorf("decrypting with %s: %w", keyURL, err)
+	}
+	if !bytes.Equal(plain, canary) {
+		return true, fmt.Errorf("decrypting with %s returned different data", keyURL)
 	}
-	return string(keys[0]), nil
+	return true, nil
 }
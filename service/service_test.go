@@ -0,0 +1,384 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containers/ocicrypt/config"
+	keyproviderpb "github.com/hown3d/kms-ocicrypt/gen/go/utils/keyprovider"
+	"github.com/hown3d/kms-ocicrypt/kms"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const testKeyProviderName = "kms"
+
+// newTestService creates a service with the local provider as default provider, reading keys from keyDir.
+func newTestService(t *testing.T, keyDir string, opts ...Option) *KeyProviderService {
+	t.Setenv("LOCAL_KMS_KEY_DIR", keyDir)
+	provider, err := kms.New(context.Background(), "local", kms.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewKeyProviderService(map[string]kms.Provider{"local": provider}, "local", testKeyProviderName, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// writeTestKeys writes a random AES key file for every name.
+func writeTestKeys(t *testing.T, keyDir string, names ...string) {
+	for _, name := range names {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(keyDir, name), key, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func keyProviderParameters(params []string) map[string][][]byte {
+	values := make([][]byte, 0, len(params))
+	for _, param := range params {
+		values = append(values, []byte(param))
+	}
+	return map[string][][]byte{testKeyProviderName: values}
+}
+
+// wrap wraps the layer key with the parameters and returns the annotation packet.
+func wrap(s *KeyProviderService, layerKey []byte, params ...string) ([]byte, error) {
+	input, err := json.Marshal(keyWrapProtocolInput{
+		Operation: opKeyWrap,
+		KeyWrapParams: keyWrapParams{
+			Ec:       &config.EncryptConfig{Parameters: keyProviderParameters(params)},
+			OptsData: layerKey,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	output, err := s.WrapKey(context.Background(), &keyproviderpb.KeyProviderKeyWrapProtocolInput{KeyProviderKeyWrapProtocolInput: input})
+	if err != nil {
+		return nil, err
+	}
+	var protoOutput keyWrapProtocolOutput
+	if err := json.Unmarshal(output.KeyProviderKeyWrapProtocolOutput, &protoOutput); err != nil {
+		return nil, err
+	}
+	return protoOutput.KeyWrapResults.Annotation, nil
+}
+
+// unwrap unwraps the layer key of an annotation packet with the parameters.
+func unwrap(s *KeyProviderService, annotation []byte, params ...string) ([]byte, error) {
+	input, err := json.Marshal(keyWrapProtocolInput{
+		Operation: opKeyUnwrap,
+		KeyUnwrapParams: keyUnwrapParams{
+			Dc:         &config.DecryptConfig{Parameters: keyProviderParameters(params)},
+			Annotation: annotation,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	output, err := s.UnWrapKey(context.Background(), &keyproviderpb.KeyProviderKeyWrapProtocolInput{KeyProviderKeyWrapProtocolInput: input})
+	if err != nil {
+		return nil, err
+	}
+	var protoOutput keyWrapProtocolOutput
+	if err := json.Unmarshal(output.KeyProviderKeyWrapProtocolOutput, &protoOutput); err != nil {
+		return nil, err
+	}
+	return protoOutput.KeyUnwrapResults.OptsData, nil
+}
+
+func TestWrapUnwrap(t *testing.T) {
+	keyDir := t.TempDir()
+	writeTestKeys(t, keyDir, "a", "b")
+	s := newTestService(t, keyDir)
+	layerKey := []byte("layer key")
+
+	annotation, err := wrap(s, layerKey, "file://a", "file://b")
+	if err != nil {
+		t.Fatalf("WrapKey: %v", err)
+	}
+	// any single key unwraps, with or without key url scheme
+	for _, key := range []string{"file://a", "b"} {
+		got, err := unwrap(s, annotation, key)
+		if err != nil {
+			t.Fatalf("UnWrapKey with %s: %v", key, err)
+		}
+		if !bytes.Equal(got, layerKey) {
+			t.Fatalf("UnWrapKey with %s returned %q, want %q", key, got, layerKey)
+		}
+	}
+
+	writeTestKeys(t, keyDir, "other")
+	if _, err := unwrap(s, annotation, "file://other"); err == nil {
+		t.Fatal("UnWrapKey with another key succeeded")
+	}
+}
+
+func TestThresholdWrapUnwrap(t *testing.T) {
+	keyDir := t.TempDir()
+	writeTestKeys(t, keyDir, "a", "b", "c")
+	s := newTestService(t, keyDir)
+	layerKey := make([]byte, 32)
+	if _, err := rand.Read(layerKey); err != nil {
+		t.Fatal(err)
+	}
+
+	annotation, err := wrap(s, layerKey, "threshold=2", "file://a", "file://b", "file://c")
+	if err != nil {
+		t.Fatalf("WrapKey: %v", err)
+	}
+	packet, err := decodeAnnotationPacket(annotation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packet.Threshold != 2 || len(packet.Recipients) != 3 {
+		t.Fatalf("packet has threshold %d and %d recipients, want 2 and 3", packet.Threshold, len(packet.Recipients))
+	}
+
+	for _, keys := range [][]string{
+		{"file://a", "file://b"},
+		{"file://b", "file://c"},
+		{"file://c", "file://a"},
+		{"file://a", "file://b", "file://c"},
+		// the threshold of the packet applies, not the one supplied for decryption
+		{"threshold=3", "file://a", "file://c"},
+	} {
+		got, err := unwrap(s, annotation, keys...)
+		if err != nil {
+			t.Fatalf("UnWrapKey with %v: %v", keys, err)
+		}
+		if !bytes.Equal(got, layerKey) {
+			t.Fatalf("UnWrapKey with %v returned a wrong layer key", keys)
+		}
+	}
+
+	for _, keys := range [][]string{
+		{"file://a"},
+		// the same key in two forms decrypts one share only
+		{"file://a", "a"},
+		{"file://b", "file://b"},
+	} {
+		if _, err := unwrap(s, annotation, keys...); err == nil {
+			t.Fatalf("UnWrapKey with %v, fewer than the threshold of distinct keys, succeeded", keys)
+		}
+	}
+}
+
+func TestThresholdWrapInvalid(t *testing.T) {
+	keyDir := t.TempDir()
+	writeTestKeys(t, keyDir, "a", "b", "c")
+	s := newTestService(t, keyDir)
+
+	for _, params := range [][]string{
+		{"threshold=2", "file://a", "file://a"},
+		{"threshold=2", "file://a", "a", "file://b"},
+		{"threshold=3", "file://a", "file://b"},
+		{"threshold=1", "file://a", "file://b"},
+	} {
+		_, err := wrap(s, []byte("layer key"), params...)
+		if status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("WrapKey with %v returned %v, want %v", params, err, codes.InvalidArgument)
+		}
+	}
+}
+
+func TestWrapStoresKeyURLWithoutPIN(t *testing.T) {
+	keyDir := t.TempDir()
+	// the local provider stands in for a pkcs11 token, it reads the key from a file named like the key id
+	key := "pkcs11:token=kms;object=layers?module-path=softhsm.so&pin-value=1234"
+	writeTestKeys(t, keyDir, key)
+	s := newTestService(t, keyDir)
+	s.kmsProviders["pkcs11"] = s.kmsProviders["local"]
+	layerKey := []byte("layer key")
+
+	annotation, err := wrap(s, layerKey, key)
+	if err != nil {
+		t.Fatalf("WrapKey: %v", err)
+	}
+	if bytes.Contains(annotation, []byte("1234")) {
+		t.Fatalf("annotation %s contains the pin", annotation)
+	}
+	packet, err := decodeAnnotationPacket(annotation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "pkcs11:token=kms;object=layers?module-path=softhsm.so"; packet.Recipients[0].KeyUrl != want {
+		t.Fatalf("recipient has key url %s, want %s", packet.Recipients[0].KeyUrl, want)
+	}
+
+	got, err := unwrap(s, annotation, key)
+	if err != nil {
+		t.Fatalf("UnWrapKey: %v", err)
+	}
+	if !bytes.Equal(got, layerKey) {
+		t.Fatalf("UnWrapKey returned %q, want %q", got, layerKey)
+	}
+
+	// errors name the key url without the pin
+	_, err = unwrap(newTestService(t, keyDir), annotation, key)
+	if err == nil || strings.Contains(err.Error(), "1234") {
+		t.Fatalf("UnWrapKey without the pkcs11 provider returned %v, want an error without the pin", err)
+	}
+}
+
+// rsaProvider is an asymmetric provider whose keys can't encrypt, like asymmetric keys of a kms.
+// Without a private key it has no public key either, like a symmetric key failing to encrypt.
+type rsaProvider struct {
+	priv       *rsa.PrivateKey
+	encryptErr error
+	publicKeys int
+}
+
+func (p *rsaProvider) Encrypt(context.Context, []byte, string, kms.EncryptionContext) ([]byte, error) {
+	return nil, p.encryptErr
+}
+
+func (p *rsaProvider) Decrypt(context.Context, []byte, string, kms.EncryptionContext) ([]byte, error) {
+	return nil, p.encryptErr
+}
+
+func (p *rsaProvider) SupportsEncryptionContext() bool {
+	return false
+}
+
+func (p *rsaProvider) PublicKey(context.Context, string, string) (crypto.PublicKey, error) {
+	p.publicKeys++
+	if p.priv == nil {
+		return nil, errors.New("UnsupportedOperationException")
+	}
+	return &p.priv.PublicKey, nil
+}
+
+func (p *rsaProvider) DecryptAsymmetric(_ context.Context, cipher []byte, _ string, _ string) ([]byte, error) {
+	return rsa.DecryptOAEP(sha256.New(), nil, p.priv, cipher, nil)
+}
+
+func TestCheckKey(t *testing.T) {
+	keyDir := t.TempDir()
+	writeTestKeys(t, keyDir, "layers")
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalidKeyUsage := &kms.Error{Kind: kms.ErrInvalidCiphertext, Err: errors.New("InvalidKeyUsageException")}
+	unavailable := &kms.Error{Kind: kms.ErrUnavailable, Err: errors.New("503")}
+
+	tests := []struct {
+		name           string
+		key            string
+		provider       *rsaProvider
+		wantProvider   string
+		wantErr        error
+		wantPublicKeys int
+	}{
+		{name: "symmetric", key: "layers", wantProvider: "local"},
+		{name: "asymmetric", key: "awskms://alias/rsa", provider: &rsaProvider{priv: priv, encryptErr: invalidKeyUsage}, wantProvider: "aws", wantPublicKeys: 1},
+		// the error of the encryption is returned for keys without public key
+		{name: "failing symmetric", key: "awskms://alias/layers", provider: &rsaProvider{encryptErr: invalidKeyUsage}, wantProvider: "aws", wantErr: kms.ErrInvalidCiphertext, wantPublicKeys: 1},
+		{name: "unavailable", key: "awskms://alias/rsa", provider: &rsaProvider{priv: priv, encryptErr: unavailable}, wantProvider: "aws", wantErr: kms.ErrUnavailable},
+		{name: "provider not enabled", key: "gcpkms://projects/p/locations/l/keyRings/r/cryptoKeys/layers", wantErr: errProviderNotEnabled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t, keyDir)
+			if tt.provider != nil {
+				s.kmsProviders["aws"] = tt.provider
+			}
+			provider, err := s.CheckKey(context.Background(), tt.key)
+			if provider != tt.wantProvider || !errors.Is(err, tt.wantErr) {
+				t.Fatalf("CheckKey returned %q, %v, want %q, %v", provider, err, tt.wantProvider, tt.wantErr)
+			}
+			if tt.provider != nil && tt.provider.publicKeys != tt.wantPublicKeys {
+				t.Fatalf("CheckKey fetched the public key %d times, want %d", tt.provider.publicKeys, tt.wantPublicKeys)
+			}
+		})
+	}
+}
+
+func TestWrapAsymmetric(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	invalidKeyUsage := &kms.Error{Kind: kms.ErrInvalidCiphertext, Err: errors.New("InvalidKeyUsageException")}
+	layerKey := []byte("layer key")
+
+	tests := []struct {
+		name           string
+		params         []string
+		wantPublicKeys int
+	}{
+		{name: "fetched public key", params: []string{"awskms://alias/rsa", "algorithm=" + kms.AlgorithmRSAOAEPSHA256}, wantPublicKeys: 1},
+		{name: "supplied public key", params: []string{"awskms://alias/rsa", "public-key=" + publicKey}},
+		{name: "supplied base64 public key", params: []string{"awskms://alias/rsa", "public-key=" + base64.StdEncoding.EncodeToString([]byte(publicKey))}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t, t.TempDir(), WithEncryptionContext([]string{EncryptionContextRepository}))
+			provider := &rsaProvider{priv: priv, encryptErr: invalidKeyUsage}
+			s.kmsProviders["aws"] = provider
+			params := append(tt.params, "repository=registry.example.com/app")
+
+			annotation, err := wrap(s, layerKey, params...)
+			if err != nil {
+				t.Fatalf("WrapKey: %v", err)
+			}
+			if provider.publicKeys != tt.wantPublicKeys {
+				t.Fatalf("WrapKey fetched the public key %d times, want %d", provider.publicKeys, tt.wantPublicKeys)
+			}
+			packet, err := decodeAnnotationPacket(annotation)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r := packet.Recipients[0]; r.Algorithm != kms.AlgorithmRSAOAEPSHA256 || r.EncryptionContext[EncryptionContextRepository] != "registry.example.com/app" {
+				t.Fatalf("recipient has algorithm %q and encryption context %v", r.Algorithm, r.EncryptionContext)
+			}
+
+			// unwrapping decrypts with the kms
+			got, err := unwrap(s, annotation, "awskms://alias/rsa", "repository=registry.example.com/app")
+			if err != nil {
+				t.Fatalf("UnWrapKey: %v", err)
+			}
+			if !bytes.Equal(got, layerKey) {
+				t.Fatalf("UnWrapKey returned %q, want %q", got, layerKey)
+			}
+			if _, err := unwrap(s, annotation, "awskms://alias/rsa", "repository=registry.example.com/other"); err == nil {
+				t.Fatal("UnWrapKey with another repository succeeded")
+			}
+		})
+	}
+
+	t.Run("key without public key", func(t *testing.T) {
+		s := newTestService(t, t.TempDir())
+		s.kmsProviders["aws"] = &rsaProvider{encryptErr: invalidKeyUsage}
+		if _, err := wrap(s, layerKey, "awskms://alias/layers", "algorithm="+kms.AlgorithmRSAOAEPSHA256); err == nil {
+			t.Fatal("WrapKey succeeded without public key")
+		}
+	})
+}
@@ -0,0 +1,132 @@
+// Package shamir implements Shamir's secret sharing over GF(2^8).
+package shamir
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// Split splits secret into n shares, of which any threshold shares are needed to recover it.
+// Each share is one byte longer than the secret, the last byte holds the x coordinate of the share.
+func Split(secret []byte, n int, threshold int) ([][]byte, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("cannot split an empty secret")
+	}
+	if threshold < 2 || threshold > n || n > 255 {
+		return nil, fmt.Errorf("invalid threshold %d of %d shares, need 2 <= threshold <= shares <= 255", threshold, n)
+	}
+
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][len(secret)] = byte(i + 1)
+	}
+
+	coefficients := make([]byte, threshold)
+	defer clear(coefficients)
+	for idx, b := range secret {
+		// random polynomial of degree threshold-1 with the secret byte as intercept
+		coefficients[0] = b
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, err
+		}
+		for i := range shares {
+			shares[i][idx] = evaluate(coefficients, byte(i+1))
+		}
+	}
+	return shares, nil
+}
+
+// Combine recovers the secret from at least threshold shares created by Split.
+// Combining fewer shares than the threshold returns a wrong secret, not an error.
+func Combine(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, errors.New("at least two shares are needed")
+	}
+	length := len(shares[0])
+	if length < 2 {
+		return nil, errors.New("share is too short")
+	}
+	xs := make([]byte, len(shares))
+	seen := map[byte]bool{}
+	for i, share := range shares {
+		if len(share) != length {
+			return nil, errors.New("shares have different lengths")
+		}
+		x := share[length-1]
+		if x == 0 || seen[x] {
+			return nil, errors.New("shares have invalid or duplicate x coordinates")
+		}
+		seen[x] = true
+		xs[i] = x
+	}
+
+	secret := make([]byte, length-1)
+	ys := make([]byte, len(shares))
+	defer clear(ys)
+	for idx := range secret {
+		for i, share := range shares {
+			ys[i] = share[idx]
+		}
+		secret[idx] = interpolateAtZero(xs, ys)
+	}
+	return secret, nil
+}
+
+// evaluate returns the value of the polynomial at x using Horner's method.
+func evaluate(coefficients []byte, x byte) byte {
+	result := coefficients[len(coefficients)-1]
+	for i := len(coefficients) - 2; i >= 0; i-- {
+		result = add(mul(result, x), coefficients[i])
+	}
+	return result
+}
+
+// interpolateAtZero returns the value at 0 of the lagrange polynomial through the points.
+func interpolateAtZero(xs []byte, ys []byte) byte {
+	var result byte
+	for i := range xs {
+		basis := byte(1)
+		for j := range xs {
+			if i == j {
+				continue
+			}
+			// x_j / (x_j - x_i), subtraction is addition in GF(2^8)
+			basis = mul(basis, div(xs[j], add(xs[j], xs[i])))
+		}
+		result = add(result, mul(ys[i], basis))
+	}
+	return result
+}
+
+func add(a, b byte) byte {
+	return a ^ b
+}
+
+// mul multiplies in GF(2^8) with the AES polynomial x^8 + x^4 + x^3 + x + 1, without data dependent branches.
+func mul(a, b byte) byte {
+	var result byte
+	for i := 0; i < 8; i++ {
+		result ^= a & -(b & 1)
+		carry := -(a >> 7)
+		a = (a << 1) ^ (0x1b & carry)
+		b >>= 1
+	}
+	return result
+}
+
+// div divides in GF(2^8), b must not be zero.
+func div(a, b byte) byte {
+	return mul(a, inverse(b))
+}
+
+// inverse returns b^254, which is the multiplicative inverse of b in GF(2^8).
+func inverse(b byte) byte {
+	result := b
+	for i := 0; i < 6; i++ {
+		result = mul(result, result)
+		result = mul(result, b)
+	}
+	return mul(result, result)
+}
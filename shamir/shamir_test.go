@@ -0,0 +1,94 @@
+package shamir
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestSplitCombine(t *testing.T) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		t.Fatal(err)
+	}
+	shares, err := Split(secret, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shares) != 5 {
+		t.Fatalf("Split returned %d shares, want 5", len(shares))
+	}
+
+	// every subset of at least three shares recovers the secret
+	for subset := 1; subset < 1<<len(shares); subset++ {
+		var selected [][]byte
+		for i, share := range shares {
+			if subset&(1<<i) != 0 {
+				selected = append(selected, share)
+			}
+		}
+		if len(selected) < 2 {
+			continue
+		}
+		combined, err := Combine(selected)
+		if err != nil {
+			t.Fatalf("Combine of %d shares: %v", len(selected), err)
+		}
+		if recovered := bytes.Equal(combined, secret); recovered != (len(selected) >= 3) {
+			t.Fatalf("Combine of %d shares of threshold 3 recovered the secret: %v", len(selected), recovered)
+		}
+	}
+}
+
+func TestSplitInvalid(t *testing.T) {
+	tests := []struct {
+		name      string
+		secret    []byte
+		n         int
+		threshold int
+	}{
+		{name: "empty secret", secret: nil, n: 3, threshold: 2},
+		{name: "threshold of one", secret: []byte("secret"), n: 3, threshold: 1},
+		{name: "threshold above shares", secret: []byte("secret"), n: 2, threshold: 3},
+		{name: "too many shares", secret: []byte("secret"), n: 256, threshold: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Split(tt.secret, tt.n, tt.threshold); err == nil {
+				t.Fatal("Split succeeded")
+			}
+		})
+	}
+}
+
+func TestCombineInvalid(t *testing.T) {
+	shares, err := Split([]byte("secret"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		shares [][]byte
+	}{
+		{name: "single share", shares: shares[:1]},
+		{name: "duplicate share", shares: [][]byte{shares[0], shares[0]}},
+		{name: "different lengths", shares: [][]byte{shares[0], append(bytes.Clone(shares[1]), 1)}},
+		{name: "x coordinate zero", shares: [][]byte{shares[0], append(bytes.Clone(shares[1][:len(shares[1])-1]), 0)}},
+		{name: "too short", shares: [][]byte{{1}, {2}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Combine(tt.shares); err == nil {
+				t.Fatal("Combine succeeded")
+			}
+		})
+	}
+}
+
+func TestMulInverse(t *testing.T) {
+	for b := 1; b < 256; b++ {
+		if got := mul(byte(b), inverse(byte(b))); got != 1 {
+			t.Fatalf("%d * inverse(%d) = %d, want 1", b, b, got)
+		}
+	}
+}
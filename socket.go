@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// listenUnix listens on a unix socket with the file mode and owner, replacing a stale socket of a previous run.
+// owner is "<user>[:<group>]" by name or id, empty keeps the owner of the process.
+func listenUnix(path string, mode fs.FileMode, owner string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	// the owner is changed before the mode opens the socket to others
+	lis, err := listenPrivate(path)
+	if err != nil {
+		return nil, err
+	}
+	if owner != "" {
+		uid, gid, err := lookupOwner(owner)
+		if err != nil {
+			lis.Close()
+			return nil, err
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			lis.Close()
+			return nil, err
+		}
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		lis.Close()
+		return nil, err
+	}
+	return lis, nil
+}
+
+// lookupOwner resolves "<user>[:<group>]" to ids, the group is -1 (unchanged) if it is missing.
+func lookupOwner(owner string) (uid int, gid int, err error) {
+	userName, groupName, hasGroup := strings.Cut(owner, ":")
+	uid, err = strconv.Atoi(userName)
+	if err != nil {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			return 0, 0, err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return 0, 0, err
+		}
+	}
+	gid = -1
+	if hasGroup {
+		gid, err = strconv.Atoi(groupName)
+		if err != nil {
+			g, err := user.LookupGroup(groupName)
+			if err != nil {
+				return 0, 0, err
+			}
+			if gid, err = strconv.Atoi(g.Gid); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	return uid, gid, nil
+}
+
+// peerAllowlist authorizes callers on a unix socket by their process credentials.
+// Every non-empty list must contain the id of the caller.
+type peerAllowlist struct {
+	uids []uint32
+	gids []uint32
+	pids []int32
+}
+
+func (a peerAllowlist) empty() bool {
+	return len(a.uids) == 0 && len(a.gids) == 0 && len(a.pids) == 0
+}
+
+func (a peerAllowlist) allows(cred peerCred) bool {
+	return allowed(a.uids, cred.uid) && allowed(a.gids, cred.gid) && allowed(a.pids, cred.pid)
+}
+
+func allowed[T comparable](list []T, id T) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, allowedID := range list {
+		if allowedID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIDs parses a comma separated list of numeric ids.
+func parseIDs[T int32 | uint32](s string) ([]T, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var ids []T
+	for _, field := range strings.Split(s, ",") {
+		id, err := strconv.ParseInt(strings.TrimSpace(field), 10, 32)
+		if err != nil || id < 0 {
+			return nil, fmt.Errorf("invalid id %q", field)
+		}
+		ids = append(ids, T(id))
+	}
+	return ids, nil
+}
+
+// peerCred are the credentials of the process on the other end of a unix socket.
+type peerCred struct {
+	uid uint32
+	gid uint32
+	pid int32
+}
+
+// peerCredAuthInfo is the AuthInfo of connections authorized by their peer credentials.
+type peerCredAuthInfo struct {
+	credentials.CommonAuthInfo
+	Uid uint32
+	Gid uint32
+	Pid int32
+}
+
+// AuthType implements credentials.AuthInfo.
+func (peerCredAuthInfo) AuthType() string {
+	return "peercred"
+}
+
+// CallerIdentity implements audit.CallerIdentity.
+func (i peerCredAuthInfo) CallerIdentity() string {
+	return fmt.Sprintf("uid=%d gid=%d pid=%d", i.Uid, i.Gid, i.Pid)
+}
+
+// peerCredentials are server transport credentials authorizing unix socket connections by the peer credentials.
+type peerCredentials struct {
+	allowlist peerAllowlist
+}
+
+func newPeerCredentials(allowlist peerAllowlist) credentials.TransportCredentials {
+	return &peerCredentials{allowlist: allowlist}
+}
+
+// ServerHandshake implements credentials.TransportCredentials.
+func (c *peerCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	cred, err := getPeerCred(conn)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading peer credentials: %w", err)
+	}
+	if !c.allowlist.allows(cred) {
+		slog.Warn("rejected unix socket connection", "uid", cred.uid, "gid", cred.gid, "pid", cred.pid)
+		return nil, nil, fmt.Errorf("peer uid=%d gid=%d pid=%d is not allowed", cred.uid, cred.gid, cred.pid)
+	}
+	return conn, peerCredAuthInfo{
+		// the socket is local but not encrypted
+		CommonAuthInfo: credentials.CommonAuthInfo{SecurityLevel: credentials.NoSecurity},
+		Uid:            cred.uid,
+		Gid:            cred.gid,
+		Pid:            cred.pid,
+	}, nil
+}
+
+// ClientHandshake implements credentials.TransportCredentials.
+func (c *peerCredentials) ClientHandshake(context.Context, string, net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, errors.New("peer credentials only authorize servers")
+}
+
+// Info implements credentials.TransportCredentials.
+func (c *peerCredentials) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: "peercred"}
+}
+
+// Clone implements credentials.TransportCredentials.
+func (c *peerCredentials) Clone() credentials.TransportCredentials {
+	return &peerCredentials{allowlist: c.allowlist}
+}
+
+// OverrideServerName implements credentials.TransportCredentials.
+func (c *peerCredentials) OverrideServerName(string) error {
+	return nil
+}
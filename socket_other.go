@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "net"
+
+// listenPrivate listens on a unix socket, its mode is set by the caller.
+func listenPrivate(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os/user"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestParseIDs(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    []uint32
+		wantErr bool
+	}{
+		{input: "", want: nil},
+		{input: "0", want: []uint32{0}},
+		{input: "1000, 1001,65534", want: []uint32{1000, 1001, 65534}},
+		{input: "2147483647", want: []uint32{2147483647}},
+		{input: "2147483648", wantErr: true},
+		{input: "-1", wantErr: true},
+		{input: "root", wantErr: true},
+		{input: "1000,", wantErr: true},
+		{input: ",", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			ids, err := parseIDs[uint32](tt.input)
+			if (err != nil) != tt.wantErr || !slices.Equal(ids, tt.want) {
+				t.Fatalf("parseIDs returned %v, %v, want %v, error %v", ids, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+
+	pids, err := parseIDs[int32]("1,42")
+	if err != nil || !slices.Equal(pids, []int32{1, 42}) {
+		t.Fatalf("parseIDs of pids returned %v, %v", pids, err)
+	}
+}
+
+func TestPeerAllowlist(t *testing.T) {
+	cred := peerCred{uid: 1000, gid: 100, pid: 42}
+	tests := []struct {
+		name      string
+		allowlist peerAllowlist
+		want      bool
+	}{
+		{name: "empty", allowlist: peerAllowlist{}, want: true},
+		{name: "uid", allowlist: peerAllowlist{uids: []uint32{0, 1000}}, want: true},
+		{name: "other uid", allowlist: peerAllowlist{uids: []uint32{0}}, want: false},
+		{name: "uid and gid", allowlist: peerAllowlist{uids: []uint32{1000}, gids: []uint32{100}}, want: true},
+		{name: "uid and other gid", allowlist: peerAllowlist{uids: []uint32{1000}, gids: []uint32{0}}, want: false},
+		{name: "other pid", allowlist: peerAllowlist{pids: []int32{1}}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.allowlist.allows(cred); got != tt.want {
+				t.Fatalf("allows returned %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLookupOwner(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Skipf("no current user: %v", err)
+	}
+	uid, err := strconv.Atoi(current.Uid)
+	if err != nil {
+		t.Skipf("user ids are not numeric: %s", current.Uid)
+	}
+	group, err := user.LookupGroupId(current.Gid)
+	if err != nil {
+		t.Skipf("no group of the current user: %v", err)
+	}
+	gid, _ := strconv.Atoi(current.Gid)
+
+	tests := []struct {
+		owner    string
+		uid, gid int
+	}{
+		{owner: "1000", uid: 1000, gid: -1},
+		{owner: "1000:2000", uid: 1000, gid: 2000},
+		{owner: current.Username, uid: uid, gid: -1},
+		{owner: current.Username + ":" + group.Name, uid: uid, gid: gid},
+		{owner: "1000:" + group.Name, uid: 1000, gid: gid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.owner, func(t *testing.T) {
+			uid, gid, err := lookupOwner(tt.owner)
+			if err != nil || uid != tt.uid || gid != tt.gid {
+				t.Fatalf("lookupOwner returned %d, %d, %v, want %d, %d", uid, gid, err, tt.uid, tt.gid)
+			}
+		})
+	}
+
+	for _, owner := range []string{"kms-ocicrypt-missing-user", "1000:kms-ocicrypt-missing-group"} {
+		if uid, gid, err := lookupOwner(owner); err == nil {
+			t.Fatalf("lookupOwner of %s returned %d, %d", owner, uid, gid)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenPrivate listens on a unix socket created with mode 0600, so nobody can connect before its mode is set.
+// The umask is process wide, files created meanwhile by other goroutines get at most the same mode.
+func listenPrivate(path string) (net.Listener, error) {
+	umask := syscall.Umask(0o177)
+	defer syscall.Umask(umask)
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,42 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kms-ocicrypt.sock")
+	owner := fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
+
+	for _, mode := range []fs.FileMode{0o660, 0o600} {
+		// the socket of the previous iteration is stale and replaced
+		lis, err := listenUnix(path, mode, owner)
+		if err != nil {
+			t.Fatalf("listenUnix with mode %v: %v", mode, err)
+		}
+		info, err := os.Lstat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Type() != fs.ModeSocket || info.Mode().Perm() != mode {
+			t.Fatalf("socket has mode %v, want a socket with %v", info.Mode(), mode)
+		}
+		// the listener doesn't remove the socket on close, like a crashed process
+		lis.(interface{ SetUnlinkOnClose(bool) }).SetUnlinkOnClose(false)
+		lis.Close()
+	}
+
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenUnix(file, 0o660, ""); err == nil {
+		t.Fatal("listenUnix replaced a file that is not a socket")
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// tlsReloadInterval is how often the certificate files are checked for changes.
+const tlsReloadInterval = 10 * time.Second
+
+// tlsReloader serves the server certificate and client CA bundle from files and reloads them when they change,
+// e.g. when cert-manager rotates the certificate of a mounted secret.
+type tlsReloader struct {
+	certFile, keyFile, clientCAFile string
+
+	mu        sync.Mutex
+	config    *tls.Config
+	modTimes  []time.Time
+	lastCheck time.Time
+}
+
+// newTLSReloader loads the certificate, key and optional client CA bundle.
+// With a client CA bundle, clients must present a certificate signed by it.
+func newTLSReloader(certFile, keyFile, clientCAFile string) (*tlsReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("tls needs a certificate and a key file")
+	}
+	r := &tlsReloader{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile}
+	modTimes, err := r.statFiles()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modTimes); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// serverConfig returns the tls config of the listener, which picks up reloaded files on every handshake.
+func (r *tlsReloader) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.current(), nil
+		},
+	}
+}
+
+// current returns the config of the files, reloading them if they changed since the last check.
+// A failed reload keeps serving the previous files.
+func (r *tlsReloader) current() *tls.Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.lastCheck) < tlsReloadInterval {
+		return r.config
+	}
+	r.lastCheck = time.Now()
+
+	modTimes, err := r.statFiles()
+	if err != nil {
+		slog.Error("checking tls files for changes", "error", err)
+		return r.config
+	}
+	if equalTimes(modTimes, r.modTimes) {
+		return r.config
+	}
+	if err := r.load(modTimes); err != nil {
+		slog.Error("reloading tls files, serving the previous certificate", "error", err)
+		return r.config
+	}
+	slog.Info("reloaded tls files", "cert", r.certFile)
+	return r.config
+}
+
+// load reads the files, r.mu must be held or r not yet shared.
+func (r *tlsReloader) load(modTimes []time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading tls certificate: %w", err)
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2"},
+	}
+	if r.clientCAFile != "" {
+		pem, err := os.ReadFile(r.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("reading tls client CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", r.clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	r.config = config
+	r.modTimes = modTimes
+	return nil
+}
+
+func (r *tlsReloader) statFiles() ([]time.Time, error) {
+	files := []string{r.certFile, r.keyFile}
+	if r.clientCAFile != "" {
+		files = append(files, r.clientCAFile)
+	}
+	modTimes := make([]time.Time, 0, len(files))
+	for _, file := range files {
+		// Stat follows the symlinks kubelet swaps when a mounted secret changes
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+	return modTimes, nil
+}
+
+func equalTimes(a, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
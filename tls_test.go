@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate with the common name and its key to the files.
+// The modification time is set explicitly, so a rewrite is detected on file systems with coarse timestamps.
+func writeTestCert(t *testing.T, certFile, keyFile, commonName string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), modTime)
+	writeTestFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), modTime)
+}
+
+func writeTestFile(t *testing.T, file string, data []byte, modTime time.Time) {
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// servedCommonName returns the common name of the certificate served in a handshake with the reloader.
+// The reload interval is skipped, so the files are checked on every handshake.
+func servedCommonName(t *testing.T, r *tlsReloader) string {
+	r.mu.Lock()
+	r.lastCheck = time.Time{}
+	r.mu.Unlock()
+
+	lis, err := tls.Listen("tcp", "127.0.0.1:0", r.serverConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.(*tls.Conn).Handshake()
+	}()
+
+	conn, err := tls.Dial("tcp", lis.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestTLSReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	modTime := time.Now().Add(-time.Hour)
+	writeTestCert(t, certFile, keyFile, "first", modTime)
+
+	r, err := newTLSReloader(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := servedCommonName(t, r); name != "first" {
+		t.Fatalf("served certificate %q, want first", name)
+	}
+
+	// a rotated certificate is served from the next handshake on
+	modTime = modTime.Add(time.Minute)
+	writeTestCert(t, certFile, keyFile, "second", modTime)
+	if name := servedCommonName(t, r); name != "second" {
+		t.Fatalf("served certificate %q after the rewrite, want second", name)
+	}
+
+	// a broken rewrite keeps serving the previous certificate
+	modTime = modTime.Add(time.Minute)
+	writeTestFile(t, keyFile, []byte("not a key"), modTime)
+	if name := servedCommonName(t, r); name != "second" {
+		t.Fatalf("served certificate %q after a broken rewrite, want second", name)
+	}
+	if err := os.Remove(certFile); err != nil {
+		t.Fatal(err)
+	}
+	if name := servedCommonName(t, r); name != "second" {
+		t.Fatalf("served certificate %q after removing the certificate, want second", name)
+	}
+
+	// and the next valid rewrite is picked up again
+	modTime = modTime.Add(time.Minute)
+	writeTestCert(t, certFile, keyFile, "third", modTime)
+	if name := servedCommonName(t, r); name != "third" {
+		t.Fatalf("served certificate %q after repairing the files, want third", name)
+	}
+}
+
+func TestTLSReloaderInvalidFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeTestCert(t, certFile, keyFile, "server", time.Now())
+	invalid := filepath.Join(dir, "invalid.pem")
+	writeTestFile(t, invalid, []byte("not a certificate"), time.Now())
+
+	tests := []struct {
+		name                            string
+		certFile, keyFile, clientCAFile string
+	}{
+		{name: "no key", certFile: certFile},
+		{name: "missing certificate", certFile: filepath.Join(dir, "missing.crt"), keyFile: keyFile},
+		{name: "invalid key", certFile: certFile, keyFile: invalid},
+		{name: "missing client CA", certFile: certFile, keyFile: keyFile, clientCAFile: filepath.Join(dir, "missing.pem")},
+		{name: "invalid client CA", certFile: certFile, keyFile: keyFile, clientCAFile: invalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newTLSReloader(tt.certFile, tt.keyFile, tt.clientCAFile); err == nil {
+				t.Fatal("newTLSReloader succeeded")
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"google.golang.org/grpc"
+)
+
+const tracingServiceName = "kms-ocicrypt"
+
+// tracingEnabled reports whether an otlp endpoint is configured with the standard environment variables
+// and the sdk isn't disabled.
+func tracingEnabled() bool {
+	if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") {
+		return false
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// setupTracing exports spans to the otlp endpoint of the OTEL_EXPORTER_OTLP_* environment variables and
+// propagates the w3c trace context of incoming requests. shutdown flushes the spans not exported yet.
+func setupTracing(ctx context.Context) (shutdown func(context.Context) error, err error) {
+	exporter, err := newOTLPExporter(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("creating otlp trace exporter: %w", err)
+	}
+	return installTracing(ctx, sdktrace.WithBatcher(exporter))
+}
+
+// installTracing sets the global tracer provider exporting with the span processor and the propagators.
+func installTracing(ctx context.Context, processor sdktrace.TracerProviderOption) (shutdown func(context.Context) error, err error) {
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES are detected last and take precedence
+	res, err := resource.New(ctx,
+		resource.WithSchemaURL(semconv.SchemaURL),
+		resource.WithAttributes(semconv.ServiceName(tracingServiceName)),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating trace resource: %w", err)
+	}
+	// the sampler is configured with OTEL_TRACES_SAMPLER and OTEL_TRACES_SAMPLER_ARG
+	tracerProvider := sdktrace.NewTracerProvider(
+		processor,
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return tracerProvider.Shutdown, nil
+}
+
+// tracingServerOption instruments the grpc server with a span of every request, the child of the propagated trace context.
+func tracingServerOption() grpc.ServerOption {
+	return grpc.StatsHandler(otelgrpc.NewServerHandler())
+}
+
+// newOTLPExporter creates the exporter of the protocol in OTEL_EXPORTER_OTLP_TRACES_PROTOCOL or
+// OTEL_EXPORTER_OTLP_PROTOCOL, which defaults to http/protobuf. Endpoint, headers, tls and timeout
+// are read from the environment by the exporter.
+func newOTLPExporter(ctx context.Context) (*otlptrace.Exporter, error) {
+	protocol := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL")
+	if protocol == "" {
+		protocol = os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+	}
+	switch protocol {
+	case "", "http/protobuf":
+		return otlptracehttp.New(ctx)
+	case "grpc":
+		return otlptracegrpc.New(ctx)
+	default:
+		return nil, fmt.Errorf("unsupported otlp protocol %q, expected grpc or http/protobuf", protocol)
+	}
+}
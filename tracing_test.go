@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestTracingServer(t *testing.T) {
+	tracerProvider, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		otel.SetTracerProvider(tracerProvider)
+		otel.SetTextMapPropagator(propagator)
+	})
+	exporter := tracetest.NewInMemoryExporter()
+	shutdown, err := installTracing(context.Background(), sdktrace.WithSyncer(exporter))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shutdown(context.Background())
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer(tracingServerOption())
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(lis)
+	defer server.Stop()
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the client propagates the w3c trace context of its span, like an instrumented containerd
+	ctx, parent := otel.Tracer("client").Start(context.Background(), "pull")
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	ctx = metadata.AppendToOutgoingContext(ctx, "traceparent", carrier.Get("traceparent"))
+	if _, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	parent.End()
+
+	var serverSpans []tracetest.SpanStub
+	for _, span := range exporter.GetSpans() {
+		if span.SpanKind == trace.SpanKindServer {
+			serverSpans = append(serverSpans, span)
+		}
+	}
+	if len(serverSpans) != 1 {
+		t.Fatalf("got %d server spans, want 1: %+v", len(serverSpans), exporter.GetSpans())
+	}
+	span := serverSpans[0]
+	if span.Name != "grpc.health.v1.Health/Check" {
+		t.Errorf("server span is named %q, want grpc.health.v1.Health/Check", span.Name)
+	}
+	if span.SpanContext.TraceID() != parent.SpanContext().TraceID() || span.Parent.SpanID() != parent.SpanContext().SpanID() || !span.Parent.IsRemote() {
+		t.Fatalf("server span has trace %s and parent %s, want the child of the client span %s in trace %s",
+			span.SpanContext.TraceID(), span.Parent.SpanID(), parent.SpanContext().SpanID(), parent.SpanContext().TraceID())
+	}
+	if name, _ := span.Resource.Set().Value("service.name"); name.AsString() != tracingServiceName {
+		t.Errorf("server span has service name %q, want %q", name.AsString(), tracingServiceName)
+	}
+}
+
+func TestTracingServiceName(t *testing.T) {
+	tracerProvider, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		otel.SetTracerProvider(tracerProvider)
+		otel.SetTextMapPropagator(propagator)
+	})
+	t.Setenv("OTEL_SERVICE_NAME", "kms-ocicrypt-node")
+	exporter := tracetest.NewInMemoryExporter()
+	shutdown, err := installTracing(context.Background(), sdktrace.WithSyncer(exporter))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shutdown(context.Background())
+
+	_, span := otel.Tracer("test").Start(context.Background(), "span")
+	span.End()
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	if name, _ := spans[0].Resource.Set().Value("service.name"); name.AsString() != "kms-ocicrypt-node" {
+		t.Fatalf("span has service name %q, want the name of OTEL_SERVICE_NAME", name.AsString())
+	}
+}